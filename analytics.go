@@ -0,0 +1,247 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// OfficeStats are rollups of the calls placed to an office's number over the
+// last analyticsWindow, recomputed hourly by the "analytics" job.
+type OfficeStats struct {
+	Phone    string        `datastore:",noindex"` // Also the key.
+	Calls    int           `datastore:",noindex"` // Finished calls.
+	Answered int           `datastore:",noindex"`
+	Busy     int           `datastore:",noindex"`
+	NoAnswer int           `datastore:",noindex"`
+	Duration time.Duration `datastore:",noindex"` // Of answered calls, in total.
+	// Hours breaks down calls by the hour of the day they were placed in
+	// Washington; it's indexed by hour.
+	Hours   []HourStats `datastore:",noindex"`
+	Updated time.Time   `datastore:",noindex"`
+}
+
+type HourStats struct {
+	Calls, Answered int
+}
+
+var ErrNoStats = errors.New("no stats for office")
+
+const (
+	// analyticsWindow is how far back OfficeStats look, so they keep up
+	// with offices changing their ways.
+	analyticsWindow = 90 * 24 * time.Hour
+	// minHourCalls is how many calls an hour needs before we'll say it's
+	// the best.
+	minHourCalls = 5
+)
+
+func rate(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
+
+func (s OfficeStats) AnswerRate() float64 { return rate(s.Answered, s.Calls) }
+func (s OfficeStats) BusyRate() float64   { return rate(s.Busy, s.Calls) }
+
+// AverageDuration is how long answered calls last, on average.
+func (s OfficeStats) AverageDuration() time.Duration {
+	if s.Answered == 0 {
+		return 0
+	}
+	return s.Duration / time.Duration(s.Answered)
+}
+
+// BestHour returns the hour of the day, in Washington, calls are most likely
+// to be answered in, or -1 if no hour has enough calls to tell.
+func (s OfficeStats) BestHour() int {
+	best := -1
+	for h, hs := range s.Hours {
+		if hs.Calls < minHourCalls {
+			continue
+		}
+		if best == -1 || rate(hs.Answered, hs.Calls) > rate(s.Hours[best].Answered, s.Hours[best].Calls) {
+			best = h
+		}
+	}
+	return best
+}
+
+// rollUp computes OfficeStats for each number called in cs. Calls that
+// haven't finished, or weren't placed, are left out.
+func rollUp(cs []Call, now time.Time) map[string]*OfficeStats {
+	loc := capitolHours.location()
+	stats := map[string]*OfficeStats{}
+	for _, c := range cs {
+		for _, l := range c.repLegs() {
+			switch l.State {
+			case StateCompleted, StateBusy, StateNoAnswer, StateFailed, StateCanceled:
+			default:
+				continue
+			}
+			s := stats[l.To]
+			if s == nil {
+				s = &OfficeStats{Phone: l.To, Hours: make([]HourStats, 24), Updated: now}
+				stats[l.To] = s
+			}
+			h := &s.Hours[c.Created.In(loc).Hour()]
+			s.Calls++
+			h.Calls++
+			switch l.State {
+			case StateCompleted:
+				s.Answered++
+				h.Answered++
+				s.Duration += c.Duration
+			case StateBusy:
+				s.Busy++
+			case StateNoAnswer:
+				s.NoAnswer++
+			}
+		}
+	}
+	return stats
+}
+
+func init() {
+	jobHandlers["analytics"] = func(ctx context.Context, _ []byte) error {
+		return runAnalytics(ctx, time.Now())
+	}
+}
+
+// enqueueAnalytics starts the analytics job, at most once an hour.
+func enqueueAnalytics(ctx context.Context) error {
+	return enqueue(ctx, "analytics", "analytics-"+time.Now().UTC().Format("2006010215"), 0, nil)
+}
+
+// runAnalytics recomputes and stores OfficeStats for every office called in
+// the last analyticsWindow.
+func runAnalytics(ctx context.Context, now time.Time) error {
+	cs, err := store.CallsSince(ctx, now.Add(-analyticsWindow))
+	if err != nil {
+		log.Errorf(ctx, "CallsSince: %v", err)
+		return err
+	}
+	stats := rollUp(cs, now)
+	for _, s := range stats {
+		if err := store.PutOfficeStats(ctx, s); err != nil {
+			log.Errorf(ctx, "PutOfficeStats(%s): %v", s.Phone, err)
+			return err
+		}
+	}
+	log.Infof(ctx, "Rolled up %d calls to %d offices", len(cs), len(stats))
+	return nil
+}
+
+// officeReport is how OfficeStats are served by /analytics.
+type officeReport struct {
+	Phone           string    `json:"phone"`
+	Calls           int       `json:"calls"`
+	AnswerRate      float64   `json:"answer_rate"`
+	BusyRate        float64   `json:"busy_rate"`
+	AverageDuration float64   `json:"average_duration_seconds"`
+	BestHour        int       `json:"best_hour"` // In Washington, or -1.
+	Updated         time.Time `json:"updated"`
+}
+
+func newOfficeReport(s OfficeStats) officeReport {
+	return officeReport{
+		Phone:           s.Phone,
+		Calls:           s.Calls,
+		AnswerRate:      s.AnswerRate(),
+		BusyRate:        s.BusyRate(),
+		AverageDuration: s.AverageDuration().Seconds(),
+		BestHour:        s.BestHour(),
+		Updated:         s.Updated,
+	}
+}
+
+// analytics serves OfficeStats as JSON: those for ?phone=, or for every
+// office, most called first.
+func analytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	var v interface{}
+	if n := r.FormValue("phone"); n != "" {
+		s, err := store.GetOfficeStats(ctx, n)
+		if err == ErrNoStats {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Errorf(ctx, "GetOfficeStats(%s): %v", n, err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		v = newOfficeReport(*s)
+	} else {
+		ss, err := store.AllOfficeStats(ctx)
+		if err != nil {
+			log.Errorf(ctx, "AllOfficeStats: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		sort.Slice(ss, func(i, j int) bool { return ss[i].Calls > ss[j].Calls })
+		rs := []officeReport{}
+		for _, s := range ss {
+			rs = append(rs, newOfficeReport(s))
+		}
+		v = rs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf(ctx, "Encode: %v", err)
+	}
+}
+
+// betterTime returns a time later today to call the office instead of now,
+// if it's historically much more likely to answer then, and the user can be
+// called then.
+func betterTime(ctx context.Context, u User, o Office, now time.Time) (time.Time, bool) {
+	s, err := store.GetOfficeStats(ctx, o.Phone)
+	if err != nil {
+		if err != ErrNoStats {
+			log.Errorf(ctx, "GetOfficeStats(%s): %v", o.Phone, err)
+		}
+		return time.Time{}, false
+	}
+	best := s.BestHour()
+	if best == -1 || len(s.Hours) != 24 {
+		return time.Time{}, false
+	}
+	loc := capitolHours.location()
+	cur := s.Hours[now.In(loc).Hour()]
+	// Unless this hour is much worse, it's not worth the wait.
+	if cur.Calls >= minHourCalls && rate(cur.Answered, cur.Calls)+0.1 > rate(s.Hours[best].Answered, s.Hours[best].Calls) {
+		return time.Time{}, false
+	}
+
+	y, m, d := now.In(u.Location()).Date()
+	from, to := callWindow(u, o.OpenHours(), y, m, d)
+	dc := now.In(loc)
+	hourStart := time.Date(dc.Year(), dc.Month(), dc.Day(), best, 0, 0, 0, loc)
+	hourEnd := hourStart.Add(time.Hour)
+	if hourStart.After(from) {
+		from = hourStart
+	}
+	if hourEnd.Before(to) {
+		to = hourEnd
+	}
+	if now.After(from) {
+		from = now
+	}
+	if !from.Before(to) {
+		return time.Time{}, false // It's passed, or the user can't then.
+	}
+	return from.Add(time.Duration(rand.Int63n(int64(to.Sub(from))))), true
+}
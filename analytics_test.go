@@ -0,0 +1,132 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRollUp(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	at := func(h int) time.Time { return time.Date(2017, 3, 1, h, 30, 0, 0, ny) }
+	var cs []Call
+	add := func(to string, h int, status CallState, n int) {
+		for i := 0; i < n; i++ {
+			cs = append(cs, Call{To: to, Created: at(h), Status: status, Duration: 2 * time.Minute})
+		}
+	}
+	add("5550000", 10, "completed", 2)
+	add("5550000", 10, "busy", 3)
+	add("5550000", 14, "completed", 4)
+	add("5550000", 14, "no-answer", 1)
+	add("5550000", 15, "completed", 1) // Too few to be best.
+	add("5550000", 11, "skipped", 5)   // Never placed.
+	add("5551111", 12, "new", 1)
+
+	stats := rollUp(cs, at(16))
+	if len(stats) != 1 {
+		t.Fatalf("rollUp: got stats for %d offices, want 1", len(stats))
+	}
+	s := stats["5550000"]
+	if s.Calls != 11 || s.Answered != 7 || s.Busy != 3 || s.NoAnswer != 1 {
+		t.Errorf("rollUp: got %+v", s)
+	}
+	if got, want := s.AnswerRate(), 7.0/11; got != want {
+		t.Errorf("AnswerRate: got %v, want %v", got, want)
+	}
+	if got, want := s.BusyRate(), 3.0/11; got != want {
+		t.Errorf("BusyRate: got %v, want %v", got, want)
+	}
+	if got := s.AverageDuration(); got != 2*time.Minute {
+		t.Errorf("AverageDuration: got %s, want 2m", got)
+	}
+	if got := s.BestHour(); got != 14 {
+		t.Errorf("BestHour: got %d, want 14", got)
+	}
+	if got := (OfficeStats{}).BestHour(); got != -1 {
+		t.Errorf("BestHour with no calls: got %d, want -1", got)
+	}
+}
+
+func TestAnalyticsEndpoint(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	now := time.Now()
+	for _, c := range []*Call{
+		{Key: "a", From: userPhone, To: "5550000", Created: now.Add(-time.Hour), Status: "completed", Duration: time.Minute},
+		{Key: "b", From: userPhone, To: "5550000", Created: now.Add(-2 * time.Hour), Status: "busy"},
+		{Key: "c", From: userPhone, To: "5551111", Created: now.Add(-time.Hour), Status: "completed"},
+		{Key: "d", From: userPhone, To: "5551111", Created: now.Add(-100 * 24 * time.Hour), Status: "completed"}, // Too old.
+	} {
+		if err := store.PutCall(ctx, c); err != nil {
+			t.Fatalf("PutCall: %v", err)
+		}
+	}
+	if err := runAnalytics(ctx, now); err != nil {
+		t.Fatalf("runAnalytics: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	analytics(w, httptest.NewRequest("GET", "/analytics", nil))
+	var rs []officeReport
+	if err := json.NewDecoder(w.Body).Decode(&rs); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(rs) != 2 || rs[0].Phone != "5550000" || rs[0].Calls != 2 || rs[0].AnswerRate != 0.5 || rs[0].BusyRate != 0.5 || rs[0].AverageDuration != 60 {
+		t.Errorf("/analytics: got %+v", rs)
+	}
+	if len(rs) == 2 && rs[1].Calls != 1 {
+		t.Errorf("/analytics: got %d calls to %s, want 1", rs[1].Calls, rs[1].Phone)
+	}
+
+	w = httptest.NewRecorder()
+	analytics(w, httptest.NewRequest("GET", "/analytics?phone=5551111", nil))
+	var r officeReport
+	if err := json.NewDecoder(w.Body).Decode(&r); err != nil {
+		t.Fatalf("Decode: %v", err)
+	} else if r.Phone != "5551111" || r.AnswerRate != 1 || r.BestHour != -1 {
+		t.Errorf("/analytics?phone=5551111: got %+v", r)
+	}
+
+	w = httptest.NewRecorder()
+	analytics(w, httptest.NewRequest("GET", "/analytics?phone=5559999", nil))
+	if w.Code != 404 {
+		t.Errorf("/analytics for an unknown office: got %d, want 404", w.Code)
+	}
+}
+
+func TestBetterTime(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	ny, _ := time.LoadLocation("America/New_York")
+	o := Office{Phone: "5550000"}
+	u := User{ZipCode: "10024", WindowStart: 9, WindowEnd: 17}
+	s := &OfficeStats{Phone: o.Phone, Hours: make([]HourStats, 24)}
+	s.Hours[10] = HourStats{Calls: 10, Answered: 2}
+	s.Hours[11] = HourStats{Calls: 10, Answered: 7}
+	s.Hours[14] = HourStats{Calls: 10, Answered: 9}
+	if err := store.PutOfficeStats(ctx, s); err != nil {
+		t.Fatalf("PutOfficeStats: %v", err)
+	}
+	at := func(h, m int) time.Time { return time.Date(2017, 3, 1, h, m, 0, 0, ny) }
+
+	if got, ok := betterTime(ctx, u, o, at(10, 15)); !ok || got.Hour() != 14 {
+		t.Errorf("betterTime at 10:15: got %s, %t; want 2PM", got, ok)
+	}
+	if got, ok := betterTime(ctx, u, o, at(14, 59)); ok {
+		t.Errorf("betterTime during the best hour: got %s", got)
+	}
+	if got, ok := betterTime(ctx, u, o, at(15, 0)); ok {
+		t.Errorf("betterTime after the best hour: got %s", got)
+	}
+	// The user can't be called at 2PM.
+	if got, ok := betterTime(ctx, User{ZipCode: "10024", WindowStart: 9, WindowEnd: 12}, o, at(10, 15)); ok {
+		t.Errorf("betterTime outside the user's window: got %s", got)
+	}
+	if got, ok := betterTime(ctx, u, Office{Phone: "5551111"}, at(10, 15)); ok {
+		t.Errorf("betterTime with no stats: got %s", got)
+	}
+}
@@ -0,0 +1,362 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+const (
+	timeFmt = "Monday, January 02 at 3:04PM MST"
+
+	tips = `Tips for calling:
+- Give your name, city, and zip code.
+- State an issue, state your opinion on it. That's it.
+- Be nice. The person you're talking to has a hard job.
+- Call every day so they remember you.
+Text STOP any time to stop.`
+)
+
+// NewRouter returns a handler serving the app's public endpoints. The rest are
+// registered by HandleAdmin.
+func NewRouter() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/incomingcall", authenticated(incomingCall)) // POSTed when someone calls.
+	m.HandleFunc("/incomingcall/menu", authenticated(callMenu))
+	m.HandleFunc("/incomingcall/zip", authenticated(callJoin))
+	m.HandleFunc("/incomingtext", authenticated(incomingText)) // POSTed when someone texts.
+	m.HandleFunc("/connect", authenticated(connect))           // POSTed when user picks up call, Dials the other number in response.
+	m.HandleFunc("/callstatus", authenticated(callStatus))     // POSTed when call status changes.
+	m.HandleFunc("/gather", authenticated(gather))             // POSTed when user presses a key after the script.
+	m.HandleFunc("/dialed", authenticated(dialed))             // POSTed when the call to the rep ends.
+	m.HandleFunc("/redial", authenticated(redial))             // POSTed when user presses a key after dialed's offer.
+
+	m.HandleFunc("/cron", cron)
+	return m
+}
+
+// HandleAdmin registers the endpoints only admins may see on m. On App Engine,
+// app.yaml restricts them to admins; elsewhere, m must only be served on a
+// private address.
+func HandleAdmin(m *http.ServeMux) {
+	m.HandleFunc("/analytics", analytics)  // GET for call analytics per office, as JSON.
+	m.HandleFunc("/events", eventsHandler) // GET for how mass calls are going, as JSON.
+}
+
+func connect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof(ctx, "PostForm: %s", in.Params)
+
+	dial := r.FormValue("dial")
+	if dial == "" {
+		log.Errorf(ctx, "Dial was not provided")
+		dial = cfg.TestNumber
+	}
+
+	if cfg.VoiceScript {
+		phone.Respond(ctx, w, &Response{Verbs: scriptVerbs(ctx, in.CallSID, dial)})
+		return
+	}
+	phone.Respond(ctx, w, &Response{
+		Verbs: []Verb{
+			NewSay("Hello, you are now being connected."),
+			dialRep(dial),
+		},
+	})
+}
+
+// authenticated wraps a webhook handler, rejecting requests that weren't sent
+// by the carrier.
+func authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := phone.Authenticate(r); err != nil {
+			log.Warningf(newContext(r), "Rejecting %s %s: %v", r.Method, r.URL, err)
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func incomingText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(newContext(r), 30*time.Second)
+	defer cancel()
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infof(ctx, "%s says: %s", in.From, in.Body)
+	u, err := store.GetUser(ctx, in.From)
+	if isNotUser(err) {
+		u = nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	text, err := runCommand(ctx, in.From, u, in.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := &Response{}
+	if text != "" {
+		resp.Verbs = []Verb{&SMS{Text: text}}
+	}
+	phone.Respond(ctx, w, resp)
+}
+
+func cron(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(r)
+	if r.Method != "GET" {
+		log.Errorf(ctx, "/cron got method %q", r.Method)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isCron(r) {
+		log.Errorf(ctx, "/cron was not requested by cron")
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	RunCron(ctx)
+}
+
+// RunCron starts calls for every user whose next call is due, keeps
+// analytics up to date, and starts mass calls.
+func RunCron(ctx context.Context) {
+	if err := enqueueAnalytics(ctx); err != nil {
+		log.Errorf(ctx, "enqueueAnalytics: %v", err)
+	}
+	runEvents(ctx, time.Now())
+
+	us, err := store.CallableUsers(ctx, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "CallableUsers: %v", err)
+		// Don't return an error, that would cause us to be re-run.
+		return
+	}
+	for _, u := range us {
+		log.Infof(ctx, "User %q is callable", u.PhoneNumber)
+		if err := enqueueCall(ctx, u, false); err != nil {
+			log.Errorf(ctx, "enqueueCall(%s): %v", u.PhoneNumber, err)
+		}
+	}
+}
+
+func init() {
+	jobHandlers["call"] = func(ctx context.Context, b []byte) error {
+		var a callArgs
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		return call(ctx, a.User, a.Force)
+	}
+	jobHandlers["actual-call"] = func(ctx context.Context, b []byte) error {
+		var a doCallArgs
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		return doCall(ctx, a.User, a.CallID, a.Rep)
+	}
+}
+
+type callArgs struct {
+	User  User
+	Force bool
+}
+
+type doCallArgs struct {
+	User   User
+	CallID string
+	Rep    Rep
+}
+
+// enqueueCall starts a call for the user in the background.
+//
+// Scheduled calls are keyed by the user's NextCall, so cron can't start two
+// for the same time; forced calls (NOW) always start a new one.
+func enqueueCall(ctx context.Context, u User, force bool) error {
+	key := fmt.Sprintf("call-%s-%d", u.PhoneNumber, u.NextCall.Unix())
+	if force {
+		key = fmt.Sprintf("now-%s-%d", u.PhoneNumber, time.Now().UnixNano())
+	}
+	return enqueue(ctx, "call", key, 0, callArgs{u, force})
+}
+
+// doCallKey is the key of the job that places the call with this ID. There's
+// only ever one per Call, and SkipNextCall cancels it.
+func doCallKey(callID string) string {
+	return "actual-call-" + callID
+}
+
+// call warns the user their call is coming, and schedules doCall.
+//
+// It runs in the background; see enqueueCall. It only returns an error
+// (causing a retry) if it hasn't done anything the user would notice.
+func call(ctx context.Context, u User, force bool) error {
+	reps, err := LookupReps(ctx, u.ZipCode)
+	if err != nil {
+		return err
+	}
+	reps = inDistrict(reps, u.District)
+	if len(reps) == 0 {
+		log.Errorf(ctx, "Zip %q had no reps", u.ZipCode)
+		return nil
+	}
+	// Call about a campaign they follow, if one's running and targets any
+	// of their reps.
+	campaign, targets := userCampaign(u, reps, time.Now())
+	if campaign != nil {
+		reps = targets
+	}
+	rand.Seed(time.Now().Unix())
+	rep := reps[rand.Intn(len(reps))] // random rep
+	office, ok := chooseOffice(u, rep, time.Now(), force)
+	if !ok {
+		// We're running late, and the offices have closed.
+		log.Warningf(ctx, "%s's offices are closed, rescheduling", rep)
+		SetNextCall(ctx, u.PhoneNumber, someTimeTomorrow(u))
+		return nil
+	}
+	if !force {
+		if t, ok := betterTime(ctx, u, office, time.Now()); ok {
+			log.Infof(ctx, "%s usually answers more later, rescheduling", rep)
+			SetNextCall(ctx, u.PhoneNumber, t)
+			return nil
+		}
+	}
+
+	// Insert a Call with status "new".
+	c, err := InsertCall(ctx, u.PhoneNumber, rep, office)
+	if err != nil {
+		log.Errorf(ctx, "InsertCall: %v", err)
+		return err
+	}
+
+	if err := enqueue(ctx, "actual-call", doCallKey(c.Key), cfg.CallDelay, doCallArgs{u, c.Key, rep}); err != nil {
+		log.Errorf(ctx, "enqueue: %v", err)
+		return err
+	}
+	log.Infof(ctx, "Enqueued actual-call task")
+
+	at := ""
+	if office.Name != "" && office.Name != dcOffice {
+		at = " at their office in " + office.Name
+	}
+	msg := fmt.Sprintf(`It's time for your call!
+You will be calling %s%s.
+Your call will come in %s. Get ready!
+`, rep.String(), at, cfg.CallDelay)
+	if campaign != nil {
+		msg += fmt.Sprintf("It's about %s. Here's what you can say:\n%s\n", campaign.Title, campaign.ScriptFor(u, rep))
+	} else {
+		msg += "Text TIPS to get some tips.\n"
+	}
+	msg += "Text SKIP to reschedule."
+	if err := phone.SendSMS(ctx, u.PhoneNumber, msg); err != nil {
+		log.Errorf(ctx, "SendSMS: %v", err)
+	}
+	return nil
+}
+
+// doCall calls the user and connects them to the rep.
+//
+// It runs in the background; see call. It only returns an error (causing a
+// retry) if it hasn't placed the call.
+func doCall(ctx context.Context, u User, callID string, rep Rep) error {
+	c, err := store.GetCall(ctx, u.PhoneNumber, callID)
+	if err != nil {
+		log.Errorf(ctx, "GetCall: %v", err)
+		return err
+	}
+	// SKIP cancels this job, but it might have been running already.
+	if c.Status == StateSkipped {
+		log.Infof(ctx, "User %s skipped latest call %s, skipping", u.PhoneNumber, c.Key)
+		return nil
+	}
+	if c.Status != StateNew || c.Sid != "" {
+		log.Warningf(ctx, "Call %s was already placed: %s", c.Key, c.Status)
+		return nil
+	}
+
+	if wait := allow(ctx, limitCalls, u.PhoneNumber, cfg.CallLimit); wait > 0 {
+		// Something's calling them far more than it should.
+		if _, err := store.UpdateCall(ctx, u.PhoneNumber, c.Key, func(c *Call) error {
+			c.advance(LegNone, StateLimited, time.Now())
+			return nil
+		}); err != nil {
+			log.Errorf(ctx, "UpdateCall: %v", err)
+		}
+		SetNextCall(ctx, u.PhoneNumber, someTimeTomorrow(u))
+		return nil
+	}
+
+	log.Infof(ctx, "User %s will call %s", u.PhoneNumber, c.To)
+
+	// Send call and update associated SID.
+	sid, err := phone.SendCall(ctx, u.PhoneNumber, c.To)
+	if err == ErrOptedOut {
+		return nil
+	} else if err != nil {
+		log.Errorf(ctx, "SendCall: %v", err)
+		return err
+	}
+	if err := store.SetSID(ctx, u.PhoneNumber, c.Key, sid); err != nil {
+		log.Errorf(ctx, "SetSID: %v", err)
+	}
+
+	// Set next call for tomorrow.
+	SetNextCall(ctx, u.PhoneNumber, someTimeTomorrow(u))
+	return nil
+}
+
+func callStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof(ctx, "PostForm: %+v", in.Params)
+
+	state, err := parseCallState(in.CallStatus)
+	if err != nil {
+		log.Warningf(ctx, "callStatus: %v", err)
+		return
+	}
+	// The child leg, to the rep, has the SID of the parent, our call to the
+	// user, which is the one we know.
+	ls := LegStatus{Leg: LegUser, SID: in.CallSID, State: state, Duration: in.Duration, AnsweredBy: in.AnsweredBy}
+	sid := in.CallSID
+	if in.ParentCallSID != "" {
+		ls.Leg, sid = LegRep, in.ParentCallSID
+	}
+	UpdateCallBySID(ctx, sid, ls)
+}
@@ -0,0 +1,87 @@
+//go:build appengine
+// +build appengine
+
+package app
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// init loads the configuration and registers handlers when running on App
+// Engine. It panics if the configuration is invalid, so a misconfigured
+// instance fails to start instead of failing on its first request.
+func init() {
+	c, err := LoadConfig()
+	if err != nil {
+		panic(err)
+	}
+	if err := Configure(c); err != nil {
+		panic(err)
+	}
+
+	http.Handle("/", NewRouter())
+	HandleAdmin(http.DefaultServeMux)
+}
+
+const (
+	defaultStore = "datastore"
+	defaultQueue = "taskqueue"
+)
+
+func newContext(r *http.Request) context.Context { return appengine.NewContext(r) }
+
+func httpClient(ctx context.Context) *http.Client { return urlfetch.Client(ctx) }
+
+// isCron reports whether the request was sent by App Engine's cron service,
+// which sets a header that external requests can't.
+func isCron(r *http.Request) bool { return r.Header.Get("X-Appengine-Cron") == "true" }
+
+// taskQueue is a Queue backed by App Engine's "default" task queue. Retries
+// and backoff are configured in queue.yaml.
+type taskQueue struct{}
+
+// Like the datastore, it's registered by a var initializer so it's there when
+// init calls Configure.
+var _ = func() bool {
+	queues["taskqueue"] = func(Config) (Queue, error) { return taskQueue{}, nil }
+	return true
+}()
+
+var jobFunc = delay.Func("job", runJob)
+
+func (taskQueue) Enqueue(ctx context.Context, j Job) error {
+	t, err := jobFunc.Task(j.Name, j.Args)
+	if err != nil {
+		return err
+	}
+	t.Name = taskName(j.Key)
+	t.ETA = j.RunAt
+	if _, err := taskqueue.Add(ctx, t, "default"); err == taskqueue.ErrTaskAlreadyAdded {
+		log.Infof(ctx, "Job %s was already enqueued", j.Key)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (taskQueue) Cancel(ctx context.Context, key string) error {
+	return taskqueue.Delete(ctx, &taskqueue.Task{Name: taskName(key)}, "default")
+}
+
+// taskNameRE matches characters that can't be in task names.
+var taskNameRE = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// taskName returns a valid task name for the job key. Task names can't be
+// reused for some time, even after the task has run, so they make good
+// idempotency keys.
+func taskName(key string) string {
+	return taskNameRE.ReplaceAllString(key, "_")
+}
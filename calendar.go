@@ -0,0 +1,254 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Calendar lists days no calls are scheduled on, like holidays and
+// congressional recesses.
+//
+// It's read from the YAML file named by Config.CalendarPath, like:
+//
+//	federal_holidays: true
+//	skip:
+//	- name: August recess
+//	  from: 2027-08-02
+//	  to: 2027-09-06
+//	- name: Day after Thanksgiving
+//	  date: 2027-11-26
+//
+// A nil *Calendar skips federal holidays only.
+type Calendar struct {
+	// FederalHolidays skips the days federal holidays are observed on.
+	FederalHolidays bool          `yaml:"federal_holidays"`
+	Skip            []CalendarDay `yaml:"skip"`
+}
+
+// CalendarDay is a day, or a range of days, to skip.
+type CalendarDay struct {
+	Name string `yaml:"name"`
+	Date string `yaml:"date"` // YYYY-MM-DD
+	// From and To are an inclusive range of days, instead of Date.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+
+	from, to time.Time // Midnight UTC
+}
+
+// calendar is the days calls aren't scheduled on. It's set by Configure.
+var calendar *Calendar
+
+const dateFmt = "2006-01-02"
+
+func loadCalendar(path string) (*Calendar, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Calendar
+	if err := yaml.UnmarshalStrict(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range c.Skip {
+		d := &c.Skip[i]
+		if d.Date != "" {
+			if d.From != "" || d.To != "" {
+				return nil, fmt.Errorf("%s: %q has both a date and a range", path, d.Name)
+			}
+			d.From, d.To = d.Date, d.Date
+		}
+		if d.from, err = time.Parse(dateFmt, d.From); err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", path, d.Name, err)
+		}
+		if d.to, err = time.Parse(dateFmt, d.To); err != nil {
+			return nil, fmt.Errorf("%s: %q: %v", path, d.Name, err)
+		}
+		if d.to.Before(d.from) {
+			return nil, fmt.Errorf("%s: %q ends before it starts", path, d.Name)
+		}
+	}
+	return &c, nil
+}
+
+// Skipped returns why no calls are scheduled on the date, or "" if they are.
+func (c *Calendar) Skipped(y int, m time.Month, d int) string {
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if c == nil || c.FederalHolidays {
+		if h := federalHoliday(day); h != "" {
+			return h
+		}
+	}
+	if c == nil {
+		return ""
+	}
+	for _, s := range c.Skip {
+		if !day.Before(s.from) && !day.After(s.to) {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+// federalHoliday returns the name of the federal holiday observed on the
+// day, or "". Holidays on a Saturday are observed on Friday, and those on a
+// Sunday on Monday.
+func federalHoliday(day time.Time) string {
+	y := day.Year()
+	fixed := func(m time.Month, d int) time.Time {
+		t := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		switch t.Weekday() {
+		case time.Saturday:
+			return t.AddDate(0, 0, -1)
+		case time.Sunday:
+			return t.AddDate(0, 0, 1)
+		}
+		return t
+	}
+	// nth returns the nth weekday of the month; n < 0 counts from the end.
+	nth := func(n int, wd time.Weekday, m time.Month) time.Time {
+		if n < 0 {
+			t := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC) // Last day of m.
+			return t.AddDate(0, 0, -((int(t.Weekday()) - int(wd) + 7) % 7))
+		}
+		t := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return t.AddDate(0, 0, (int(wd)-int(t.Weekday())+7)%7+7*(n-1))
+	}
+	for _, h := range []struct {
+		name string
+		day  time.Time
+	}{
+		{"New Year's Day", fixed(time.January, 1)},
+		{"Martin Luther King Jr. Day", nth(3, time.Monday, time.January)},
+		{"Washington's Birthday", nth(3, time.Monday, time.February)},
+		{"Memorial Day", nth(-1, time.Monday, time.May)},
+		{"Juneteenth", fixed(time.June, 19)},
+		{"Independence Day", fixed(time.July, 4)},
+		{"Labor Day", nth(1, time.Monday, time.September)},
+		{"Columbus Day", nth(2, time.Monday, time.October)},
+		{"Veterans Day", fixed(time.November, 11)},
+		{"Thanksgiving", nth(4, time.Thursday, time.November)},
+		{"Christmas", fixed(time.December, 25)},
+		// Next year's New Year's Day can be observed on December 31.
+		{"New Year's Day", time.Date(y+1, time.January, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)},
+	} {
+		if h.name == "New Year's Day" && h.day.Month() == time.December && h.day.Weekday() != time.Friday {
+			continue
+		}
+		if h.day.Equal(day) {
+			return h.name
+		}
+	}
+	return ""
+}
+
+// Schedule is which days of the week a user is called on.
+type Schedule struct {
+	Days [7]bool // Indexed by time.Weekday.
+	// Weekly means at most once a week, on any of Days.
+	Weekly bool
+}
+
+var (
+	weekdays = Schedule{Days: [7]bool{false, true, true, true, true, true, false}}
+
+	// schedules are the named schedules users can choose.
+	schedules = map[string]Schedule{
+		"DAILY":    {Days: [7]bool{true, true, true, true, true, true, true}},
+		"WEEKDAYS": weekdays,
+		"MWF":      {Days: [7]bool{false, true, false, true, false, true, false}},
+		"WEEKLY":   {Days: weekdays.Days, Weekly: true},
+	}
+
+	// dayNames are what users can call days of the week. Single letters are
+	// ambiguous, except in "M W F".
+	dayNames = map[string]time.Weekday{
+		"SU": time.Sunday, "SUN": time.Sunday, "SUNDAY": time.Sunday, "SUNDAYS": time.Sunday,
+		"M": time.Monday, "MO": time.Monday, "MON": time.Monday, "MONDAY": time.Monday, "MONDAYS": time.Monday,
+		"TU": time.Tuesday, "TUE": time.Tuesday, "TUES": time.Tuesday, "TUESDAY": time.Tuesday, "TUESDAYS": time.Tuesday,
+		"W": time.Wednesday, "WE": time.Wednesday, "WED": time.Wednesday, "WEDNESDAY": time.Wednesday, "WEDNESDAYS": time.Wednesday,
+		"TH": time.Thursday, "THU": time.Thursday, "THUR": time.Thursday, "THURS": time.Thursday, "THURSDAY": time.Thursday, "THURSDAYS": time.Thursday,
+		"F": time.Friday, "FR": time.Friday, "FRI": time.Friday, "FRIDAY": time.Friday, "FRIDAYS": time.Friday,
+		"SA": time.Saturday, "SAT": time.Saturday, "SATURDAY": time.Saturday, "SATURDAYS": time.Saturday,
+	}
+)
+
+// parseSchedule parses a named schedule, like "MWF", or a list of days, like
+// "TUE, THU" or "Mondays and Fridays". It returns the schedule's canonical
+// name, which is what's stored on User.
+func parseSchedule(s string) (Schedule, string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if sc, found := schedules[s]; found {
+		return sc, s, nil
+	}
+	fs := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' || r == '/' || r == '&' || r == '+' })
+	var sc Schedule
+	ok := false
+	for _, f := range fs {
+		if f == "AND" {
+			continue
+		}
+		wd, found := dayNames[f]
+		if !found {
+			return Schedule{}, "", fmt.Errorf("%q isn't a day", f)
+		}
+		sc.Days[wd] = true
+		ok = true
+	}
+	if !ok {
+		return Schedule{}, "", fmt.Errorf("%q isn't a list of days", s)
+	}
+	for name, named := range schedules {
+		if named == sc {
+			return sc, name, nil
+		}
+	}
+	return sc, sc.String(), nil
+}
+
+// String lists the schedule's days, like "MON,WED".
+func (sc Schedule) String() string {
+	var ds []string
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		if sc.Days[wd] {
+			ds = append(ds, strings.ToUpper(wd.String()[:3]))
+		}
+	}
+	// Start the week on Monday.
+	sort.SliceStable(ds, func(i, j int) bool { return ds[j] == "SUN" && ds[i] != "SUN" })
+	return strings.Join(ds, ",")
+}
+
+// nextCallDay returns the date of the first day after now, in now's
+// location, that's on the schedule and not skipped by the calendar.
+func (sc Schedule) nextCallDay(now time.Time) (y int, m time.Month, d int) {
+	start := 1
+	if sc.Weekly {
+		start = 7
+	}
+	for i := start; i < start+366; i++ {
+		t := time.Date(now.Year(), now.Month(), now.Day()+i, 12, 0, 0, 0, now.Location())
+		if sc.Days[t.Weekday()] && calendar.Skipped(t.Date()) == "" {
+			return t.Date()
+		}
+	}
+	// Everything's skipped for a year; try again then.
+	return time.Date(now.Year()+1, now.Month(), now.Day(), 12, 0, 0, 0, now.Location()).Date()
+}
+
+// missedBetween reports whether there's a day on the schedule after day and
+// before next, both dates at midnight UTC, that isn't skipped. It walks
+// forward the way nextCallDay schedules calls, so a weekly call moved past a
+// holiday isn't mistaken for a missed week.
+func (sc Schedule) missedBetween(day, next time.Time) bool {
+	y, m, d := sc.nextCallDay(day)
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Before(next)
+}
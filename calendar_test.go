@@ -0,0 +1,150 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFederalHoliday(t *testing.T) {
+	for _, c := range []struct {
+		date, want string
+	}{
+		{"2017-01-02", "New Year's Day"}, // Observed Monday.
+		{"2017-01-16", "Martin Luther King Jr. Day"},
+		{"2017-05-29", "Memorial Day"},
+		{"2020-07-03", "Independence Day"}, // Observed Friday.
+		{"2017-11-23", "Thanksgiving"},
+		{"2021-12-31", "New Year's Day"}, // 2022's, observed Friday.
+		{"2017-12-31", ""},
+		{"2017-01-01", ""},
+		{"2017-03-01", ""},
+	} {
+		day, _ := time.Parse(dateFmt, c.date)
+		if got := federalHoliday(day); got != c.want {
+			t.Errorf("federalHoliday(%s): got %q, want %q", c.date, got, c.want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	for _, c := range []struct {
+		s, want string
+	}{
+		{"daily", "DAILY"},
+		{"MWF", "MWF"},
+		{"weekly", "WEEKLY"},
+		{"Mon, Wed and Fri", "MWF"},
+		{"M W F", "MWF"},
+		{"tue/thu", "TUE,THU"},
+		{"Sundays & Mondays", "MON,SUN"},
+	} {
+		_, got, err := parseSchedule(c.s)
+		if err != nil || got != c.want {
+			t.Errorf("parseSchedule(%q): got %q, %v; want %q", c.s, got, err, c.want)
+		}
+	}
+	for _, s := range []string{"", "sometimes", "T"} {
+		if _, _, err := parseSchedule(s); err == nil {
+			t.Errorf("parseSchedule(%q): got no error", s)
+		}
+	}
+}
+
+func TestLoadCalendar(t *testing.T) {
+	c, err := loadCalendar("testdata/calendar.yaml")
+	if err != nil {
+		t.Fatalf("loadCalendar: %v", err)
+	}
+	for _, c2 := range []struct {
+		y    int
+		m    time.Month
+		d    int
+		want string
+	}{
+		{2017, time.March, 14, "Snow day"},
+		{2017, time.April, 10, "Spring recess"},
+		{2017, time.April, 21, "Spring recess"},
+		{2017, time.April, 24, ""},
+		{2017, time.July, 4, "Independence Day"},
+	} {
+		if got := c.Skipped(c2.y, c2.m, c2.d); got != c2.want {
+			t.Errorf("Skipped(%d-%d-%d): got %q, want %q", c2.y, c2.m, c2.d, got, c2.want)
+		}
+	}
+
+	if c, err := loadCalendar(""); c != nil || err != nil {
+		t.Errorf(`loadCalendar(""): got %v, %v; want nil`, c, err)
+	}
+}
+
+func TestNextCallDay(t *testing.T) {
+	defer func(c *Calendar) { calendar = c }(calendar)
+	var err error
+	if calendar, err = loadCalendar("testdata/calendar.yaml"); err != nil {
+		t.Fatalf("loadCalendar: %v", err)
+	}
+	ny, _ := time.LoadLocation("America/New_York")
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 10, 0, 0, 0, ny) }
+
+	for _, c := range []struct {
+		desc string
+		days string
+		now  time.Time
+		want time.Time
+	}{
+		{"weekdays", "", day(2017, 3, 1), day(2017, 3, 2)},
+		{"weekdays, Friday", "WEEKDAYS", day(2017, 3, 3), day(2017, 3, 6)},
+		{"daily, Friday", "DAILY", day(2017, 3, 3), day(2017, 3, 4)},
+		{"MWF", "MWF", day(2017, 3, 1), day(2017, 3, 3)},
+		{"weekly", "WEEKLY", day(2017, 3, 1), day(2017, 3, 8)},
+		{"MLK day", "", day(2017, 1, 13), day(2017, 1, 17)},
+		{"snow day", "TUE", day(2017, 3, 8), day(2017, 3, 21)},
+		{"recess", "", day(2017, 4, 7), day(2017, 4, 24)},
+	} {
+		sc, _, err := parseSchedule(c.days)
+		if c.days == "" {
+			sc, err = weekdays, nil
+		}
+		if err != nil {
+			t.Fatalf("%s: parseSchedule: %v", c.desc, err)
+		}
+		y, m, d := sc.nextCallDay(c.now)
+		if wy, wm, wd := c.want.Date(); y != wy || m != wm || d != wd {
+			t.Errorf("%s: nextCallDay(%s): got %d-%d-%d, want %s", c.desc, c.now.Format(dateFmt), y, m, d, c.want.Format(dateFmt))
+		}
+	}
+}
+
+func TestDaysCommand(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	for _, c := range []struct{ text, want, days string }{
+		{"DAYS MWF", "We'll call you on MON,WED,FRI", "MWF"},
+		{"WEEKLY", "once a week", "WEEKLY"},
+		{"days sat, sun", "voicemail", "SAT,SUN"},
+		{"DAYS whenever", "Sorry", "SAT,SUN"},
+		{"weekdays", "MON,TUE,WED,THU,FRI", "WEEKDAYS"},
+	} {
+		u, err := store.GetUser(ctx, userPhone)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		got, err := runCommand(ctx, userPhone, u, c.text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", c.text, err)
+		} else if !strings.Contains(got, c.want) {
+			t.Errorf("runCommand(%q): got %q, want it to contain %q", c.text, got, c.want)
+		}
+		if u, err := store.GetUser(ctx, userPhone); err != nil {
+			t.Errorf("GetUser: %v", err)
+		} else if u.Days != c.days {
+			t.Errorf("runCommand(%q): got Days %q, want %q", c.text, u.Days, c.days)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CallState is where a call, or one of its legs, is. Besides ours, they're
+// the statuses Twilio sends to status callbacks.
+type CallState string
+
+const (
+	StateNew     CallState = "new"     // Scheduled, and not placed yet.
+	StateSkipped CallState = "skipped" // The user SKIP'd it, or pressed 2.
+	StateLimited CallState = "limited" // Not placed, because of CallLimit.
+
+	StateQueued     CallState = "queued"
+	StateInitiated  CallState = "initiated"
+	StateRinging    CallState = "ringing"
+	StateInProgress CallState = "in-progress" // Answered.
+	StateCompleted  CallState = "completed"   // Answered, and hung up.
+	StateBusy       CallState = "busy"
+	StateNoAnswer   CallState = "no-answer"
+	StateFailed     CallState = "failed"
+	StateCanceled   CallState = "canceled"
+)
+
+// callStateOrder is the order states happen in. A call only moves forward,
+// so a webhook for an earlier state than the call's already in is stale.
+var callStateOrder = map[CallState]int{
+	StateNew:        0,
+	StateQueued:     1,
+	StateInitiated:  2,
+	StateRinging:    3,
+	StateInProgress: 4,
+	// Final states.
+	StateSkipped:   5,
+	StateLimited:   5,
+	StateCompleted: 5,
+	StateBusy:      5,
+	StateNoAnswer:  5,
+	StateFailed:    5,
+	StateCanceled:  5,
+}
+
+// parseCallState parses a status from the carrier.
+func parseCallState(s string) (CallState, error) {
+	st := CallState(s)
+	if _, found := callStateOrder[st]; !found || st == StateNew || st == StateSkipped || st == StateLimited {
+		return "", fmt.Errorf("unknown call status %q", s)
+	}
+	return st, nil
+}
+
+// Final reports whether nothing more happens after the state.
+func (s CallState) Final() bool {
+	return callStateOrder[s] == callStateOrder[StateCompleted]
+}
+
+// CanBecome reports whether a call in state s can move to state t: it must
+// be later, and s mustn't be final. Only calls that haven't been placed can be
+// limited.
+func (s CallState) CanBecome(t CallState) bool {
+	if s == "" {
+		s = StateNew
+	}
+	_, known := callStateOrder[t]
+	switch {
+	case !known || s.Final():
+		return false
+	case t == StateLimited:
+		return s == StateNew
+	}
+	return callStateOrder[t] > callStateOrder[s]
+}
+
+// Leg is which of a call's two phone calls something happened to.
+type Leg string
+
+const (
+	LegNone Leg = ""     // The call as a whole, like SKIP.
+	LegUser Leg = "user" // Our call to the user, the parent.
+	LegRep  Leg = "rep"  // The user's call to their rep, the <Dial>ed child.
+)
+
+// CallLeg is one of a call's two phone calls.
+type CallLeg struct {
+	SID   string // The carrier's ID for it.
+	To    string // For the rep's legs, the office dialed; see Call.To.
+	State CallState
+	// When it reached each state, or zero if it hasn't.
+	Initiated, Ringing, Answered, Completed time.Time
+	// AnsweredBy is who the carrier thinks answered: "human", or, e.g.,
+	// "machine_end_beep" for voicemail. It's empty if it couldn't tell.
+	AnsweredBy string
+}
+
+// Voicemail reports whether a machine answered the leg.
+func (l CallLeg) Voicemail() bool {
+	return strings.HasPrefix(l.AnsweredBy, "machine") || l.AnsweredBy == "fax"
+}
+
+// stamp records when the leg reached the state.
+func (l *CallLeg) stamp(s CallState, now time.Time) {
+	switch {
+	case s == StateQueued || s == StateInitiated:
+		l.Initiated = now
+	case s == StateRinging:
+		l.Ringing = now
+	case s == StateInProgress:
+		l.Answered = now
+	case s.Final():
+		l.Completed = now
+	}
+}
+
+// LegStatus is what the carrier told us about one of a call's legs.
+type LegStatus struct {
+	Leg        Leg
+	SID        string
+	State      CallState
+	Duration   time.Duration
+	AnsweredBy string
+}
+
+// CallEvent is something that happened to a call, for debugging.
+type CallEvent struct {
+	Time  time.Time
+	Leg   Leg
+	State CallState
+	// Stale means it was ignored, because the leg had already moved past it.
+	Stale bool
+}
+
+// leg returns the call's leg, or nil for LegNone.
+func (c *Call) leg(leg Leg) *CallLeg {
+	switch leg {
+	case LegUser:
+		return &c.UserLeg
+	case LegRep:
+		return &c.RepLeg
+	}
+	return nil
+}
+
+// advance moves the call's leg to the state, if it can get there from where
+// it is, and logs the event either way. It reports whether the leg moved.
+func (c *Call) advance(leg Leg, s CallState, now time.Time) bool {
+	cur := &c.Status
+	l := c.leg(leg)
+	if l != nil {
+		cur = &l.State
+	}
+	ok := cur.CanBecome(s)
+	c.Events = append(c.Events, CallEvent{Time: now, Leg: leg, State: s, Stale: !ok})
+	if !ok {
+		return false
+	}
+	*cur = s
+	if l != nil {
+		l.stamp(s, now)
+	}
+	c.Status = c.overall()
+	return true
+}
+
+// update applies what the carrier told us about one of the call's legs. It
+// reports whether the leg moved.
+func (c *Call) update(ls LegStatus, now time.Time) bool {
+	l := c.leg(ls.Leg)
+	if l == nil {
+		return false
+	}
+	if ls.Leg == LegRep {
+		for _, a := range c.Attempts {
+			if a.SID != "" && a.SID == ls.SID {
+				// It's about an office they've since moved on from.
+				c.Events = append(c.Events, CallEvent{Time: now, Leg: ls.Leg, State: ls.State, Stale: true})
+				return false
+			}
+		}
+	}
+	if l.SID == "" {
+		l.SID = ls.SID
+	}
+	if ls.AnsweredBy != "" {
+		l.AnsweredBy = ls.AnsweredBy
+	}
+	if !c.advance(ls.Leg, ls.State, now) {
+		return false
+	}
+	if ls.Leg == LegRep && ls.Duration != time.Duration(0) {
+		c.Duration = ls.Duration
+	}
+	return true
+}
+
+// redial starts a new rep's leg, to another office, keeping the last one in
+// Attempts.
+func (c *Call) redial(to, repName string) {
+	if c.RepLeg.To == "" {
+		c.RepLeg.To = c.To
+	}
+	c.Attempts = append(c.Attempts, c.RepLeg)
+	c.RepLeg = CallLeg{To: to}
+	c.To, c.RepName = to, repName
+	c.Status = c.overall()
+}
+
+// over reports whether both of the call's legs are over, or the rep's never
+// started.
+func (c *Call) over() bool {
+	return c.UserLeg.State.Final() && (c.RepLeg.State == "" || c.RepLeg.State.Final())
+}
+
+// overall is the state of the call as a whole: the rep's leg, once the user's
+// been connected, or else the user's.
+func (c *Call) overall() CallState {
+	switch {
+	case c.Status == StateSkipped || c.Status == StateLimited:
+		return c.Status
+	case c.RepLeg.State != "":
+		return c.RepLeg.State
+	case c.UserLeg.State == StateCompleted:
+		// They hung up before they were connected.
+		return StateCanceled
+	case c.UserLeg.State != "":
+		return c.UserLeg.State
+	}
+	return StateNew
+}
+
+// repLegs are the calls to the rep's offices, oldest first.
+func (c Call) repLegs() []CallLeg {
+	if c.RepLeg.State == "" && len(c.Events) == 0 {
+		// Before legs were tracked, Status was the rep's leg.
+		return []CallLeg{{To: c.To, State: c.Status}}
+	}
+	ls := append(append([]CallLeg(nil), c.Attempts...), c.RepLeg)
+	for i := range ls {
+		if ls[i].To == "" {
+			ls[i].To = c.To
+		}
+	}
+	return ls
+}
+
+// outcomeText returns the text telling the user how their call, which just
+// finished, went, or "" if there's nothing to tell them.
+func outcomeText(c Call) string {
+	switch {
+	case c.RepLeg.State == "" && c.UserLeg.State != StateCompleted && c.UserLeg.State.Final():
+		return "We called you, but couldn't get through. Text NOW to try again."
+	case c.RepLeg.State == StateCompleted && c.RepLeg.Voicemail():
+		return fmt.Sprintf("You reached %s's voicemail. Thanks for leaving a message!", c.RepName)
+	case c.RepLeg.State == StateBusy:
+		return fmt.Sprintf("%s's line was busy. Text NOW to try again.", c.RepName)
+	case c.RepLeg.State == StateNoAnswer:
+		return fmt.Sprintf("Nobody answered at %s's office. Text NOW to try again.", c.RepName)
+	case c.RepLeg.State == StateFailed:
+		return fmt.Sprintf("We couldn't get through to %s. Text NOW to try again.", c.RepName)
+	}
+	return ""
+}
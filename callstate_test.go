@@ -0,0 +1,196 @@
+package app
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCanBecome(t *testing.T) {
+	for _, c := range []struct {
+		from, to CallState
+		want     bool
+	}{
+		{"", StateQueued, true},
+		{StateNew, StateRinging, true},
+		{StateRinging, StateInProgress, true},
+		{StateInProgress, StateCompleted, true},
+		{StateRinging, StateNoAnswer, true},
+		{StateNew, StateSkipped, true},
+		{StateNew, StateLimited, true},
+		{StateRinging, StateLimited, false},
+		{StateInProgress, StateRinging, false},
+		{StateCompleted, StateInProgress, false},
+		{StateCompleted, StateCompleted, false},
+		{StateBusy, StateCompleted, false},
+		{StateSkipped, StateQueued, false},
+		{StateNew, "bogus", false},
+	} {
+		if got := c.from.CanBecome(c.to); got != c.want {
+			t.Errorf("%q.CanBecome(%q): got %t, want %t", c.from, c.to, got, c.want)
+		}
+	}
+}
+
+func TestParseCallState(t *testing.T) {
+	if s, err := parseCallState("no-answer"); err != nil || s != StateNoAnswer {
+		t.Errorf("parseCallState(no-answer): got %q, %v", s, err)
+	}
+	for _, bad := range []string{"", "new", "skipped", "bogus"} {
+		if _, err := parseCallState(bad); err == nil {
+			t.Errorf("parseCallState(%q): got nil error", bad)
+		}
+	}
+}
+
+func TestCallStatusWebhooks(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(p Telephony) { phone = p }(phone)
+	phone = &fakePhone{}
+	if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	c, err := InsertCall(ctx, userPhone, senator, senator.mainOffice())
+	if err != nil {
+		t.Fatalf("InsertCall: %v", err)
+	}
+	if err := store.SetSID(ctx, userPhone, c.Key, "CA123"); err != nil {
+		t.Fatalf("SetSID: %v", err)
+	}
+
+	user := func(status string) url.Values {
+		return url.Values{"CallSid": {"CA123"}, "CallStatus": {status}}
+	}
+	rep := func(status string, dur string) url.Values {
+		return url.Values{"CallSid": {"CA456"}, "ParentCallSid": {"CA123"}, "CallStatus": {status}, "CallDuration": {dur}}
+	}
+	for _, p := range []url.Values{
+		user("ringing"),
+		user("in-progress"),
+		rep("ringing", ""),
+		rep("completed", "90"),
+		rep("in-progress", ""), // Late, so ignored.
+		user("completed"),
+		user("ringing"), // Late, so ignored.
+		rep("bogus", ""),
+	} {
+		postWebhook(callStatus, "/callstatus", p)
+	}
+
+	c, err = store.GetCall(ctx, userPhone, c.Key)
+	if err != nil {
+		t.Fatalf("GetCall: %v", err)
+	}
+	if c.Status != StateCompleted || c.UserLeg.State != StateCompleted || c.RepLeg.State != StateCompleted {
+		t.Errorf("States: got %q (user %q, rep %q), want all completed", c.Status, c.UserLeg.State, c.RepLeg.State)
+	}
+	if c.UserLeg.SID != "CA123" || c.RepLeg.SID != "CA456" {
+		t.Errorf("SIDs: got user %q, rep %q; want CA123, CA456", c.UserLeg.SID, c.RepLeg.SID)
+	}
+	if c.UserLeg.Answered.IsZero() || c.RepLeg.Ringing.IsZero() || c.RepLeg.Completed.IsZero() {
+		t.Errorf("Times: got user %+v, rep %+v", c.UserLeg, c.RepLeg)
+	}
+	if !c.RepLeg.Answered.IsZero() {
+		t.Errorf("Rep leg answered at %v, after it completed", c.RepLeg.Answered)
+	}
+	if c.Duration != 90*time.Second {
+		t.Errorf("Duration: got %v, want 1m30s", c.Duration)
+	}
+	var stale int
+	for _, e := range c.Events {
+		if e.Stale {
+			stale++
+		}
+	}
+	if len(c.Events) != 7 || stale != 2 {
+		t.Errorf("Events: got %d, %d stale; want 7, 2 stale: %+v", len(c.Events), stale, c.Events)
+	}
+}
+
+func TestOverallState(t *testing.T) {
+	now := time.Now()
+	c := &Call{Status: StateNew}
+	c.advance(LegUser, StateInProgress, now)
+	if c.Status != StateInProgress {
+		t.Errorf("Answered: got %q, want %q", c.Status, StateInProgress)
+	}
+	// They hung up before the rep's leg started.
+	c.advance(LegUser, StateCompleted, now)
+	if c.Status != StateCanceled {
+		t.Errorf("Hung up: got %q, want %q", c.Status, StateCanceled)
+	}
+
+	c = &Call{Status: StateNew}
+	c.advance(LegUser, StateInProgress, now)
+	if !c.advance(LegNone, StateSkipped, now) {
+		t.Errorf("Couldn't skip an answered call")
+	}
+	c.advance(LegUser, StateCompleted, now)
+	if c.Status != StateSkipped {
+		t.Errorf("Skipped: got %q, want %q", c.Status, StateSkipped)
+	}
+}
+
+func TestCallOutcomes(t *testing.T) {
+	ctx := context.Background()
+	defer func(p Telephony) { phone = p }(phone)
+
+	user := func(status string) url.Values {
+		return url.Values{"CallSid": {"CA123"}, "CallStatus": {status}}
+	}
+	rep := func(status, answeredBy string) url.Values {
+		return url.Values{"CallSid": {"CA456"}, "ParentCallSid": {"CA123"}, "CallStatus": {status}, "AnsweredBy": {answeredBy}}
+	}
+	for _, c := range []struct {
+		desc     string
+		webhooks []url.Values
+		outcome  string
+		text     string
+	}{
+		{"user didn't answer", []url.Values{user("ringing"), user("no-answer")},
+			"you didn't answer", "couldn't get through"},
+		{"user hung up", []url.Values{user("in-progress"), user("completed")},
+			"hung up before connecting", ""},
+		{"rep busy", []url.Values{user("in-progress"), rep("busy", ""), user("completed")},
+			"busy", "line was busy"},
+		{"voicemail", []url.Values{user("in-progress"), rep("in-progress", "machine_end_beep"), rep("completed", ""), user("completed")},
+			"voicemail", "voicemail"},
+		{"rep answered", []url.Values{user("in-progress"), rep("in-progress", "human"), rep("completed", ""), user("completed")},
+			"completed", "first call"},
+	} {
+		store = newMemStore()
+		fp := &fakePhone{}
+		phone = fp
+		if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+			t.Fatalf("InsertUser: %v", err)
+		}
+		call, err := InsertCall(ctx, userPhone, senator, senator.mainOffice())
+		if err != nil {
+			t.Fatalf("InsertCall: %v", err)
+		}
+		if err := store.SetSID(ctx, userPhone, call.Key, "CA123"); err != nil {
+			t.Fatalf("SetSID: %v", err)
+		}
+		for _, p := range c.webhooks {
+			postWebhook(callStatus, "/callstatus", p)
+		}
+
+		call, err = store.GetCall(ctx, userPhone, call.Key)
+		if err != nil {
+			t.Fatalf("GetCall: %v", err)
+		}
+		if got := outcome(*call); got != c.outcome {
+			t.Errorf("%s: outcome: got %q, want %q", c.desc, got, c.outcome)
+		}
+		switch {
+		case c.text == "" && len(fp.texts) != 0:
+			t.Errorf("%s: texts: got %q, want none", c.desc, fp.texts)
+		case c.text != "" && (len(fp.texts) != 1 || !strings.Contains(fp.texts[0], c.text)):
+			t.Errorf("%s: texts: got %q, want one containing %q", c.desc, fp.texts, c.text)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// Campaign is an issue users can follow. While it's running, their calls are
+// to the reps it targets, and the text before each call has its script.
+//
+// Campaigns are read from the YAML file named by Config.CampaignsPath, like:
+//
+//	campaigns:
+//	- code: CLEANAIR
+//	  title: Protect the Clean Air Act
+//	  script: >
+//	    Hi, my name is {{.Name}} and I'm a constituent from {{.City}}. I'm
+//	    calling to ask {{.RepTitle}} {{.RepName}} to vote no on H.R. 1234.
+//	  chamber: house
+//	  start: 2017-03-01
+//	  end: 2017-04-30
+//
+// Instead of a chamber, a campaign can target a committee, by listing its
+// members' names as the rep lookup spells them:
+//
+//	committee:
+//	  name: Senate Environment and Public Works
+//	  members: [John Barrasso, Tom Carper]
+//
+// Campaigns with neither target all reps.
+type Campaign struct {
+	Code  string `yaml:"code"` // What users FOLLOW, e.g., "CLEANAIR".
+	Title string `yaml:"title"`
+	// Script is a text/template executed with a scriptData.
+	Script    string     `yaml:"script"`
+	Chamber   string     `yaml:"chamber"` // "house" or "senate", or "" for both.
+	Committee *Committee `yaml:"committee"`
+	// Start and End are the first and last days, in Washington, the
+	// campaign runs, as YYYY-MM-DD. Either can be left out.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+
+	script     *template.Template
+	start, end time.Time // Midnight UTC; zero if open-ended.
+}
+
+type Committee struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members"`
+}
+
+// scriptData is what campaign scripts can refer to. Values that aren't
+// known are left as prompts, like "[your name]".
+type scriptData struct {
+	Name     string // The user's name.
+	City     string // The user's city.
+	RepName  string // e.g., "Jane Doe"
+	RepTitle string // "Senator" or "Representative"
+}
+
+// campaigns are the campaigns users can follow. They're set by Configure.
+var campaigns []*Campaign
+
+func loadCampaigns(path string) ([]*Campaign, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Campaigns []*Campaign `yaml:"campaigns"`
+	}
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cs := f.Campaigns
+	codes := map[string]bool{}
+	for _, c := range cs {
+		c.Code = strings.ToUpper(c.Code)
+		if c.Code == "" || strings.ContainsAny(c.Code, " \t\n") {
+			return nil, fmt.Errorf("%s: campaign %q needs a code with no spaces", path, c.Title)
+		}
+		if codes[c.Code] {
+			return nil, fmt.Errorf("%s: more than one campaign is %s", path, c.Code)
+		}
+		codes[c.Code] = true
+		if c.Chamber != "" && c.Chamber != "house" && c.Chamber != "senate" {
+			return nil, fmt.Errorf("%s: %s: chamber %q isn't \"house\" or \"senate\"", path, c.Code, c.Chamber)
+		}
+		if c.script, err = template.New(c.Code).Parse(c.Script); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		// Catch references to fields that don't exist.
+		if err := c.script.Execute(ioutil.Discard, scriptData{}); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if c.Start != "" {
+			if c.start, err = time.Parse(dateFmt, c.Start); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, c.Code, err)
+			}
+		}
+		if c.End != "" {
+			if c.end, err = time.Parse(dateFmt, c.End); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, c.Code, err)
+			}
+		}
+	}
+	return cs, nil
+}
+
+// lookupCampaign returns the campaign with the code, ignoring case, or nil.
+func lookupCampaign(code string) *Campaign {
+	for _, c := range campaigns {
+		if strings.EqualFold(c.Code, code) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Active reports whether the campaign is running at t.
+func (c *Campaign) Active(t time.Time) bool {
+	day := dateOf(t.In(capitolHours.location()))
+	return (c.start.IsZero() || !day.Before(c.start)) && (c.end.IsZero() || !day.After(c.end))
+}
+
+// Over reports whether the campaign has ended by t.
+func (c *Campaign) Over(t time.Time) bool {
+	return !c.end.IsZero() && dateOf(t.In(capitolHours.location())).After(c.end)
+}
+
+// Targets reports whether the campaign asks users to call the rep.
+func (c *Campaign) Targets(r Rep) bool {
+	if c.Chamber != "" && r.Chamber() != c.Chamber {
+		return false
+	}
+	if c.Committee != nil {
+		for _, m := range c.Committee.Members {
+			if normalizeName(m) == normalizeName(r.Name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// normalizeName upper-cases the name, and drops punctuation and extra spaces.
+func normalizeName(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToUpper(s), func(r rune) bool {
+		return r == ' ' || r == '.' || r == ','
+	}), " ")
+}
+
+// ScriptFor returns the campaign's script for the user to read to the rep.
+func (c *Campaign) ScriptFor(u User, r Rep) string {
+	d := scriptData{
+		Name:     u.Name,
+		City:     u.City,
+		RepName:  r.Name,
+		RepTitle: "Representative",
+	}
+	if d.Name == "" {
+		d.Name = "[your name]"
+	}
+	if d.City == "" {
+		d.City = "[your city]"
+	}
+	if r.Chamber() == "senate" {
+		d.RepTitle = "Senator"
+	}
+	var b bytes.Buffer
+	if err := c.script.Execute(&b, d); err != nil {
+		// It ran when it was loaded, so this shouldn't happen.
+		return c.Title
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// userCampaign returns an active campaign the user follows that targets any
+// of reps, and those reps, or nil if there isn't one.
+func userCampaign(u User, reps []Rep, now time.Time) (*Campaign, []Rep) {
+	for _, code := range u.Campaigns {
+		c := lookupCampaign(code)
+		if c == nil || !c.Active(now) {
+			continue
+		}
+		var targets []Rep
+		for _, r := range reps {
+			if c.Targets(r) {
+				targets = append(targets, r)
+			}
+		}
+		if len(targets) > 0 {
+			return c, targets
+		}
+	}
+	return nil, nil
+}
+
+// listIssues replies to ISSUES with the campaigns that haven't ended.
+func listIssues(ctx context.Context, r *request) (string, error) {
+	now := time.Now()
+	following := map[string]bool{}
+	for _, code := range r.User.Campaigns {
+		following[code] = true
+	}
+	msg := ""
+	for _, c := range campaigns {
+		if c.Over(now) {
+			continue
+		}
+		msg += fmt.Sprintf("\n%s - %s", c.Code, c.Title)
+		switch {
+		case following[c.Code]:
+			msg += " (following)"
+		case !c.Active(now):
+			msg += " (starts " + c.start.Format("Jan 2") + ")"
+		}
+	}
+	if msg == "" {
+		return "There are no issues to follow right now. Check back soon!", nil
+	}
+	return "Issues:" + msg + "\nText FOLLOW <ISSUE> to get a script for your calls about it.", nil
+}
+
+// follow adds the campaign to those the user follows.
+func follow(ctx context.Context, r *request) (string, error) {
+	c := lookupCampaign(r.Arg)
+	if c == nil || c.Over(time.Now()) {
+		return fmt.Sprintf("Sorry, there's no issue %s. Text ISSUES for a list.", strings.ToUpper(r.Arg)), nil
+	}
+	if _, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		for _, code := range u.Campaigns {
+			if code == c.Code {
+				return nil
+			}
+		}
+		u.Campaigns = append(u.Campaigns, c.Code)
+		return nil
+	}); err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	msg := fmt.Sprintf("You're following %s. We'll text you a script before your calls about it.", c.Title)
+	if r.User.Name == "" {
+		msg += ` Text "NAME <YOUR NAME>" so we can put your name in it.`
+	}
+	return msg, nil
+}
+
+// unfollow removes the campaign from those the user follows.
+func unfollow(ctx context.Context, r *request) (string, error) {
+	code := strings.ToUpper(r.Arg)
+	found := false
+	if _, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		var cs []string
+		for _, c := range u.Campaigns {
+			if c == code {
+				found = true
+			} else {
+				cs = append(cs, c)
+			}
+		}
+		u.Campaigns = cs
+		return nil
+	}); err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	if !found {
+		return fmt.Sprintf("You aren't following %s.", code), nil
+	}
+	return fmt.Sprintf("You've stopped following %s.", code), nil
+}
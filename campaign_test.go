@@ -0,0 +1,189 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	senator  = Rep{Name: "Jane Doe", Offices: []Office{{Phone: "2022240001"}}, Link: "https://www.doe.senate.gov"}
+	houseRep = Rep{Name: "Harriet House", Offices: []Office{{Phone: "2022250012"}}, District: "12", Link: "https://house.house.gov"}
+)
+
+func TestLoadCampaigns(t *testing.T) {
+	cs, err := loadCampaigns("testdata/campaigns.yaml")
+	if err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	if len(cs) != 4 || cs[0].Code != "CLEANAIR" {
+		t.Fatalf("loadCampaigns: got %+v", cs)
+	}
+	clean, epw := cs[0], cs[1]
+
+	ny, _ := time.LoadLocation("America/New_York")
+	for _, c := range []struct {
+		t            time.Time
+		active, over bool
+	}{
+		{time.Date(2017, 2, 28, 23, 0, 0, 0, ny), false, false},
+		{time.Date(2017, 3, 1, 0, 0, 0, 0, ny), true, false},
+		{time.Date(2017, 4, 30, 23, 0, 0, 0, ny), true, false},
+		{time.Date(2017, 5, 1, 0, 0, 0, 0, ny), false, true},
+	} {
+		if got := clean.Active(c.t); got != c.active {
+			t.Errorf("Active(%s): got %t, want %t", c.t, got, c.active)
+		}
+		if got := clean.Over(c.t); got != c.over {
+			t.Errorf("Over(%s): got %t, want %t", c.t, got, c.over)
+		}
+	}
+	if !epw.Active(time.Now()) {
+		t.Errorf("Campaign with no dates isn't active")
+	}
+
+	if clean.Targets(senator) || !clean.Targets(houseRep) {
+		t.Errorf("House campaign: got Targets %t for a senator and %t for a rep; want false, true", clean.Targets(senator), clean.Targets(houseRep))
+	}
+	if !epw.Targets(Rep{Name: "jane  doe", Link: "https://www.doe.senate.gov"}) || epw.Targets(houseRep) {
+		t.Errorf("Committee campaign targets the wrong reps")
+	}
+
+	dir, err := ioutil.TempDir("", "makemecall")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, bad := range []string{
+		"campaigns:\n- title: No code\n  script: hi\n",
+		"campaigns:\n- code: A\n  script: hi\n- code: a\n  script: hi\n",
+		"campaigns:\n- code: A\n  script: '{{.Nope}}'\n",
+		"campaigns:\n- code: A\n  script: hi\n  chamber: both\n",
+		"campaigns:\n- code: A\n  script: hi\n  start: tomorrow\n",
+	} {
+		path := writeTemp(t, dir, bad)
+		if _, err := loadCampaigns(path); err == nil {
+			t.Errorf("loadCampaigns(%q): got no error", bad)
+		}
+	}
+}
+
+func TestScriptFor(t *testing.T) {
+	cs, err := loadCampaigns("testdata/campaigns.yaml")
+	if err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	for _, c := range []struct {
+		u    User
+		r    Rep
+		want string
+	}{
+		{User{}, houseRep, "Hi, my name is [your name] and I'm a constituent from [your city]. I'm calling to ask Representative Harriet House to vote no on H.R. 1234."},
+		{User{Name: "Jenny", City: "Springfield"}, senator, "Hi, my name is Jenny and I'm a constituent from Springfield. I'm calling to ask Senator Jane Doe to vote no on H.R. 1234."},
+	} {
+		if got := cs[0].ScriptFor(c.u, c.r); got != c.want {
+			t.Errorf("ScriptFor(%+v, %s): got %q, want %q", c.u, c.r.Name, got, c.want)
+		}
+	}
+}
+
+func TestCampaignCommands(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(cs []*Campaign) { campaigns = cs }(campaigns)
+	var err error
+	if campaigns, err = loadCampaigns("testdata/campaigns.yaml"); err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+
+	for _, c := range []struct{ text, want string }{
+		{"ISSUES", "EPW - Fund the EPA\nSOON - Something coming up (starts Jan 1)"},
+		{"FOLLOW epw", "You're following Fund the EPA. We'll text you a script before your calls about it. Text \"NAME"},
+		{"FOLLOW EPW", "You're following"},
+		{"FOLLOW OLD", "Sorry, there's no issue OLD"},
+		{"FOLLOW", `Text "FOLLOW <ISSUE>"`},
+		{"ISSUES", "EPW - Fund the EPA (following)"},
+		{"NAME  Jenny   Jones ", "Thanks, Jenny Jones!"},
+		{"UNFOLLOW SOON", "You aren't following SOON"},
+		{"FOLLOW soon", "You're following Something coming up"},
+		{"UNFOLLOW EPW", "You've stopped following EPW"},
+	} {
+		u, err := store.GetUser(ctx, userPhone)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		got, err := runCommand(ctx, userPhone, u, c.text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", c.text, err)
+		} else if !strings.Contains(got, c.want) {
+			t.Errorf("runCommand(%q): got %q, want it to contain %q", c.text, got, c.want)
+		}
+	}
+	if u, err := store.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser: %v", err)
+	} else if u.Name != "Jenny Jones" || strings.Join(u.Campaigns, ",") != "SOON" {
+		t.Errorf("User after commands: got %+v", u)
+	}
+}
+
+func TestCallWithCampaign(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(cs []*Campaign, d RepProvider, p Telephony) { campaigns, directory, phone = cs, d, p }(campaigns, directory, phone)
+	var err error
+	if campaigns, err = loadCampaigns("testdata/campaigns.yaml"); err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	directory = &fakeReps{reps: []Rep{senator, houseRep}}
+	fp := &fakePhone{}
+	phone = fp
+
+	u := User{PhoneNumber: userPhone, ZipCode: "10024", City: "New York", Campaigns: []string{"SOON", "EPW"}}
+	if err := store.PutUser(ctx, &u); err != nil {
+		t.Fatalf("PutUser: %v", err)
+	}
+	if err := call(ctx, u, true); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if len(fp.texts) != 1 {
+		t.Fatalf("Sent texts: got %q, want 1", fp.texts)
+	}
+	for _, want := range []string{"You will be calling Sen. Jane Doe", "It's about Fund the EPA", "Please ask Senator Jane Doe to fully fund the EPA."} {
+		if !strings.Contains(fp.texts[0], want) {
+			t.Errorf("Sent text %q doesn't contain %q", fp.texts[0], want)
+		}
+	}
+}
+
+func TestAddressCity(t *testing.T) {
+	for _, c := range []struct{ addr, want string }{
+		{"123 Main St, Springfield, IL 62701", "Springfield"},
+		{"123 Main St, Apt 4, New York, NY", "New York"},
+		{"123 Main St Springfield IL", ""},
+	} {
+		if got := addressCity(c.addr); got != c.want {
+			t.Errorf("addressCity(%q): got %q, want %q", c.addr, got, c.want)
+		}
+	}
+}
+
+// writeTemp writes s to a new file in dir, and returns its name.
+func writeTemp(t *testing.T, dir, s string) string {
+	f, err := ioutil.TempFile(dir, "makemecall")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	return f.Name()
+}
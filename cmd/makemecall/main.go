@@ -0,0 +1,109 @@
+// Command makemecall serves Make Me Call as a normal HTTP server, outside of
+// App Engine.
+//
+// It's configured the same way as the App Engine app; see the README.
+package main
+
+import (
+	_ "expvar" // Adds /debug/vars to http.DefaultServeMux.
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	app "github.com/ImJasonH/makemecall"
+	"golang.org/x/net/context"
+)
+
+var (
+	addr   = flag.String("addr", ":8080", "address to listen on")
+	static = flag.String("static", ".", "directory containing index.html and other static files")
+	every  = flag.Duration("cron", 11*time.Minute, "how often to check for callable users")
+	debug  = flag.String("debug_addr", "", "if set, private address to serve counters (at /debug/vars) and admin pages on")
+)
+
+func main() {
+	flag.Parse()
+
+	c, err := app.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := app.Configure(c); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: withStatic(app.NewRouter()),
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down...")
+		cancel()
+		sctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+		srv.Shutdown(sctx)
+	}()
+
+	if *debug != "" {
+		app.HandleAdmin(http.DefaultServeMux)
+		go func() { log.Println(http.ListenAndServe(*debug, nil)) }()
+	}
+	go cron(ctx)
+	go app.RunQueue(ctx)
+
+	log.Printf("Listening on %s", *addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// cron does what cron.yaml does on App Engine.
+func cron(ctx context.Context) {
+	t := time.NewTicker(*every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			app.RunCron(ctx)
+		}
+	}
+}
+
+// withStatic serves the static files that app.yaml serves on App Engine.
+func withStatic(h http.Handler) http.Handler {
+	m := http.NewServeMux()
+	for path, file := range map[string]string{
+		"/":            "index.html",
+		"/favicon.png": "favicon.png",
+		"/robots.txt":  "robots.txt",
+		"/sitemap.xml": "sitemap.xml",
+	} {
+		file := filepath.Join(*static, file)
+		if path == "/" {
+			// "/" matches everything, so only serve index.html for exactly "/".
+			m.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/" {
+					h.ServeHTTP(w, r)
+					return
+				}
+				http.ServeFile(w, r, file)
+			})
+			continue
+		}
+		m.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, file) })
+	}
+	return m
+}
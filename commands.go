@@ -0,0 +1,567 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// command is something users can text us.
+type command struct {
+	Name    string
+	Aliases []string
+	// Args describes the argument in HELP, e.g., "<ZIPCODE>". Commands
+	// without Args ignore anything after their name.
+	Args string
+	// ArgRE, if set, is what the argument must match, ignoring case.
+	ArgRE *regexp.Regexp
+	Help  string
+	// Anyone means people who haven't joined, or have stopped, can use it.
+	// Otherwise, they're told to JOIN.
+	Anyone bool
+	// Keyword means it's one of the carriers' standard keywords, or JOIN,
+	// which are the only commands answered once a number opts out.
+	Keyword bool
+	// Run returns the reply, if any. Returning an error fails the webhook,
+	// so the carrier retries it; only do that before any side effects.
+	Run func(ctx context.Context, r *request) (string, error)
+}
+
+// request is a command texted by a user.
+type request struct {
+	From string
+	User *User  // nil if they've never joined.
+	Name string // The name or alias they used, e.g., "QUIT".
+	Arg  string
+	// Source is how it was sent: "sms", or "voice" from the phone menu.
+	Source string
+}
+
+// joined reports whether the user has joined and not stopped.
+func (r *request) joined() bool {
+	return r.User != nil && !r.User.IsStopped()
+}
+
+// commands are what users can text, in the order HELP lists them. It's set in
+// init, since HELP refers to it.
+var commands []*command
+
+func init() {
+	commands = []*command{{
+		Name:    "JOIN",
+		Args:    "<ZIPCODE>",
+		ArgRE:   regexp.MustCompile(`^[0-9]{5}(-[0-9]{4})?$`),
+		Help:    "Sign up for calls to congress",
+		Anyone:  true,
+		Keyword: true,
+		Run:     join,
+	}, {
+		Name:    "STATUS",
+		Aliases: []string{"INFO", "REPS"},
+		Help:    "Your next call and members of congress",
+		Run: func(ctx context.Context, r *request) (string, error) {
+			return defaultText(ctx, r.User), nil
+		},
+	}, {
+		Name:    "HISTORY",
+		Aliases: []string{"STATS", "STREAK"},
+		Help:    "Your latest calls and streak",
+		Run:     history,
+	}, {
+		Name: "NOW",
+		Help: "Call now",
+		Run:  callNow,
+	}, {
+		Name:    "SKIP",
+		Aliases: []string{"LATER"},
+		Help:    "Skip your next call",
+		Run:     skip,
+	}, {
+		Name:    "TIPS",
+		Aliases: []string{"TIP"},
+		Help:    "Tips for calling",
+		Run: func(context.Context, *request) (string, error) {
+			return tips, nil
+		},
+	}, {
+		Name:  "ADDRESS",
+		Args:  "<STREET, CITY, STATE>",
+		ArgRE: regexp.MustCompile(`[0-9].*[A-Z]`),
+		Help:  "Tell us exactly which district you're in",
+		Run: func(ctx context.Context, r *request) (string, error) {
+			return setAddress(ctx, r.User, r.Arg), nil
+		},
+	}, {
+		Name:  "TIME",
+		Args:  "<9AM-5PM>",
+		ArgRE: timeRangeRE,
+		Help:  "Choose when you're called, e.g., TIME 9AM-11AM PT",
+		Run:   setTime,
+	}, {
+		Name:    "DAYS",
+		Aliases: []string{"DAILY", "WEEKDAYS", "MWF", "WEEKLY"},
+		Args:    "<DAILY|WEEKDAYS|MWF|WEEKLY>",
+		Help:    "Choose which days you're called, e.g., DAYS TUE,THU",
+		Run:     setDays,
+	}, {
+		Name:  "NAME",
+		Args:  "<YOUR NAME>",
+		ArgRE: regexp.MustCompile(`[A-Z]`),
+		Help:  "Tell us your name, for call scripts",
+		Run:   setName,
+	}, {
+		Name:    "OFFICE",
+		Aliases: []string{"OFFICES"},
+		Args:    "<DC|LOCAL|ANY>",
+		ArgRE:   regexp.MustCompile(`^(DC|LOCAL|ANY)$`),
+		Help:    "Choose which offices you call: in Washington, near you, or either",
+		Run:     setOffice,
+	}, {
+		Name:    "ISSUES",
+		Aliases: []string{"ISSUE", "CAMPAIGNS"},
+		Help:    "Issues you can follow",
+		Run:     listIssues,
+	}, {
+		Name:  "FOLLOW",
+		Args:  "<ISSUE>",
+		ArgRE: regexp.MustCompile(`^\S+$`),
+		Help:  "Call about an issue, with a script",
+		Run:   follow,
+	}, {
+		Name:  "UNFOLLOW",
+		Args:  "<ISSUE>",
+		ArgRE: regexp.MustCompile(`^\S+$`),
+		Help:  "Stop following an issue",
+		Run:   unfollow,
+	}, {
+		Name:  "RSVP",
+		Args:  "[EVENT]",
+		ArgRE: regexp.MustCompile(`^\S*$`),
+		Help:  "Join a mass call",
+		Run:   rsvp,
+	}, {
+		Name:    "STOP",
+		Aliases: []string{"STOPALL", "UNSUBSCRIBE", "CANCEL", "END", "QUIT"},
+		Help:    "Stop all texts and calls",
+		Anyone:  true,
+		Keyword: true,
+		Run: func(ctx context.Context, r *request) (string, error) {
+			if err := optOut(ctx, r.From, r.Name); err != nil {
+				return "", err
+			}
+			return "You've been unsubscribed, and won't get any more texts or calls from us. Text START to resubscribe.", nil
+		},
+	}, {
+		Name:    "START",
+		Aliases: []string{"UNSTOP"},
+		Help:    "Undo STOP",
+		Anyone:  true,
+		Keyword: true,
+		Run: func(ctx context.Context, r *request) (string, error) {
+			u, err := optIn(ctx, r.From, r.Source, r.Name)
+			if err != nil {
+				return "", err
+			}
+			if u == nil {
+				return `You've been resubscribed. Text "JOIN <ZIPCODE>" to get started.`, nil
+			}
+			return "Welcome back! You've been resubscribed.\n" + defaultText(ctx, u), nil
+		},
+	}, {
+		Name:    "HELP",
+		Aliases: []string{"COMMANDS", "MENU"},
+		Help:    "This list",
+		Anyone:  true,
+		Keyword: true,
+		Run: func(ctx context.Context, r *request) (string, error) {
+			return helpText(r.joined()), nil
+		},
+	}}
+}
+
+// lookupCommand returns the command with the name or alias, or nil.
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+		for _, a := range c.Aliases {
+			if a == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// parseCommand splits a text into its command name, upper-cased, and its
+// argument. It ignores case, punctuation around the name and argument, and
+// extra whitespace, so "  join: 12345." is JOIN with argument "12345".
+func parseCommand(s string) (name, arg string) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 {
+		return "", ""
+	}
+	name = strings.ToUpper(strings.TrimFunc(fs[0], isPunct))
+	arg = strings.TrimFunc(strings.Join(fs[1:], " "), isPunct)
+	return name, arg
+}
+
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// runCommand runs the command texted by from, who is u, or nil if they've
+// never joined, and returns the reply, if any.
+func runCommand(ctx context.Context, from string, u *User, text string) (string, error) {
+	name, arg := parseCommand(text)
+	c := lookupCommand(name)
+	if c == nil || !c.Keyword {
+		// Carriers only allow replies to their keywords once a number
+		// opts out.
+		if out, err := optedOut(ctx, from); err != nil {
+			return "", err
+		} else if out {
+			log.Infof(ctx, "Not replying to %s, which opted out", from)
+			return "", nil
+		}
+	}
+	if c == nil || !c.Keyword {
+		// Don't let anyone run up our bill, but always honor keywords.
+		if wait := allow(ctx, limitTexts, from, cfg.TextLimit); wait > 0 {
+			return "", nil
+		}
+	}
+	r := &request{From: from, User: u, Name: name, Arg: arg, Source: "sms"}
+	if c == nil {
+		return unknownCommand(name, r.joined()), nil
+	}
+	if !r.joined() && !c.Anyone {
+		return `Text "JOIN <ZIPCODE>" to get started.`, nil
+	}
+	if c.ArgRE != nil && !c.ArgRE.MatchString(strings.ToUpper(arg)) {
+		return fmt.Sprintf(`Text "%s %s" to %s.`, c.Name, c.Args, strings.ToLower(c.Help[:1])+c.Help[1:]), nil
+	}
+	return c.Run(ctx, r)
+}
+
+// unknownCommand replies to a text that isn't a command, suggesting the
+// closest one.
+func unknownCommand(name string, joined bool) string {
+	msg := "Sorry, we didn't understand that."
+	if name != "" {
+		if c := closestCommand(name, joined); c != "" {
+			msg = fmt.Sprintf("Sorry, we didn't understand that. Did you mean %s?", c)
+		}
+	}
+	if !joined {
+		return msg + ` Text "JOIN <ZIPCODE>" to get started, or HELP for more.`
+	}
+	return msg + " Text HELP for a list of commands."
+}
+
+// closestCommand returns the name or alias of the command that's fewest edits
+// from name, if it's close enough to be a likely typo.
+func closestCommand(name string, joined bool) string {
+	best, bestDist := "", 0
+	for _, c := range commands {
+		if !joined && !c.Anyone {
+			continue
+		}
+		for _, n := range append([]string{c.Name}, c.Aliases...) {
+			d := editDistance(name, n)
+			if best == "" || d < bestDist {
+				best, bestDist = n, d
+			}
+		}
+	}
+	// Allow one typo in short words, and a couple in longer ones.
+	if bestDist > 1+len(name)/4 {
+		return ""
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// helpText lists the commands available to the user. Carriers require it to
+// say who we are and how to opt out.
+func helpText(joined bool) string {
+	msg := "Make Me Call: daily calls to your members of congress. Text:"
+	for _, c := range commands {
+		if !joined && !c.Anyone {
+			continue
+		}
+		usage := c.Name
+		if c.Args != "" {
+			usage += " " + c.Args
+		}
+		msg += fmt.Sprintf("\n%s - %s", usage, c.Help)
+	}
+	return msg + "\nMsg&data rates may apply."
+}
+
+// join signs up a new user, or resubscribes a stopped one. Either way, it's
+// consent to texts and calls.
+func join(ctx context.Context, r *request) (string, error) {
+	if r.joined() {
+		return defaultText(ctx, r.User), nil
+	}
+	if r.User != nil {
+		// They stopped, and are starting again, maybe somewhere else.
+		if _, err := optIn(ctx, r.From, r.Source, r.Name); err != nil {
+			return "", err
+		}
+		u, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+			if u.ZipCode != r.Arg {
+				u.ZipCode = r.Arg
+				u.District = District{}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+			return "", err
+		}
+		return "Welcome back!\n" + defaultText(ctx, u), nil
+	}
+	if err := recordConsent(ctx, r.From, true, r.Source, r.Name); err != nil {
+		return "", err
+	}
+	u, err := InsertUser(ctx, r.From, r.Arg)
+	if err != nil {
+		return "", err
+	}
+	return `Thank you, you have joined!
+Text STOP any time to stop.
+` + defaultText(ctx, u), nil
+}
+
+// callNow calls the user right away, unless they've used NOW too much lately.
+func callNow(ctx context.Context, r *request) (string, error) {
+	if wait := allow(ctx, limitNow, r.From, cfg.NowLimit); wait > 0 {
+		next := time.Now().Add(wait).In(r.User.Location())
+		return fmt.Sprintf("You've asked for a lot of calls lately! You can text NOW again after %s. Your next call is %s",
+			next.Format("Monday at 3:04PM MST"), r.User.NextCallFormatted()), nil
+	}
+	if err := enqueueCall(ctx, *r.User, true); err != nil {
+		log.Errorf(ctx, "enqueueCall: %v", err)
+	}
+	return "", nil
+}
+
+func skip(ctx context.Context, r *request) (string, error) {
+	if err := SkipNextCall(ctx, r.From); err == ErrNoSkippableCalls {
+		// TODO: Take this to mean "reschedule my as-yet-incoming call" ?
+		// Until then, do nothing.
+		return "", nil
+	} else if err != nil {
+		// Do nothing.
+		return "", nil
+	}
+	next := someTimeTomorrow(*r.User)
+	u, err := SetNextCall(ctx, r.From, next)
+	if err != nil {
+		log.Errorf(ctx, "SetNextCall: %v", err)
+		return "", nil
+	}
+	log.Infof(ctx, "Successful SKIP")
+	return fmt.Sprintf("Your next call is %s", u.NextCallFormatted()), nil
+}
+
+// setTime sets the hours the user wants to be called between, and maybe their
+// time zone, and reschedules their next call.
+func setTime(ctx context.Context, r *request) (string, error) {
+	start, end, zone, err := parseTimeRange(r.Arg)
+	if err != nil {
+		return fmt.Sprintf(`Sorry, %v. Try "TIME 9AM-5PM", and maybe a time zone like "TIME 9AM-5PM PT".`, err), nil
+	}
+	u, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		u.WindowStart, u.WindowEnd = start, end
+		if zone != "" {
+			u.TimeZone = zone
+		}
+		u.NextCall = someTimeTomorrow(*u)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+
+	loc := u.Location()
+	now := time.Now().In(loc)
+	h := u.officeHours()
+	from, to := callWindow(*u, h, now.Year(), now.Month(), now.Day())
+	msg := fmt.Sprintf("We'll call you between %s and %s %s.", formatHour(start), formatHour(end), now.Format("MST"))
+	if !from.Equal(time.Date(now.Year(), now.Month(), now.Day(), start, 0, 0, 0, loc)) ||
+		!to.Equal(time.Date(now.Year(), now.Month(), now.Day(), end, 0, 0, 0, loc)) {
+		zone := "Eastern time"
+		if h.TimeZone != capitolHours.TimeZone {
+			zone = "your time"
+		}
+		msg = fmt.Sprintf("Congressional offices are only open from %s to %s %s, so we'll call you between %s and %s %s.",
+			formatHour(h.Start), formatHour(h.End), zone,
+			from.In(loc).Format("3:04PM"), to.In(loc).Format("3:04PM"), now.Format("MST"))
+	}
+	return msg + "\nYour next call is " + u.NextCallFormatted(), nil
+}
+
+// setDays sets which days the user is called on, and reschedules their next
+// call. Texting a named schedule, like MWF, is the same as DAYS MWF.
+func setDays(ctx context.Context, r *request) (string, error) {
+	arg := r.Arg
+	if r.Name != "DAYS" {
+		arg = r.Name
+	}
+	sc, name, err := parseSchedule(arg)
+	if err != nil {
+		return fmt.Sprintf(`Sorry, %v. Try "DAYS WEEKDAYS", "DAYS MWF", "DAYS WEEKLY" or a list of days like "DAYS TUE,THU".`, err), nil
+	}
+	u, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		u.Days = name
+		u.NextCall = someTimeTomorrow(*u)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	msg := fmt.Sprintf("We'll call you on %s, except holidays.", sc)
+	if sc.Weekly {
+		msg = "We'll call you once a week, on a weekday that isn't a holiday."
+	}
+	if sc.Days[time.Saturday] || sc.Days[time.Sunday] {
+		msg += " Offices are closed on weekends, so you'll leave a voicemail then."
+	}
+	return msg + "\nYour next call is " + u.NextCallFormatted(), nil
+}
+
+// setName sets the name campaign scripts use.
+func setName(ctx context.Context, r *request) (string, error) {
+	name := strings.Join(strings.Fields(r.Arg), " ")
+	if len(name) > 50 {
+		name = name[:50]
+	}
+	if _, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		u.Name = name
+		return nil
+	}); err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	return fmt.Sprintf("Thanks, %s! We'll use your name in call scripts.", name), nil
+}
+
+// setOffice sets which of their reps' offices the user calls, and
+// reschedules their next call during those offices' hours.
+func setOffice(ctx context.Context, r *request) (string, error) {
+	pref := strings.ToUpper(r.Arg)
+	u, err := store.UpdateUser(ctx, r.From, func(u *User) error {
+		u.Office = pref
+		u.NextCall = someTimeTomorrow(*u)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	msg := "OK, you'll call your members of congress at their offices in Washington."
+	switch pref {
+	case officeLocal:
+		msg = "OK, you'll call your members of congress at their offices near you, if they have any."
+	case officeAny:
+		msg = "OK, you'll call your members of congress at whichever of their offices is open."
+	}
+	return msg + "\nYour next call is " + u.NextCallFormatted(), nil
+}
+
+// defaultText is the user's status: their ZIP code, next call and reps.
+func defaultText(ctx context.Context, u *User) string {
+	msg := fmt.Sprintf("Your zip code is %s\n", u.ZipCode)
+	if !u.District.IsZero() {
+		msg += fmt.Sprintf("Your district is %s\n", u.District)
+	}
+	msg += fmt.Sprintf(`Your next call is scheduled for %s
+Your members of congress:
+`, u.NextCallFormatted())
+	// Look up reps by zip.
+	rs, err := LookupReps(ctx, u.ZipCode)
+	if err != nil {
+		return msg + "(We couldn't look them up right now. Sorry!)"
+	}
+	rs = inDistrict(rs, u.District)
+	house := 0
+	for _, r := range rs {
+		msg += fmt.Sprintf("- %s\n", r.String())
+		if _, ok := houseDistrict(r); ok {
+			house++
+		}
+	}
+	if house > 1 {
+		msg += `Your zip code is in more than one district. Text "ADDRESS <STREET, CITY, STATE>" so we call the right rep.`
+	}
+	return msg
+}
+
+// setAddress finds the district the address is in and stores it, so the user
+// is only asked to call their own House member.
+func setAddress(ctx context.Context, u *User, addr string) string {
+	d, zip, err := geocoder.Geocode(ctx, addr)
+	if err == ErrNoSuchAddress {
+		return `We couldn't find that address. Try "ADDRESS <STREET, CITY, STATE ZIP>".`
+	} else if err != nil {
+		log.Errorf(ctx, "Geocode: %v", err)
+		return "We couldn't look up that address right now. Try again later."
+	}
+	updated, err := store.UpdateUser(ctx, u.PhoneNumber, func(u *User) error {
+		u.District = d
+		if zip != "" {
+			u.ZipCode = zip
+		}
+		if city := addressCity(addr); city != "" {
+			u.City = city
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", u.PhoneNumber, err)
+		return "We couldn't save your address right now. Try again later."
+	}
+	log.Infof(ctx, "User %s is in %s", u.PhoneNumber, d)
+	return defaultText(ctx, updated)
+}
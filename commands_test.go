@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseCommand(t *testing.T) {
+	for _, c := range []struct {
+		text, name, arg string
+	}{
+		{"TIPS", "TIPS", ""},
+		{"  tips  ", "TIPS", ""},
+		{"Stop!", "STOP", ""},
+		{"join: 12345.", "JOIN", "12345"},
+		{"JOIN  12345-6789", "JOIN", "12345-6789"},
+		{"address 200 W 79th St,  New York, NY", "ADDRESS", "200 W 79th St, New York, NY"},
+		{"?", "", ""},
+		{"", "", ""},
+	} {
+		name, arg := parseCommand(c.text)
+		if name != c.name || arg != c.arg {
+			t.Errorf("parseCommand(%q): got %q, %q; want %q, %q", c.text, name, arg, c.name, c.arg)
+		}
+	}
+}
+
+func TestClosestCommand(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		joined bool
+		want   string
+	}{
+		{"TIPZ", true, "TIPS"},
+		{"SKP", true, "SKIP"},
+		{"ADRESS", true, "ADDRESS"},
+		{"JION", false, "JOIN"},
+		// Only JOIN and HELP are suggested to people who haven't joined.
+		{"SKP", false, ""},
+		{"HELLO", true, "HELP"},
+		{"BANANA", true, ""},
+	} {
+		if got := closestCommand(c.name, c.joined); got != c.want {
+			t.Errorf("closestCommand(%q, %t): got %q, want %q", c.name, c.joined, got, c.want)
+		}
+	}
+}
+
+func TestHelpListsCommands(t *testing.T) {
+	help := helpText(true)
+	for _, c := range commands {
+		if !strings.Contains(help, c.Name) {
+			t.Errorf("HELP doesn't mention %s:\n%s", c.Name, help)
+		}
+	}
+	if help := helpText(false); strings.Contains(help, "SKIP") || !strings.Contains(help, "JOIN <ZIPCODE>") {
+		t.Errorf("HELP for someone who hasn't joined:\n%s", help)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	directory = &fakeReps{}
+
+	for _, c := range []struct {
+		desc, text, want string
+	}{
+		{"unknown, before joining", "hello", `Text "JOIN <ZIPCODE>" to get started`},
+		{"command that needs a user", "skip", `Text "JOIN <ZIPCODE>" to get started.`},
+		{"bad argument", "join me", `Text "JOIN <ZIPCODE>" to sign up`},
+		{"join", "Join 12345", "Thank you, you have joined!"},
+		{"join again", "JOIN 12345", "Your zip code is 12345"},
+		{"typo", "tipz", "Did you mean TIPS?"},
+		{"alias", "info", "Your zip code is 12345"},
+		{"help", "help", "ADDRESS <STREET, CITY, STATE>"},
+		{"missing address", "ADDRESS", `Text "ADDRESS <STREET, CITY, STATE>"`},
+	} {
+		u, err := store.GetUser(ctx, userPhone)
+		if isNotUser(err) {
+			u = nil
+		}
+		got, err := runCommand(ctx, userPhone, u, c.text)
+		if err != nil {
+			t.Errorf("%s: runCommand(%q): %v", c.desc, c.text, err)
+		} else if !strings.Contains(got, c.want) {
+			t.Errorf("%s: runCommand(%q): got %q, want it to contain %q", c.desc, c.text, got, c.want)
+		}
+	}
+}
+
+func TestNow(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(c Config, p Telephony) { cfg, phone = c, p }(cfg, phone)
+	cfg.NowLimit = Limit{}
+	phone = &fakePhone{}
+
+	if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	body := postWebhook(incomingText, "/incomingtext", url.Values{"From": {userPhone}, "Body": {"NOW"}})
+	var r Response
+	if err := xml.Unmarshal([]byte(body), &r); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", body, err)
+	}
+	if len(r.Verbs) != 0 {
+		t.Errorf("NOW got response: %s", body)
+	}
+	if js, err := s.ClaimJobs(ctx, time.Now(), time.Minute, 10); err != nil {
+		t.Errorf("ClaimJobs: %v", err)
+	} else if len(js) != 1 || js[0].Name != "call" || !strings.HasPrefix(js[0].Key, "now-") {
+		t.Errorf("Jobs after NOW: got %+v, want a call now", js)
+	}
+}
@@ -0,0 +1,334 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of a running instance.
+//
+// It's read from the YAML or JSON file named by $MMC_CONFIG (or config.yaml,
+// if it exists), then overridden by any environment variables listed in
+// envVars.
+type Config struct {
+	// Host is the public base URL of this instance, which Twilio sends
+	// webhooks to, e.g., "https://make-me-call.appspot.com".
+	Host string `yaml:"host"`
+
+	TwilioSID    string `yaml:"twilio_sid"`    // Twilio account SID
+	TwilioToken  string `yaml:"twilio_token"`  // Twilio account token
+	TwilioNumber string `yaml:"twilio_number"` // Our Twilio phone number
+
+	// TwilioSecondaryToken is also accepted when validating webhook
+	// signatures, while rotating TwilioToken.
+	TwilioSecondaryToken string `yaml:"twilio_secondary_token"`
+
+	// TestNumber is dialed when a call is connected without a number.
+	TestNumber string `yaml:"test_number"`
+
+	// TimeZone is the IANA name of the time zone of users whose ZIP code's
+	// time zone isn't known.
+	TimeZone string `yaml:"time_zone"`
+
+	// Calls are scheduled between CallWindowStart and CallWindowEnd, in
+	// hours since midnight in each user's time zone, unless they've chosen
+	// other hours with TIME. Either way, they're only scheduled when
+	// congressional offices are open.
+	CallWindowStart int `yaml:"call_window_start"`
+	CallWindowEnd   int `yaml:"call_window_end"`
+
+	// CalendarPath names a file listing days not to schedule calls on; see
+	// Calendar. Without it, only federal holidays are skipped.
+	CalendarPath string `yaml:"calendar_path"`
+
+	// VoiceScript reads users their talking points when they pick up, and
+	// asks them to press 1 to be connected or 2 to skip the call.
+	VoiceScript bool `yaml:"voice_script"`
+
+	// CallDelay is how long to wait between warning the user that their
+	// call is coming and actually calling them.
+	CallDelay time.Duration `yaml:"call_delay"`
+
+	// Store names where users and calls are kept: "datastore" (only on App
+	// Engine, the default there), "sqlite" (the default elsewhere) or
+	// "memory".
+	Store string `yaml:"store"`
+	// SQLitePath is the database file used by the "sqlite" store.
+	SQLitePath string `yaml:"sqlite_path"`
+
+	// Queue names what runs background jobs: "taskqueue" (only on App
+	// Engine, the default there) or "local" (the default elsewhere), which
+	// keeps jobs in the store and runs them in-process.
+	Queue string `yaml:"queue"`
+
+	// Reps names where reps are looked up: "whoismyrepresentative" (the
+	// default) or "dataset", which reads LegislatorsPath,
+	// ZipDistrictsPath and, if it's set, LegislatorOfficesPath; see
+	// legislatorDataset.
+	Reps                  string `yaml:"reps"`
+	LegislatorsPath       string `yaml:"legislators_path"`
+	ZipDistrictsPath      string `yaml:"zip_districts_path"`
+	LegislatorOfficesPath string `yaml:"legislator_offices_path"`
+	// RepCacheTTL is how long looked-up reps are kept in the store before
+	// they're looked up again. Zero turns off caching.
+	RepCacheTTL time.Duration `yaml:"rep_cache_ttl"`
+
+	// Geocoder names what finds the district of an address texted with
+	// ADDRESS: "census" (the default), the US Census Bureau's geocoder, or
+	// "file", which reads AddressesPath; see addressFile.
+	Geocoder      string `yaml:"geocoder"`
+	AddressesPath string `yaml:"addresses_path"`
+
+	// CampaignsPath names a file of issue campaigns users can follow; see
+	// Campaign.
+	CampaignsPath string `yaml:"campaigns_path"`
+	// EventsPath names a file of mass calls users can RSVP to; see Event.
+	EventsPath string `yaml:"events_path"`
+	// MaxDialAttempts is the most offices a user is connected to in one
+	// call: when one's busy or doesn't answer, they're offered another.
+	MaxDialAttempts int `yaml:"max_dial_attempts"`
+	// MaxCallsPerMinute is the most calls a mass call starts each minute,
+	// to stay under Twilio's limits. Zero is no limit.
+	MaxCallsPerMinute int `yaml:"max_calls_per_minute"`
+
+	// Rate limits per phone number, like "3/24h" for three at once,
+	// refilling at three a day; "0" is no limit. TextLimit is commands
+	// texted to us, except the carrier keywords like STOP and HELP.
+	// NowLimit is NOW. CallLimit is calls we place, scheduled or not.
+	TextLimit Limit `yaml:"text_limit"`
+	NowLimit  Limit `yaml:"now_limit"`
+	CallLimit Limit `yaml:"call_limit"`
+
+	loc *time.Location
+}
+
+// Location returns the default time zone.
+func (c Config) Location() *time.Location {
+	if c.loc != nil {
+		return c.loc
+	}
+	if l, err := time.LoadLocation(c.TimeZone); err == nil {
+		return l
+	}
+	return time.UTC
+}
+
+// cfg is the configuration of this instance. It's set by Configure.
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		TestNumber:      "8887018992", // NOAA dial-a-buoy
+		TimeZone:        "America/New_York",
+		CallWindowStart: 12, // noon
+		CallWindowEnd:   17, // 5pm
+		CallDelay:       5 * time.Minute,
+		Store:           defaultStore,
+		SQLitePath:      "makemecall.db",
+		Queue:           defaultQueue,
+		Reps:            "whoismyrepresentative",
+		RepCacheTTL:     24 * time.Hour,
+		Geocoder:        "census",
+		TextLimit:       Limit{30, time.Hour},
+		NowLimit:        Limit{3, 24 * time.Hour},
+		CallLimit:       Limit{6, 24 * time.Hour},
+
+		MaxCallsPerMinute: 30,
+		MaxDialAttempts:   3,
+	}
+}
+
+// envVars maps environment variables to the Config fields they set.
+var envVars = map[string]func(c *Config, v string) error{
+	"MMC_HOST":                    func(c *Config, v string) error { c.Host = v; return nil },
+	"TWILIO_ACCOUNT_SID":          func(c *Config, v string) error { c.TwilioSID = v; return nil },
+	"TWILIO_AUTH_TOKEN":           func(c *Config, v string) error { c.TwilioToken = v; return nil },
+	"TWILIO_NUMBER":               func(c *Config, v string) error { c.TwilioNumber = v; return nil },
+	"TWILIO_SECONDARY_AUTH_TOKEN": func(c *Config, v string) error { c.TwilioSecondaryToken = v; return nil },
+	"MMC_TEST_NUMBER":             func(c *Config, v string) error { c.TestNumber = v; return nil },
+	"MMC_TIME_ZONE":               func(c *Config, v string) error { c.TimeZone = v; return nil },
+	"MMC_CALL_DELAY":              func(c *Config, v string) (err error) { c.CallDelay, err = time.ParseDuration(v); return },
+	"MMC_CALL_WINDOW":             parseCallWindow,
+	"MMC_VOICE_SCRIPT":            func(c *Config, v string) (err error) { c.VoiceScript, err = strconv.ParseBool(v); return },
+	"MMC_CALENDAR":                func(c *Config, v string) error { c.CalendarPath = v; return nil },
+	"MMC_STORE":                   func(c *Config, v string) error { c.Store = v; return nil },
+	"MMC_SQLITE_PATH":             func(c *Config, v string) error { c.SQLitePath = v; return nil },
+	"MMC_QUEUE":                   func(c *Config, v string) error { c.Queue = v; return nil },
+	"MMC_REPS":                    func(c *Config, v string) error { c.Reps = v; return nil },
+	"MMC_LEGISLATORS":             func(c *Config, v string) error { c.LegislatorsPath = v; return nil },
+	"MMC_ZIP_DISTRICTS":           func(c *Config, v string) error { c.ZipDistrictsPath = v; return nil },
+	"MMC_LEGISLATOR_OFFICES":      func(c *Config, v string) error { c.LegislatorOfficesPath = v; return nil },
+	"MMC_GEOCODER":                func(c *Config, v string) error { c.Geocoder = v; return nil },
+	"MMC_ADDRESSES":               func(c *Config, v string) error { c.AddressesPath = v; return nil },
+	"MMC_REP_CACHE_TTL":           func(c *Config, v string) (err error) { c.RepCacheTTL, err = time.ParseDuration(v); return },
+	"MMC_CAMPAIGNS":               func(c *Config, v string) error { c.CampaignsPath = v; return nil },
+	"MMC_EVENTS":                  func(c *Config, v string) error { c.EventsPath = v; return nil },
+	"MMC_MAX_CALLS_PER_MINUTE":    func(c *Config, v string) (err error) { c.MaxCallsPerMinute, err = strconv.Atoi(v); return },
+	"MMC_MAX_DIAL_ATTEMPTS":       func(c *Config, v string) (err error) { c.MaxDialAttempts, err = strconv.Atoi(v); return },
+	"MMC_TEXT_LIMIT":              func(c *Config, v string) (err error) { c.TextLimit, err = parseLimit(v); return },
+	"MMC_NOW_LIMIT":               func(c *Config, v string) (err error) { c.NowLimit, err = parseLimit(v); return },
+	"MMC_CALL_LIMIT":              func(c *Config, v string) (err error) { c.CallLimit, err = parseLimit(v); return },
+}
+
+// parseCallWindow parses a window of hours like "12-17".
+func parseCallWindow(c *Config, v string) error {
+	parts := strings.Split(v, "-")
+	if len(parts) != 2 {
+		return fmt.Errorf("want START-END, got %q", v)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return err
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return err
+	}
+	c.CallWindowStart, c.CallWindowEnd = start, end
+	return nil
+}
+
+// LoadConfig reads configuration from the config file and the environment,
+// and validates it.
+func LoadConfig() (Config, error) {
+	c := defaultConfig()
+
+	path := os.Getenv("MMC_CONFIG")
+	if path == "" {
+		path = "config.yaml"
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			path = ""
+		}
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		// YAML is a superset of JSON, so this reads either.
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return c, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	for k, set := range envVars {
+		if v := os.Getenv(k); v != "" {
+			if err := set(&c, v); err != nil {
+				return c, fmt.Errorf("$%s: %v", k, err)
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// validate checks that required values are set and others make sense, and
+// loads the time zone.
+func (c *Config) validate() error {
+	var errs []string
+	for _, r := range []struct{ name, val string }{
+		{"host", c.Host},
+		{"twilio_sid", c.TwilioSID},
+		{"twilio_token", c.TwilioToken},
+		{"twilio_number", c.TwilioNumber},
+	} {
+		if r.val == "" {
+			errs = append(errs, r.name+" is required")
+		}
+	}
+	c.Host = strings.TrimSuffix(c.Host, "/")
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("time_zone: %v", err))
+	}
+	c.loc = loc
+
+	if c.CallWindowStart < 0 || c.CallWindowEnd > 24 || c.CallWindowStart >= c.CallWindowEnd {
+		errs = append(errs, fmt.Sprintf("call window %d-%d is not a range of hours in a day", c.CallWindowStart, c.CallWindowEnd))
+	}
+	if c.CallDelay < 0 {
+		errs = append(errs, "call_delay must not be negative")
+	}
+	if c.RepCacheTTL < 0 {
+		errs = append(errs, "rep_cache_ttl must not be negative")
+	}
+	if c.MaxCallsPerMinute < 0 {
+		errs = append(errs, "max_calls_per_minute must not be negative")
+	}
+	if c.MaxDialAttempts < 1 {
+		errs = append(errs, "max_dial_attempts must be at least 1")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Configure sets the configuration of this instance, and opens its backends.
+func Configure(c Config) error {
+	s, err := openStore(c)
+	if err != nil {
+		return err
+	}
+	store = s
+
+	q, err := openQueue(c)
+	if err != nil {
+		return err
+	}
+	queue = q
+
+	d, err := openRepProvider(c)
+	if err != nil {
+		return err
+	}
+	directory = d
+
+	cal, err := loadCalendar(c.CalendarPath)
+	if err != nil {
+		return err
+	}
+	calendar = cal
+
+	cs, err := loadCampaigns(c.CampaignsPath)
+	if err != nil {
+		return err
+	}
+	campaigns = cs
+
+	es, err := loadEvents(c.EventsPath)
+	if err != nil {
+		return err
+	}
+	events = es
+
+	g, err := openGeocoder(c)
+	if err != nil {
+		return err
+	}
+	geocoder = g
+
+	cfg = c
+	phone = consentGuard{&Twilio{
+		SID:     c.TwilioSID,
+		Token:   c.TwilioToken,
+		From:    c.TwilioNumber,
+		BaseURL: twilioBaseURL,
+		Host:    c.Host,
+
+		SecondaryToken: c.TwilioSecondaryToken,
+	}}
+	return nil
+}
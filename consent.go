@@ -0,0 +1,135 @@
+package app
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// ConsentEvent records a number opting in to or out of texts and calls.
+//
+// Events are only ever added, so the ledger shows when and how each number
+// consented, and the latest event is whether it does now. Numbers with no
+// events haven't opted out.
+type ConsentEvent struct {
+	PhoneNumber string `datastore:",noindex"`
+	Time        time.Time
+	OptIn       bool   `datastore:",noindex"`
+	Source      string `datastore:",noindex"` // How, e.g., "sms".
+	Keyword     string `datastore:",noindex"` // What they said, e.g., "STOP".
+}
+
+var (
+	ErrNoConsent = errors.New("no consent events")
+	ErrOptedOut  = errors.New("number has opted out")
+)
+
+// recordConsent adds an event to the number's consent ledger.
+func recordConsent(ctx context.Context, n string, optIn bool, source, keyword string) error {
+	e := &ConsentEvent{
+		PhoneNumber: n,
+		Time:        time.Now(),
+		OptIn:       optIn,
+		Source:      source,
+		Keyword:     keyword,
+	}
+	if err := store.AddConsent(ctx, e); err != nil {
+		log.Errorf(ctx, "AddConsent(%s): %v", n, err)
+		return err
+	}
+	log.Infof(ctx, "%s opted in=%t with %s %s", n, optIn, source, keyword)
+	return nil
+}
+
+// optedOut reports whether the number's latest consent event is an opt-out.
+func optedOut(ctx context.Context, n string) (bool, error) {
+	e, err := store.LatestConsent(ctx, n)
+	if err == ErrNoConsent {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !e.OptIn, nil
+}
+
+// consentGuard is a Telephony that refuses to text or call numbers that have
+// opted out, returning ErrOptedOut. Configure wraps the carrier in one, so
+// nothing is sent to them however it's sent.
+//
+// Replies to a number's own texts aren't blocked, so that STOP can be
+// confirmed; runCommand keeps them to the carrier keywords.
+type consentGuard struct {
+	Telephony
+}
+
+// check fails closed: if we can't tell whether the number opted out, we don't
+// send to it.
+func (g consentGuard) check(ctx context.Context, to string) error {
+	out, err := optedOut(ctx, to)
+	if err != nil {
+		return err
+	}
+	if out {
+		log.Warningf(ctx, "Not sending to %s, which opted out", to)
+		return ErrOptedOut
+	}
+	return nil
+}
+
+func (g consentGuard) SendSMS(ctx context.Context, to, text string) error {
+	if err := g.check(ctx, to); err != nil {
+		return err
+	}
+	return g.Telephony.SendSMS(ctx, to, text)
+}
+
+func (g consentGuard) SendCall(ctx context.Context, to, dial string) (string, error) {
+	if err := g.check(ctx, to); err != nil {
+		return "", err
+	}
+	return g.Telephony.SendCall(ctx, to, dial)
+}
+
+// optOut records that the number opted out, and soft-deletes its user, if
+// any: they're kept, but never called, until they opt back in.
+func optOut(ctx context.Context, n, keyword string) error {
+	if err := recordConsent(ctx, n, false, "sms", keyword); err != nil {
+		return err
+	}
+	if _, err := store.UpdateUser(ctx, n, func(u *User) error {
+		u.Stopped = time.Now()
+		u.NextCall = time.Time{}
+		return nil
+	}); err != nil && !isNotUser(err) {
+		log.Errorf(ctx, "UpdateUser(%s): %v", n, err)
+	}
+	if err := SkipNextCall(ctx, n); err != nil && err != ErrNoSkippableCalls {
+		// consentGuard will stop it anyway.
+		log.Errorf(ctx, "SkipNextCall(%s): %v", n, err)
+	}
+	return nil
+}
+
+// optIn records that the number opted in, and restores its user, if it was
+// soft-deleted. It returns the user, or nil if the number never joined.
+func optIn(ctx context.Context, n, source, keyword string) (*User, error) {
+	if err := recordConsent(ctx, n, true, source, keyword); err != nil {
+		return nil, err
+	}
+	u, err := store.UpdateUser(ctx, n, func(u *User) error {
+		if u.IsStopped() {
+			u.Stopped = time.Time{}
+			u.NextCall = someTimeTomorrow(*u)
+		}
+		return nil
+	})
+	if isNotUser(err) {
+		return nil, nil
+	} else if err != nil {
+		log.Errorf(ctx, "UpdateUser(%s): %v", n, err)
+		return nil, err
+	}
+	return u, nil
+}
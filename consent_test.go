@@ -0,0 +1,127 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fakePhone is a Telephony that records what it's asked to send.
+type fakePhone struct {
+	Twilio // For webhooks.
+
+	mu    sync.Mutex
+	texts []string // "to: text"
+	calls []string // "to -> dial"
+}
+
+func (p *fakePhone) SendSMS(ctx context.Context, to, text string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.texts = append(p.texts, to+": "+text)
+	return nil
+}
+
+func (p *fakePhone) SendCall(ctx context.Context, to, dial string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = append(p.calls, to+" -> "+dial)
+	return "CA" + randomString(), nil
+}
+
+func (p *fakePhone) Authenticate(r *http.Request) error { return nil }
+
+func TestConsentGuard(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	fp := &fakePhone{}
+	g := consentGuard{fp}
+
+	if err := g.SendSMS(ctx, userPhone, "hi"); err != nil {
+		t.Errorf("SendSMS to a number with no consent events: %v", err)
+	}
+	if err := optOut(ctx, userPhone, "STOP"); err != nil {
+		t.Fatalf("optOut: %v", err)
+	}
+	if err := g.SendSMS(ctx, userPhone, "hi again"); err != ErrOptedOut {
+		t.Errorf("SendSMS after opting out: got %v, want ErrOptedOut", err)
+	}
+	if _, err := g.SendCall(ctx, userPhone, "5550000"); err != ErrOptedOut {
+		t.Errorf("SendCall after opting out: got %v, want ErrOptedOut", err)
+	}
+	if _, err := optIn(ctx, userPhone, "sms", "START"); err != nil {
+		t.Fatalf("optIn: %v", err)
+	}
+	if err := g.SendSMS(ctx, userPhone, "welcome back"); err != nil {
+		t.Errorf("SendSMS after opting back in: %v", err)
+	}
+	if want := []string{userPhone + ": hi", userPhone + ": welcome back"}; strings.Join(fp.texts, "|") != strings.Join(want, "|") {
+		t.Errorf("Sent texts: got %q, want %q", fp.texts, want)
+	}
+	if len(fp.calls) != 0 {
+		t.Errorf("Placed calls: got %q, want none", fp.calls)
+	}
+}
+
+func TestStopAndStart(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	directory = &fakeReps{}
+
+	send := func(text, want string) {
+		t.Helper()
+		u, err := store.GetUser(ctx, userPhone)
+		if isNotUser(err) {
+			u = nil
+		}
+		got, err := runCommand(ctx, userPhone, u, text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", text, err)
+		} else if want == "" && got != "" || !strings.Contains(got, want) {
+			t.Errorf("runCommand(%q): got %q, want %q", text, got, want)
+		}
+	}
+
+	send("JOIN 12345", "you have joined")
+	for _, kw := range []string{"STOP", "stopall", "Unsubscribe", "CANCEL", "end", "QUIT"} {
+		send(kw, "unsubscribed")
+	}
+	u, err := store.GetUser(ctx, userPhone)
+	if err != nil {
+		t.Fatalf("GetUser after STOP: %v", err)
+	}
+	if !u.IsStopped() || u.ZipCode != "12345" {
+		t.Errorf("User after STOP: got %+v, want them stopped but kept", u)
+	}
+
+	// Only keywords are answered now.
+	send("STATUS", "")
+	send("hello", "")
+	send("HELP", "STOP - Stop all texts and calls")
+
+	send("UNSTOP", "Welcome back")
+	if u, err := store.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser after START: %v", err)
+	} else if u.IsStopped() || u.NextCall.IsZero() {
+		t.Errorf("User after START: got %+v, want them callable", u)
+	}
+	send("STATUS", "Your zip code is 12345")
+
+	send("STOP", "unsubscribed")
+	send("JOIN 54321", "Welcome back")
+	if u, err := store.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser after JOIN: %v", err)
+	} else if u.IsStopped() || u.ZipCode != "54321" {
+		t.Errorf("User after STOP and JOIN: got %+v", u)
+	}
+
+	if e, err := store.LatestConsent(ctx, userPhone); err != nil {
+		t.Errorf("LatestConsent: %v", err)
+	} else if !e.OptIn || e.Keyword != "JOIN" {
+		t.Errorf("LatestConsent: got %+v, want JOIN", e)
+	}
+}
@@ -1,38 +1,46 @@
+//go:build appengine
+// +build appengine
+
 package app
 
 import (
-	"errors"
-	"math/rand"
+	"encoding/json"
 	"time"
 
+	"github.com/ImJasonH/makemecall/log"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
-///////////
-// USERS //
-///////////
+// The datastore is registered by a var initializer, not init, because
+// appengine.go's init, which runs first, opens it. Package variables are all
+// initialized before any init runs.
+var _ = func() bool {
+	stores["datastore"] = func(Config) (Store, error) { return datastoreStore{}, nil }
+	return true
+}()
 
-type User struct {
-	PhoneNumber string `datastore:",noindex"` // Also the key.
-	ZipCode     string `datastore:",noindex"`
-	NextCall    time.Time
-}
+// datastoreStore is a Store backed by the App Engine datastore.
+//
+// Users are keyed by phone number, and are the ancestors of their Calls.
+type datastoreStore struct{}
 
-func (u User) NextCallFormatted() string {
-	return u.NextCall.In(nytz).Format(timeFmt)
+func userKey(ctx context.Context, n string) *datastore.Key {
+	return datastore.NewKey(ctx, "User", n, 0, nil)
 }
 
-func isNotUser(err error) bool {
-	return err == datastore.ErrNoSuchEntity
+func callKey(ctx context.Context, user, call string) *datastore.Key {
+	return datastore.NewKey(ctx, "Call", call, 0, userKey(ctx, user))
 }
 
-func GetUser(ctx context.Context, n string) (*User, error) {
-	k := datastore.NewKey(ctx, "User", n, 0, nil)
+///////////
+// USERS //
+///////////
+
+func (datastoreStore) GetUser(ctx context.Context, n string) (*User, error) {
 	var u User
-	if err := datastore.Get(ctx, k, &u); err == datastore.ErrNoSuchEntity {
-		return nil, err
+	if err := datastore.Get(ctx, userKey(ctx, n), &u); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchUser
 	} else if err != nil {
 		log.Errorf(ctx, "GetUser: Get(%q): %v", n, err)
 		return nil, err
@@ -40,24 +48,37 @@ func GetUser(ctx context.Context, n string) (*User, error) {
 	return &u, nil
 }
 
-func InsertUser(ctx context.Context, n, zip string) (*User, error) {
-	k := datastore.NewKey(ctx, "User", n, 0, nil)
-	u := User{
-		PhoneNumber: n,
-		ZipCode:     zip,
-		NextCall:    someTimeTomorrow(),
-	}
-	if _, err := datastore.Put(ctx, k, &u); err != nil {
-		log.Errorf(ctx, "InsertUser: Put(%q): %v", n, err)
+func (datastoreStore) PutUser(ctx context.Context, u *User) error {
+	_, err := datastore.Put(ctx, userKey(ctx, u.PhoneNumber), u)
+	return err
+}
+
+func (datastoreStore) UpdateUser(ctx context.Context, n string, f func(*User) error) (*User, error) {
+	var u User
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		k := userKey(ctx, n)
+		if err := datastore.Get(ctx, k, &u); err == datastore.ErrNoSuchEntity {
+			return ErrNoSuchUser
+		} else if err != nil {
+			return err
+		}
+		if err := f(&u); err != nil {
+			return err
+		}
+		_, err := datastore.Put(ctx, k, &u)
+		return err
+	}, nil); err != nil {
 		return nil, err
 	}
-	log.Infof(ctx, "Stored user: %s", n)
 	return &u, nil
 }
 
-func CallableUsers(ctx context.Context) ([]User, error) {
+func (datastoreStore) DeleteUser(ctx context.Context, n string) error {
+	return datastore.Delete(ctx, userKey(ctx, n))
+}
+
+func (datastoreStore) CallableUsers(ctx context.Context, now time.Time) ([]User, error) {
 	var us []User
-	now := time.Now().In(nytz)
 	q := datastore.NewQuery("User").
 		Filter("NextCall <", now).
 		Order("-NextCall").
@@ -78,179 +99,287 @@ func CallableUsers(ctx context.Context) ([]User, error) {
 			log.Errorf(ctx, "Query: %v", err)
 			return nil, err
 		}
-		us = append(us, u)
+		// Stopped users' NextCall is zero, so they sort last and don't
+		// crowd out callable ones.
+		if !u.IsStopped() {
+			us = append(us, u)
+		}
 	}
 	return us, nil
 }
 
-func SetNextCall(ctx context.Context, n string, next time.Time) (*User, error) {
-	var u User
+func (datastoreStore) ActiveUsers(ctx context.Context) ([]User, error) {
+	var us []User
+	for t := datastore.NewQuery("User").Run(ctx); ; {
+		var u User
+		if _, err := t.Next(&u); err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if !u.IsStopped() {
+			us = append(us, u)
+		}
+	}
+	return us, nil
+}
+
+///////////
+// CALLS //
+///////////
+
+func (datastoreStore) PutCall(ctx context.Context, c *Call) error {
+	_, err := datastore.Put(ctx, callKey(ctx, c.From, c.Key), c)
+	return err
+}
+
+func (datastoreStore) GetCall(ctx context.Context, user, key string) (*Call, error) {
+	var c Call
+	if err := datastore.Get(ctx, callKey(ctx, user, key), &c); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchCall
+	} else if err != nil {
+		log.Errorf(ctx, "GetCall: Get(%q): %v", key, err)
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (datastoreStore) LatestCall(ctx context.Context, user string) (*Call, error) {
+	q := datastore.NewQuery("Call").
+		Ancestor(userKey(ctx, user)).
+		Order("-Created").
+		Limit(1)
+	var c Call
+	if _, err := q.Run(ctx).Next(&c); err == datastore.Done {
+		return nil, ErrNoSuchCall
+	} else if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (datastoreStore) UserCalls(ctx context.Context, user string, n int) ([]Call, error) {
+	q := datastore.NewQuery("Call").
+		Ancestor(userKey(ctx, user)).
+		Order("-Created")
+	if n > 0 {
+		q = q.Limit(n)
+	}
+	var cs []Call
+	if _, err := q.GetAll(ctx, &cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (datastoreStore) CallsSince(ctx context.Context, since time.Time) ([]Call, error) {
+	var cs []Call
+	if _, err := datastore.NewQuery("Call").Filter("Created >=", since).GetAll(ctx, &cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (datastoreStore) UpdateCall(ctx context.Context, user, key string, f func(*Call) error) (*Call, error) {
+	var c Call
 	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		k := datastore.NewKey(ctx, "User", n, 0, nil)
-		if err := datastore.Get(ctx, k, &u); err != nil {
-			log.Errorf(ctx, "SetNextCall(%s): Get: %v", n, err)
+		k := callKey(ctx, user, key)
+		if err := datastore.Get(ctx, k, &c); err == datastore.ErrNoSuchEntity {
+			return ErrNoSuchCall
+		} else if err != nil {
 			return err
 		}
-		u.NextCall = next
-		log.Infof(ctx, "User %s will call tomorrow at %s", n, next)
-		if _, err := datastore.Put(ctx, k, &u); err != nil {
-			log.Errorf(ctx, "SetNextCall(%s): Put: %v", n, err)
+		if err := f(&c); err != nil {
 			return err
 		}
-		return nil
+		_, err := datastore.Put(ctx, k, &c)
+		return err
 	}, nil); err != nil {
 		return nil, err
 	}
-	return &u, nil
+	return &c, nil
 }
 
-func DeleteUser(ctx context.Context, n string) {
-	k := datastore.NewKey(ctx, "User", n, 0, nil)
-	if err := datastore.Delete(ctx, k); err != nil {
-		log.Errorf(ctx, "Error deleting %s: %v", n, err)
+func (s datastoreStore) SetSID(ctx context.Context, user, key, sid string) error {
+	if err := storeSIDLookup(ctx, sid, user, key); err != nil {
+		return err
 	}
-	log.Infof(ctx, "Deleted %s", n)
+	_, err := s.UpdateCall(ctx, user, key, func(c *Call) error {
+		c.Sid = sid
+		return nil
+	})
+	return err
 }
 
-///////////
-// CALLS //
-///////////
+func (datastoreStore) CallBySID(ctx context.Context, sid string) (*Call, error) {
+	ck := lookupBySID(ctx, sid)
+	if ck == nil {
+		return nil, ErrNoSuchCall
+	}
+	var c Call
+	if err := datastore.Get(ctx, ck, &c); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchCall
+	} else if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+//////////
+// REPS //
+//////////
 
-type Call struct {
-	Key      string `datastore:",noindex"`
-	To       string `datastore:",noindex"`
-	From     string `datastore:",noindex"`
-	Sid      string // Twilio SID
-	Created  time.Time
-	Duration time.Duration `datastore:",noindex"`
-	// "new" means not called yet, "skipped" means user SKIP'd, rest are Twilio statuses.
-	Status string
+func repsKey(ctx context.Context, zip string) *datastore.Key {
+	return datastore.NewKey(ctx, "CachedReps", zip, 0, nil)
 }
 
-const (
-	callKeyLength = 10
-	alphabet      = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
-)
+// cachedRepsEntity is how CachedReps are stored. The datastore can't hold a
+// list of Reps that each have a list of Offices, so they're JSON.
+type cachedRepsEntity struct {
+	Reps    []byte `datastore:",noindex"`
+	Fetched time.Time
+}
 
-func randomString() string {
-	s := make([]byte, callKeyLength)
-	for i := 0; i < callKeyLength; i++ {
-		s[i] = alphabet[rand.Intn(len(alphabet))]
+func (datastoreStore) GetCachedReps(ctx context.Context, zip string) (*CachedReps, error) {
+	var e cachedRepsEntity
+	err := datastore.Get(ctx, repsKey(ctx, zip), &e)
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		// Cached before Reps were JSON, so look them up again.
+		return nil, ErrNotCached
+	} else if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotCached
+	} else if err != nil {
+		return nil, err
 	}
-	return string(s)
-}
-
-func InsertCall(ctx context.Context, from, to string) (*Call, error) {
-	key := randomString()
-	pk := datastore.NewKey(ctx, "User", from, 0, nil)
-	k := datastore.NewKey(ctx, "Call", key, 0, pk)
-	now := time.Now()
-	c := Call{
-		Key:     key,
-		To:      to,
-		From:    from,
-		Created: now,
-		Status:  "new",
+	c := &CachedReps{Zip: zip, Fetched: e.Fetched}
+	if err := json.Unmarshal(e.Reps, &c.Reps); err != nil {
+		return nil, err
 	}
-	if _, err := datastore.Put(ctx, k, &c); err != nil {
-		log.Errorf(ctx, "InsertCall: Put(%q): %v", key, err)
+	return c, nil
+}
+
+func (datastoreStore) PutCachedReps(ctx context.Context, c *CachedReps) error {
+	b, err := json.Marshal(c.Reps)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(ctx, repsKey(ctx, c.Zip), &cachedRepsEntity{Reps: b, Fetched: c.Fetched})
+	return err
+}
+
+/////////////
+// CONSENT //
+/////////////
+
+// ConsentEvents are children of their number's User key, whether or not
+// there's a User.
+
+func (datastoreStore) AddConsent(ctx context.Context, e *ConsentEvent) error {
+	_, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "ConsentEvent", userKey(ctx, e.PhoneNumber)), e)
+	return err
+}
+
+func (datastoreStore) LatestConsent(ctx context.Context, n string) (*ConsentEvent, error) {
+	q := datastore.NewQuery("ConsentEvent").
+		Ancestor(userKey(ctx, n)).
+		Order("-Time").
+		Limit(1)
+	var e ConsentEvent
+	if _, err := q.Run(ctx).Next(&e); err == datastore.Done {
+		return nil, ErrNoConsent
+	} else if err != nil {
 		return nil, err
 	}
-	log.Infof(ctx, "Inserted Call %s", key)
-	return &c, nil
+	return &e, nil
 }
 
-func GetCall(ctx context.Context, u User, key string) (*Call, error) {
-	uk := datastore.NewKey(ctx, "User", u.PhoneNumber, 0, nil)
-	k := datastore.NewKey(ctx, "Call", key, 0, uk)
-	var c Call
-	if err := datastore.Get(ctx, k, &c); err != nil {
-		log.Errorf(ctx, "GetCall: Get(%q): %v", key, err)
+///////////////
+// ANALYTICS //
+///////////////
+
+func officeStatsKey(ctx context.Context, phone string) *datastore.Key {
+	return datastore.NewKey(ctx, "OfficeStats", phone, 0, nil)
+}
+
+func (datastoreStore) PutOfficeStats(ctx context.Context, s *OfficeStats) error {
+	_, err := datastore.Put(ctx, officeStatsKey(ctx, s.Phone), s)
+	return err
+}
+
+func (datastoreStore) GetOfficeStats(ctx context.Context, phone string) (*OfficeStats, error) {
+	var s OfficeStats
+	if err := datastore.Get(ctx, officeStatsKey(ctx, phone), &s); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoStats
+	} else if err != nil {
 		return nil, err
 	}
-	return &c, nil
+	return &s, nil
 }
 
-func UpdateCallBySID(ctx context.Context, sid, status string, dur time.Duration) error {
-	// Lookup Call key for SID.
-	ck := lookupBySID(ctx, sid)
-	if ck == nil {
-		return errors.New("sid lookup failed")
+func (datastoreStore) AllOfficeStats(ctx context.Context) ([]OfficeStats, error) {
+	var ss []OfficeStats
+	if _, err := datastore.NewQuery("OfficeStats").GetAll(ctx, &ss); err != nil {
+		return nil, err
 	}
+	return ss, nil
+}
 
-	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		var c Call
-		if err := datastore.Get(ctx, ck, &c); err != nil {
-			log.Errorf(ctx, "UpdateCallBySID(%q): Get: %v", sid, err)
-			return err
-		}
+/////////////////
+// RATE LIMITS //
+/////////////////
 
-		c.Status = status
-		log.Infof(ctx, "Updating status to %q", status)
-		if dur != time.Duration(0) {
-			c.Duration = dur
+func (datastoreStore) UpdateBucket(ctx context.Context, key string, f func(*Bucket) error) (*Bucket, error) {
+	b := Bucket{Key: key}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		k := datastore.NewKey(ctx, "Bucket", key, 0, nil)
+		if err := datastore.Get(ctx, k, &b); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
 		}
-		if _, err := datastore.Put(ctx, ck, &c); err != nil {
-			log.Errorf(ctx, "UpdateCallBySID: Put(%q): %v", sid, err)
+		if err := f(&b); err != nil {
 			return err
 		}
-		log.Infof(ctx, "Successful update")
-		return nil
-	}, nil)
+		_, err := datastore.Put(ctx, k, &b)
+		return err
+	}, nil); err != nil {
+		return nil, err
+	}
+	return &b, nil
 }
 
-// Sets SID on a call by key.
-func SetSID(ctx context.Context, u User, callID, sid string) error {
-	// Store the SIDLookup.
-	storeSIDLookup(ctx, sid, u.PhoneNumber, callID)
+////////////
+// EVENTS //
+////////////
 
-	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		uk := datastore.NewKey(ctx, "User", u.PhoneNumber, 0, nil)
-		k := datastore.NewKey(ctx, "Call", callID, 0, uk)
-		var c Call
-		if err := datastore.Get(ctx, k, &c); err != nil {
-			log.Errorf(ctx, "SetSID(%s): Get: %v", callID, err)
-			return err
-		}
-		c.Sid = sid
-		if _, err := datastore.Put(ctx, k, &c); err != nil {
-			log.Errorf(ctx, "SetSID(%s): Put: %v", callID, err)
+// Attendees are children of an Event entity, which is never stored, so they
+// can be queried by ancestor.
+func eventKey(ctx context.Context, event string) *datastore.Key {
+	return datastore.NewKey(ctx, "Event", event, 0, nil)
+}
+
+func (datastoreStore) UpdateAttendee(ctx context.Context, event, n string, f func(*Attendee) error) (*Attendee, error) {
+	a := Attendee{Event: event, PhoneNumber: n}
+	if err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		k := datastore.NewKey(ctx, "Attendee", n, 0, eventKey(ctx, event))
+		if err := datastore.Get(ctx, k, &a); err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
-		return nil
-	}, nil)
-}
-
-var ErrNoSkippableCalls = errors.New("no skippable calls")
-
-// Skips the latest "new" call for the user, sets the user's NextCall time.
-func SkipNextCall(ctx context.Context, n string) error {
-	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		uk := datastore.NewKey(ctx, "User", n, 0, nil)
-		q := datastore.NewQuery("Call").
-			Ancestor(uk).
-			Order("-Created"). // Key is a timestamp.
-			Limit(1)
-		var c Call
-		ck, err := q.Run(ctx).Next(&c)
-		if err != nil {
-			log.Errorf(ctx, "SkipNextCall(%s): Next: %v", n, err)
+		if err := f(&a); err != nil {
 			return err
 		}
+		_, err := datastore.Put(ctx, k, &a)
+		return err
+	}, nil); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
 
-		if c.Status != "new" {
-			log.Infof(ctx, `Next call (%s) is not "new": %s`, c.Key, c.Status)
-			return ErrNoSkippableCalls
-		}
-
-		log.Infof(ctx, "User's next call is %s", c.Key)
-		c.Status = "skipped"
-		if _, err := datastore.Put(ctx, ck, &c); err != nil {
-			log.Errorf(ctx, "SkipNextCall(%s): Put: %v", n, err)
-			return err
-		}
-		return nil
-	}, nil)
+func (datastoreStore) Attendees(ctx context.Context, event string) ([]Attendee, error) {
+	var as []Attendee
+	if _, err := datastore.NewQuery("Attendee").Ancestor(eventKey(ctx, event)).GetAll(ctx, &as); err != nil {
+		return nil, err
+	}
+	return as, nil
 }
 
 ////////////////
@@ -263,19 +392,20 @@ func SkipNextCall(ctx context.Context, n string) error {
 // include the originating user's phone number, which is necessary to construct
 // a User key, which is the ancestor of a Call key. :(
 //
-// So, instead, this small Entity maps Twilio SID -> Call key.
+// So, instead, this small Entity maps Twilio SID -> Call key. Other stores
+// index calls by SID directly.
 type SIDLookup struct {
 	// Key is SID
 	CallKey *datastore.Key
 }
 
-func storeSIDLookup(ctx context.Context, sid, user, call string) {
-	uk := datastore.NewKey(ctx, "User", user, 0, nil)
-	ck := datastore.NewKey(ctx, "Call", call, 0, uk)
+func storeSIDLookup(ctx context.Context, sid, user, call string) error {
 	luk := datastore.NewKey(ctx, "SIDLookup", sid, 0, nil)
-	if _, err := datastore.Put(ctx, luk, &SIDLookup{ck}); err != nil {
+	if _, err := datastore.Put(ctx, luk, &SIDLookup{callKey(ctx, user, call)}); err != nil {
 		log.Errorf(ctx, "storeSIDLookup(%q): %v", sid, err)
+		return err
 	}
+	return nil
 }
 
 func lookupBySID(ctx context.Context, sid string) *datastore.Key {
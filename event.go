@@ -0,0 +1,547 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// Event is a mass call: everyone who RSVPs is called during the same window,
+// so offices hear from many constituents at once.
+//
+// Events are read from the YAML file named by Config.EventsPath, like:
+//
+//	events:
+//	- code: AIRDAY
+//	  campaign: CLEANAIR
+//	  message: Call with hundreds of others to protect the Clean Air Act!
+//	  invite: 2017-03-20T12:00:00-04:00
+//	  start: 2017-03-21T12:00:00-04:00
+//	  end: 2017-03-21T13:00:00-04:00
+//	  office_calls_per_minute: 2
+//
+// Users are invited by text at Invite, or a day before Start: those who
+// follow Campaign, if it's set, or else everyone. Its script is texted to
+// them before their call, and only the reps it targets are called.
+type Event struct {
+	Code     string `yaml:"code"` // What users RSVP to.
+	Campaign string `yaml:"campaign"`
+	Message  string `yaml:"message"`
+	// Invite, Start and End are RFC 3339 times.
+	Invite string `yaml:"invite"`
+	Start  string `yaml:"start"`
+	End    string `yaml:"end"`
+	// OfficeCallsPerMinute is how many calls a minute each office gets,
+	// so their lines aren't jammed. The default is 2.
+	OfficeCallsPerMinute int `yaml:"office_calls_per_minute"`
+
+	invite, start, end time.Time
+}
+
+// events are the mass calls users can RSVP to. They're set by Configure.
+var events []*Event
+
+// loadEvents reads events from path. Campaigns must already be loaded.
+func loadEvents(path string) ([]*Event, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Events []*Event `yaml:"events"`
+	}
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	codes := map[string]bool{}
+	for _, e := range f.Events {
+		e.Code = strings.ToUpper(e.Code)
+		if e.Code == "" || strings.ContainsAny(e.Code, " \t\n") {
+			return nil, fmt.Errorf("%s: event %q needs a code with no spaces", path, e.Message)
+		}
+		if codes[e.Code] {
+			return nil, fmt.Errorf("%s: more than one event is %s", path, e.Code)
+		}
+		codes[e.Code] = true
+		if e.Campaign != "" && lookupCampaign(e.Campaign) == nil {
+			return nil, fmt.Errorf("%s: %s: no campaign %q", path, e.Code, e.Campaign)
+		}
+		if e.start, err = time.Parse(time.RFC3339, e.Start); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, e.Code, err)
+		}
+		if e.end, err = time.Parse(time.RFC3339, e.End); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, e.Code, err)
+		}
+		if !e.end.After(e.start) {
+			return nil, fmt.Errorf("%s: %s ends before it starts", path, e.Code)
+		}
+		e.invite = e.start.Add(-24 * time.Hour)
+		if e.Invite != "" {
+			if e.invite, err = time.Parse(time.RFC3339, e.Invite); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, e.Code, err)
+			}
+		}
+		if e.OfficeCallsPerMinute == 0 {
+			e.OfficeCallsPerMinute = 2
+		}
+	}
+	return f.Events, nil
+}
+
+// lookupEvent returns the event with the code, ignoring case, or nil.
+func lookupEvent(code string) *Event {
+	for _, e := range events {
+		if strings.EqualFold(e.Code, code) {
+			return e
+		}
+	}
+	return nil
+}
+
+// invites reports whether the event invites the user.
+func (e *Event) invites(u User) bool {
+	if e.Campaign == "" {
+		return true
+	}
+	for _, c := range u.Campaigns {
+		if strings.EqualFold(c, e.Campaign) {
+			return true
+		}
+	}
+	return false
+}
+
+// Attendee is a user who RSVP'd to an event, and how their call is going.
+type Attendee struct {
+	Event       string    `datastore:",noindex"`
+	PhoneNumber string    `datastore:",noindex"`
+	RSVPed      time.Time `datastore:",noindex"`
+	// Status is "going" until their call's scheduled, then "scheduled", or
+	// "unscheduled" if there wasn't room in the window. Then it's "called",
+	// with CallKey, or "failed" if the call couldn't be placed.
+	Status  string    `datastore:",noindex"`
+	Rep     Rep       `datastore:",noindex"`
+	CallAt  time.Time `datastore:",noindex"`
+	CallKey string    `datastore:",noindex"`
+}
+
+var ErrNoSuchEvent = errors.New("no such event")
+
+func init() {
+	jobHandlers["sms"] = func(ctx context.Context, b []byte) error {
+		var a smsArgs
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		if err := phone.SendSMS(ctx, a.To, a.Text); err != nil && err != ErrOptedOut {
+			return err
+		}
+		return nil
+	}
+	jobHandlers["event-invite"] = func(ctx context.Context, b []byte) error {
+		var code string
+		if err := json.Unmarshal(b, &code); err != nil {
+			return err
+		}
+		return inviteToEvent(ctx, code)
+	}
+	jobHandlers["event-start"] = func(ctx context.Context, b []byte) error {
+		var code string
+		if err := json.Unmarshal(b, &code); err != nil {
+			return err
+		}
+		return startEvent(ctx, code, time.Now())
+	}
+	jobHandlers["event-call"] = func(ctx context.Context, b []byte) error {
+		var a eventCallArgs
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		return eventCall(ctx, a.Event, a.PhoneNumber)
+	}
+}
+
+type smsArgs struct {
+	To, Text string
+}
+
+type eventCallArgs struct {
+	Event, PhoneNumber string
+}
+
+// runEvents starts inviting users to events, and starts events, when it's
+// time. Each happens once per event, however often it's run.
+func runEvents(ctx context.Context, now time.Time) {
+	for _, e := range events {
+		if !now.Before(e.invite) && now.Before(e.start) {
+			if err := enqueue(ctx, "event-invite", "event-invite-"+e.Code, 0, e.Code); err != nil {
+				log.Errorf(ctx, "enqueue event-invite %s: %v", e.Code, err)
+			}
+		}
+		if !now.Before(e.start) && now.Before(e.end) {
+			if err := enqueue(ctx, "event-start", "event-start-"+e.Code, 0, e.Code); err != nil {
+				log.Errorf(ctx, "enqueue event-start %s: %v", e.Code, err)
+			}
+		}
+	}
+}
+
+// inviteToEvent texts everyone the event invites, each in their own job.
+func inviteToEvent(ctx context.Context, code string) error {
+	e := lookupEvent(code)
+	if e == nil {
+		log.Errorf(ctx, "No event %s", code)
+		return nil
+	}
+	us, err := store.ActiveUsers(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ActiveUsers: %v", err)
+		return err
+	}
+	n := 0
+	for _, u := range us {
+		if !e.invites(u) {
+			continue
+		}
+		text := fmt.Sprintf("%s\nIt's %s. Text RSVP %s to be called then!",
+			e.Message, e.start.In(u.Location()).Format(timeFmt), e.Code)
+		if err := enqueue(ctx, "sms", "event-invite-"+e.Code+"-"+u.PhoneNumber, 0, smsArgs{u.PhoneNumber, text}); err != nil {
+			log.Errorf(ctx, "enqueue sms: %v", err)
+			return err
+		}
+		n++
+	}
+	log.Infof(ctx, "Invited %d users to %s", n, e.Code)
+	return nil
+}
+
+// rsvp replies to RSVP, signing the user up for an event's mass call. With
+// no code, it's the only upcoming event they're invited to.
+func rsvp(ctx context.Context, r *request) (string, error) {
+	now := time.Now()
+	e := lookupEvent(r.Arg)
+	if r.Arg == "" {
+		var upcoming []*Event
+		for _, e := range events {
+			if now.Before(e.end) && e.invites(*r.User) {
+				upcoming = append(upcoming, e)
+			}
+		}
+		if len(upcoming) == 1 {
+			e = upcoming[0]
+		} else if len(upcoming) > 1 {
+			var codes []string
+			for _, e := range upcoming {
+				codes = append(codes, e.Code)
+			}
+			return fmt.Sprintf("Text RSVP and one of %s.", strings.Join(codes, ", ")), nil
+		}
+	}
+	if e == nil || !now.Before(e.end) {
+		return "Sorry, there's no mass call like that coming up.", nil
+	}
+	if _, err := store.UpdateAttendee(ctx, e.Code, r.From, func(a *Attendee) error {
+		if a.Status == "" {
+			a.RSVPed = now
+			a.Status = "going"
+		}
+		return nil
+	}); err != nil {
+		log.Errorf(ctx, "UpdateAttendee(%s, %s): %v", e.Code, r.From, err)
+		return "We couldn't save that right now. Try again later.", nil
+	}
+	when := e.start.In(r.User.Location())
+	if now.After(e.start) {
+		when = now.In(r.User.Location())
+	}
+	return fmt.Sprintf("You're in! We'll call you for %s between %s and %s.",
+		e.Code, when.Format("Monday 3:04PM"), e.end.In(r.User.Location()).Format("3:04PM MST")), nil
+}
+
+// startEvent schedules a call for everyone going to the event, spread across
+// the rest of its window, so that we start at most cfg.MaxCallsPerMinute
+// calls, and each office gets at most OfficeCallsPerMinute.
+func startEvent(ctx context.Context, code string, now time.Time) error {
+	e := lookupEvent(code)
+	if e == nil {
+		log.Errorf(ctx, "No event %s", code)
+		return nil
+	}
+	as, err := store.Attendees(ctx, e.Code)
+	if err != nil {
+		log.Errorf(ctx, "Attendees(%s): %v", e.Code, err)
+		return err
+	}
+	from := e.start
+	if now.After(from) {
+		from = now
+	}
+	s := newEventSchedule(from, e.end, cfg.MaxCallsPerMinute, e.OfficeCallsPerMinute)
+	// If this is a retry, leave room for calls already scheduled.
+	for _, a := range as {
+		if a.Status == "scheduled" {
+			s.take(a.Rep.PhoneNumber(), a.CallAt)
+		}
+	}
+	// Call them in the order they RSVP'd.
+	sort.Slice(as, func(i, j int) bool { return as[i].RSVPed.Before(as[j].RSVPed) })
+	for _, a := range as {
+		if a.Status != "going" {
+			continue
+		}
+		status, rep, at := "unscheduled", Rep{}, time.Time{}
+		if r, ok := eventRep(ctx, e, a.PhoneNumber); ok {
+			if t, ok := s.next(r.PhoneNumber()); ok {
+				status, rep, at = "scheduled", r, t
+			}
+		}
+		if _, err := store.UpdateAttendee(ctx, e.Code, a.PhoneNumber, func(a *Attendee) error {
+			a.Status, a.Rep, a.CallAt = status, rep, at
+			return nil
+		}); err != nil {
+			log.Errorf(ctx, "UpdateAttendee(%s, %s): %v", e.Code, a.PhoneNumber, err)
+			return err
+		}
+		if status != "scheduled" {
+			log.Warningf(ctx, "Couldn't schedule %s's call for %s", a.PhoneNumber, e.Code)
+			continue
+		}
+		if err := enqueue(ctx, "event-call", "event-call-"+e.Code+"-"+a.PhoneNumber, at.Sub(now), eventCallArgs{e.Code, a.PhoneNumber}); err != nil {
+			log.Errorf(ctx, "enqueue event-call: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// eventRep picks which rep the user calls for the event.
+func eventRep(ctx context.Context, e *Event, n string) (Rep, bool) {
+	u, err := store.GetUser(ctx, n)
+	if err != nil {
+		log.Errorf(ctx, "GetUser(%s): %v", n, err)
+		return Rep{}, false
+	}
+	reps, err := LookupReps(ctx, u.ZipCode)
+	if err != nil {
+		return Rep{}, false
+	}
+	reps = inDistrict(reps, u.District)
+	if c := lookupCampaign(e.Campaign); c != nil {
+		var targets []Rep
+		for _, r := range reps {
+			if c.Targets(r) {
+				targets = append(targets, r)
+			}
+		}
+		reps = targets
+	}
+	if len(reps) == 0 {
+		return Rep{}, false
+	}
+	return reps[rand.Intn(len(reps))], true
+}
+
+// eventSchedule hands out minutes of an event's window to calls.
+type eventSchedule struct {
+	from, end            time.Time
+	perMinute, perOffice int
+	total                map[int]int            // Minute -> calls.
+	office               map[string]map[int]int // Office number -> minute -> calls.
+}
+
+func newEventSchedule(from, end time.Time, perMinute, perOffice int) *eventSchedule {
+	return &eventSchedule{
+		from:      from,
+		end:       end,
+		perMinute: perMinute,
+		perOffice: perOffice,
+		total:     map[int]int{},
+		office:    map[string]map[int]int{},
+	}
+}
+
+// take records a call to the office at t.
+func (s *eventSchedule) take(office string, t time.Time) {
+	m := int(t.Sub(s.from) / time.Minute)
+	s.total[m]++
+	if s.office[office] == nil {
+		s.office[office] = map[int]int{}
+	}
+	s.office[office][m]++
+}
+
+// next returns a time in the earliest minute with room for a call to the
+// office, and takes it, or false if the window's full.
+func (s *eventSchedule) next(office string) (time.Time, bool) {
+	for m := 0; s.from.Add(time.Duration(m) * time.Minute).Before(s.end); m++ {
+		if (s.perMinute > 0 && s.total[m] >= s.perMinute) || s.office[office][m] >= s.perOffice {
+			continue
+		}
+		t := s.from.Add(time.Duration(m)*time.Minute + time.Duration(rand.Intn(60))*time.Second)
+		if !t.Before(s.end) {
+			t = s.from.Add(time.Duration(m) * time.Minute)
+		}
+		s.take(office, t)
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// eventCall texts the user their script, and calls them and connects them to
+// their rep, for the event.
+func eventCall(ctx context.Context, code, n string) error {
+	e := lookupEvent(code)
+	if e == nil {
+		log.Errorf(ctx, "No event %s", code)
+		return nil
+	}
+	u, err := store.GetUser(ctx, n)
+	if err != nil {
+		log.Errorf(ctx, "GetUser(%s): %v", n, err)
+		return err
+	}
+	var a *Attendee
+	if a, err = store.UpdateAttendee(ctx, e.Code, n, func(*Attendee) error { return nil }); err != nil {
+		log.Errorf(ctx, "UpdateAttendee(%s, %s): %v", e.Code, n, err)
+		return err
+	}
+	if a.Status != "scheduled" || u.IsStopped() {
+		log.Infof(ctx, "Not calling %s for %s: %s", n, e.Code, a.Status)
+		return nil
+	}
+	setStatus := func(status, key string) {
+		if _, err := store.UpdateAttendee(ctx, e.Code, n, func(a *Attendee) error {
+			a.Status, a.CallKey = status, key
+			return nil
+		}); err != nil {
+			log.Errorf(ctx, "UpdateAttendee(%s, %s): %v", e.Code, n, err)
+		}
+	}
+	if wait := allow(ctx, limitCalls, n, cfg.CallLimit); wait > 0 {
+		setStatus("failed", "")
+		return nil
+	}
+
+	// Mass calls are spread out over reps' offices in Washington, so that's
+	// where they go.
+	c, err := InsertCall(ctx, n, a.Rep, a.Rep.mainOffice())
+	if err != nil {
+		log.Errorf(ctx, "InsertCall: %v", err)
+		return err
+	}
+	msg := fmt.Sprintf("It's time for the %s mass call! We're calling you now to connect you to %s.", e.Code, a.Rep)
+	if camp := lookupCampaign(e.Campaign); camp != nil {
+		msg += "\nHere's what you can say:\n" + camp.ScriptFor(*u, a.Rep)
+	}
+	if err := phone.SendSMS(ctx, n, msg); err != nil {
+		log.Errorf(ctx, "SendSMS: %v", err)
+	}
+	sid, err := phone.SendCall(ctx, n, a.Rep.PhoneNumber())
+	if err != nil {
+		// It's too late to try again.
+		log.Errorf(ctx, "SendCall: %v", err)
+		setStatus("failed", c.Key)
+		return nil
+	}
+	if err := store.SetSID(ctx, n, c.Key, sid); err != nil {
+		log.Errorf(ctx, "SetSID: %v", err)
+	}
+	setStatus("called", c.Key)
+	return nil
+}
+
+// EventProgress is how an event's calls are going.
+type EventProgress struct {
+	Code  string    `json:"code"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	RSVPs       int `json:"rsvps"`
+	Scheduled   int `json:"scheduled"`   // Not called yet.
+	Unscheduled int `json:"unscheduled"` // No room in the window.
+	Called      int `json:"called"`
+	InProgress  int `json:"in_progress"` // Called, and not done yet.
+	Connected   int `json:"connected"`
+	Failed      int `json:"failed"` // Not placed, or not answered.
+}
+
+// eventProgress tallies the event's attendees and their calls.
+func eventProgress(ctx context.Context, e *Event) (*EventProgress, error) {
+	as, err := store.Attendees(ctx, e.Code)
+	if err != nil {
+		return nil, err
+	}
+	p := &EventProgress{Code: e.Code, Start: e.start, End: e.end, RSVPs: len(as)}
+	for _, a := range as {
+		switch a.Status {
+		case "scheduled":
+			p.Scheduled++
+		case "unscheduled":
+			p.Unscheduled++
+		case "failed":
+			p.Failed++
+		case "called":
+			p.Called++
+			c, err := store.GetCall(ctx, a.PhoneNumber, a.CallKey)
+			if err != nil {
+				return nil, err
+			}
+			switch c.Status {
+			case StateCompleted:
+				p.Connected++
+			case StateBusy, StateNoAnswer, StateFailed, StateCanceled, StateSkipped, StateLimited:
+				p.Failed++
+			default:
+				p.InProgress++
+			}
+		}
+	}
+	return p, nil
+}
+
+// eventsHandler serves the progress of events as JSON: of ?code=, or of all
+// of them.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	es := events
+	if code := r.FormValue("code"); code != "" {
+		e := lookupEvent(code)
+		if e == nil {
+			http.Error(w, ErrNoSuchEvent.Error(), http.StatusNotFound)
+			return
+		}
+		es = []*Event{e}
+	}
+	ps := []*EventProgress{}
+	for _, e := range es {
+		p, err := eventProgress(ctx, e)
+		if err != nil {
+			log.Errorf(ctx, "eventProgress(%s): %v", e.Code, err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		ps = append(ps, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ps); err != nil {
+		log.Errorf(ctx, "Encode: %v", err)
+	}
+}
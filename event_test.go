@@ -0,0 +1,219 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// loadTestEvents sets campaigns and events from testdata.
+func loadTestEvents(t *testing.T) {
+	var err error
+	if campaigns, err = loadCampaigns("testdata/campaigns.yaml"); err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	if events, err = loadEvents("testdata/events.yaml"); err != nil {
+		t.Fatalf("loadEvents: %v", err)
+	}
+}
+
+func TestLoadEvents(t *testing.T) {
+	defer func(cs []*Campaign, es []*Event) { campaigns, events = cs, es }(campaigns, events)
+	loadTestEvents(t)
+	if len(events) != 2 {
+		t.Fatalf("loadEvents: got %+v", events)
+	}
+	air, all := events[0], events[1]
+	if air.Code != "AIRDAY" || air.OfficeCallsPerMinute != 1 || air.end.Sub(air.start) != 10*time.Minute {
+		t.Errorf("AIRDAY: got %+v", air)
+	}
+	if all.OfficeCallsPerMinute != 2 || !all.invite.Equal(all.start.Add(-24*time.Hour)) {
+		t.Errorf("EVERYONE: got %+v, want 2 calls a minute and an invite a day before", all)
+	}
+	if lookupEvent("airday") != air || lookupEvent("nope") != nil {
+		t.Errorf("lookupEvent: got the wrong events")
+	}
+	if air.invites(User{}) || !air.invites(User{Campaigns: []string{"CLEANAIR"}}) || !all.invites(User{}) {
+		t.Errorf("invites: got the wrong users")
+	}
+
+	dir, err := ioutil.TempDir("", "makemecall")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	const times = "  start: 2017-03-21T12:00:00Z\n  end: 2017-03-21T13:00:00Z\n"
+	for _, bad := range []string{
+		"events:\n- message: No code\n" + times,
+		"events:\n- code: A\n" + times + "- code: a\n" + times,
+		"events:\n- code: A\n  campaign: NOPE\n" + times,
+		"events:\n- code: A\n  start: noon\n  end: 2017-03-21T13:00:00Z\n",
+		"events:\n- code: A\n  start: 2017-03-21T13:00:00Z\n  end: 2017-03-21T12:00:00Z\n",
+	} {
+		path := writeTemp(t, dir, bad)
+		if _, err := loadEvents(path); err == nil {
+			t.Errorf("loadEvents(%q): got no error", bad)
+		}
+	}
+}
+
+func TestEventSchedule(t *testing.T) {
+	from := time.Date(2017, 3, 21, 16, 0, 0, 0, time.UTC)
+	s := newEventSchedule(from, from.Add(3*time.Minute), 3, 2)
+	s.take("A", from.Add(30*time.Second))
+
+	// Minute 0 has room for one more call to A, and then B.
+	var got []string
+	for _, office := range []string{"A", "A", "B", "A", "A", "A", "B", "B", "B"} {
+		t, ok := s.next(office)
+		if !ok {
+			got = append(got, office+" none")
+			continue
+		}
+		got = append(got, office+" "+t.Sub(from).Truncate(time.Minute).String())
+	}
+	want := []string{"A 0s", "A 1m0s", "B 0s", "A 1m0s", "A 2m0s", "A 2m0s", "B 1m0s", "B 2m0s", "B none"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("next: got %q, want %q", got, want)
+	}
+}
+
+func TestMassCall(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(cs []*Campaign, es []*Event, d RepProvider, p Telephony) {
+		campaigns, events, directory, phone = cs, es, d, p
+	}(campaigns, events, directory, phone)
+	loadTestEvents(t)
+	directory = &fakeReps{reps: []Rep{senator, houseRep}}
+	fp := &fakePhone{}
+	phone = fp
+	air := lookupEvent("AIRDAY")
+	// Move the events to tomorrow, so they're coming up.
+	d := time.Since(air.start).Truncate(24*time.Hour) + 24*time.Hour
+	for _, e := range events {
+		e.invite, e.start, e.end = e.invite.Add(d), e.start.Add(d), e.end.Add(d)
+	}
+
+	followers := []string{userPhone, "5551111", "5552222"}
+	for _, n := range append(followers, "5553333") {
+		u := User{PhoneNumber: n, ZipCode: zip}
+		if n != "5553333" {
+			u.Campaigns = []string{"CLEANAIR"}
+		}
+		if err := store.PutUser(ctx, &u); err != nil {
+			t.Fatalf("PutUser: %v", err)
+		}
+	}
+
+	// Invites go to followers, once, after the invite time.
+	runEvents(ctx, air.invite.Add(-time.Minute))
+	if _, err := s.GetJob(ctx, "event-invite-AIRDAY"); err != ErrNoSuchJob {
+		t.Errorf("Invite job before invite time: got %v, want ErrNoSuchJob", err)
+	}
+	runEvents(ctx, air.invite)
+	if _, err := s.GetJob(ctx, "event-invite-AIRDAY"); err != nil {
+		t.Errorf("Invite job: %v", err)
+	}
+	if err := inviteToEvent(ctx, "AIRDAY"); err != nil {
+		t.Fatalf("inviteToEvent: %v", err)
+	}
+	for _, n := range followers {
+		if _, err := s.GetJob(ctx, "event-invite-AIRDAY-"+n); err != nil {
+			t.Errorf("Invite to %s: %v", n, err)
+		}
+	}
+	if _, err := s.GetJob(ctx, "event-invite-AIRDAY-5553333"); err != ErrNoSuchJob {
+		t.Errorf("Invite to non-follower: got %v, want ErrNoSuchJob", err)
+	}
+
+	for _, c := range []struct{ from, text, want string }{
+		{userPhone, "RSVP airday", "You're in! We'll call you for AIRDAY"},
+		{"5551111", "RSVP AIRDAY", "You're in!"},
+		{"5552222", "RSVP", "Text RSVP and one of AIRDAY, EVERYONE."},
+		{"5552222", "RSVP AIRDAY", "You're in!"},
+		{"5553333", "RSVP", "You're in! We'll call you for EVERYONE"},
+		{"5553333", "RSVP NOPE", "Sorry, there's no mass call like that"},
+	} {
+		u, err := store.GetUser(ctx, c.from)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		got, err := runCommand(ctx, c.from, u, c.text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", c.text, err)
+		} else if !strings.Contains(got, c.want) {
+			t.Errorf("runCommand(%q): got %q, want it to contain %q", c.text, got, c.want)
+		}
+	}
+
+	// Each office gets one call a minute, and only the House is targeted.
+	if err := startEvent(ctx, "AIRDAY", air.start); err != nil {
+		t.Fatalf("startEvent: %v", err)
+	}
+	as, err := store.Attendees(ctx, "AIRDAY")
+	if err != nil {
+		t.Fatalf("Attendees: %v", err)
+	}
+	minutes := map[int]bool{}
+	for _, a := range as {
+		if a.Status != "scheduled" || a.Rep.PhoneNumber() != houseRep.PhoneNumber() {
+			t.Errorf("Attendee after startEvent: got %+v", a)
+		}
+		m := int(a.CallAt.Sub(air.start) / time.Minute)
+		if minutes[m] {
+			t.Errorf("More than one call to the office in minute %d", m)
+		}
+		minutes[m] = true
+		if _, err := s.GetJob(ctx, "event-call-AIRDAY-"+a.PhoneNumber); err != nil {
+			t.Errorf("Call job for %s: %v", a.PhoneNumber, err)
+		}
+	}
+
+	for _, n := range followers[:2] {
+		if err := eventCall(ctx, "AIRDAY", n); err != nil {
+			t.Fatalf("eventCall: %v", err)
+		}
+	}
+	if len(fp.calls) != 2 || fp.calls[0] != userPhone+" -> "+houseRep.PhoneNumber() {
+		t.Errorf("Calls: got %q", fp.calls)
+	}
+	if len(fp.texts) != 2 || !strings.Contains(fp.texts[0], "It's time for the AIRDAY mass call!") || !strings.Contains(fp.texts[0], "vote no on H.R. 1234") {
+		t.Errorf("Texts: got %q", fp.texts)
+	}
+	a, err := store.UpdateAttendee(ctx, "AIRDAY", userPhone, func(*Attendee) error { return nil })
+	if err != nil {
+		t.Fatalf("UpdateAttendee: %v", err)
+	}
+	if _, err := store.UpdateCall(ctx, userPhone, a.CallKey, func(c *Call) error { c.Status = StateCompleted; return nil }); err != nil {
+		t.Fatalf("UpdateCall: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	eventsHandler(w, httptest.NewRequest("GET", "/events?code=airday", nil))
+	var ps []EventProgress
+	if err := json.NewDecoder(w.Body).Decode(&ps); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	want := EventProgress{Code: "AIRDAY", Start: air.start, End: air.end, RSVPs: 3, Scheduled: 1, Called: 2, InProgress: 1, Connected: 1}
+	if len(ps) != 1 || !ps[0].Start.Equal(want.Start) {
+		t.Fatalf("/events: got %+v, want [%+v]", ps, want)
+	}
+	ps[0].Start, ps[0].End = want.Start, want.End
+	if ps[0] != want {
+		t.Errorf("/events: got %+v, want %+v", ps[0], want)
+	}
+
+	w = httptest.NewRecorder()
+	eventsHandler(w, httptest.NewRequest("GET", "/events?code=nope", nil))
+	if w.Code != 404 {
+		t.Errorf("/events for no event: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Geocoder finds the congressional district a street address is in.
+//
+// Implementations are censusGeocoder, which asks the US Census Bureau, and
+// addressFile, which reads a local file. They're selected by Config.Geocoder.
+type Geocoder interface {
+	// Geocode returns the district containing the address, and its ZIP code
+	// if known. It returns ErrNoSuchAddress if the address can't be found.
+	Geocode(ctx context.Context, address string) (d District, zip string, err error)
+}
+
+// geocoder resolves users' addresses. It's set by Configure.
+var geocoder Geocoder
+
+var ErrNoSuchAddress = errors.New("no such address")
+
+func openGeocoder(c Config) (Geocoder, error) {
+	switch c.Geocoder {
+	case "census":
+		return censusGeocoder{BaseURL: "https://geocoding.geo.census.gov"}, nil
+	case "file":
+		return loadAddressFile(c.AddressesPath)
+	}
+	return nil, fmt.Errorf("unknown geocoder %q; want \"census\" or \"file\"", c.Geocoder)
+}
+
+// censusGeocoder is a Geocoder backed by the US Census Bureau's geocoder,
+// which needs no API key. See
+// https://geocoding.geo.census.gov/geocoder/Geocoding_Services_API.html
+type censusGeocoder struct {
+	BaseURL string
+}
+
+// censusDistrictRE matches the field the district is in, which is named for
+// the Congress, like "CD119". Other fields, like CDSESSN, are about the layer.
+var censusDistrictRE = regexp.MustCompile(`^CD[0-9]+$`)
+
+// censusResponse is the part of the geocoder's response we need.
+type censusResponse struct {
+	Result struct {
+		AddressMatches []struct {
+			AddressComponents struct {
+				State string `json:"state"`
+				Zip   string `json:"zip"`
+			} `json:"addressComponents"`
+			// Layer names, like "119th Congressional Districts", to the
+			// areas in that layer containing the address.
+			Geographies map[string][]map[string]interface{} `json:"geographies"`
+		} `json:"addressMatches"`
+	} `json:"result"`
+}
+
+func (g censusGeocoder) Geocode(ctx context.Context, address string) (District, string, error) {
+	v := url.Values{
+		"address":   {address},
+		"benchmark": {"Public_AR_Current"},
+		"vintage":   {"Current_Current"},
+		"layers":    {"all"},
+		"format":    {"json"},
+	}
+	resp, err := httpClient(ctx).Get(g.BaseURL + "/geocoder/geographies/onelineaddress?" + v.Encode())
+	if err != nil {
+		return District{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return District{}, "", fmt.Errorf("returned %d", resp.StatusCode)
+	}
+	var r censusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return District{}, "", fmt.Errorf("json.Decode: %v", err)
+	}
+	if len(r.Result.AddressMatches) == 0 {
+		return District{}, "", ErrNoSuchAddress
+	}
+	m := r.Result.AddressMatches[0]
+	for layer, areas := range m.Geographies {
+		if !strings.HasSuffix(layer, "Congressional Districts") || len(areas) == 0 {
+			continue
+		}
+		for k, v := range areas[0] {
+			s, ok := v.(string)
+			if !censusDistrictRE.MatchString(k) || !ok {
+				continue
+			}
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return District{}, "", fmt.Errorf("bad district %s=%q", k, s)
+			}
+			// 00 is at-large; 98 is a non-voting delegate, e.g., DC's.
+			if n == 98 {
+				n = 0
+			}
+			return District{m.AddressComponents.State, n}, m.AddressComponents.Zip, nil
+		}
+	}
+	return District{}, "", fmt.Errorf("no congressional district for %q", address)
+}
+
+// addressFile is a Geocoder that looks addresses up in a CSV file, for tests
+// and running offline. Each row is an address, its state, district number and
+// ZIP code, e.g.:
+//
+//	"123 Main St, New York, NY 10024",NY,12,10024
+//
+// Addresses are matched ignoring case, punctuation and spacing.
+type addressFile map[string]addressEntry
+
+type addressEntry struct {
+	district District
+	zip      string
+}
+
+func loadAddressFile(path string) (addressFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := addressFile{}
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = 4
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		n, err := strconv.Atoi(rec[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad district %q for %q", path, rec[2], rec[0])
+		}
+		a[normalizeAddress(rec[0])] = addressEntry{District{rec[1], n}, rec[3]}
+	}
+	return a, nil
+}
+
+func (a addressFile) Geocode(ctx context.Context, address string) (District, string, error) {
+	e, found := a[normalizeAddress(address)]
+	if !found {
+		return District{}, "", ErrNoSuchAddress
+	}
+	return e.district, e.zip, nil
+}
+
+// addressCity returns the city in an address like "STREET, CITY, STATE ZIP",
+// or "" if there isn't one.
+func addressCity(addr string) string {
+	parts := strings.Split(addr, ",")
+	if len(parts) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(parts[len(parts)-2])
+}
+
+// normalizeAddress upper-cases the address, and reduces punctuation and runs
+// of spaces to single spaces.
+func normalizeAddress(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToUpper(s), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '.' || r == '\t' || r == '#'
+	}), " ")
+}
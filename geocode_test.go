@@ -0,0 +1,124 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestAddressFile(t *testing.T) {
+	a, err := loadAddressFile("testdata/addresses.csv")
+	if err != nil {
+		t.Fatalf("loadAddressFile: %v", err)
+	}
+	for _, c := range []struct {
+		addr    string
+		want    District
+		wantZip string
+		wantErr error
+	}{
+		{"200 W 79th St, New York, NY 10024", District{"NY", 12}, "10024", nil},
+		{"  400 w. 125th st new york ny ", District{"NY", 13}, "10027", nil},
+		{"2020 Carey Ave, Cheyenne, WY 82001", District{"WY", 0}, "82001", nil},
+		{"1 Nowhere Ln", District{}, "", ErrNoSuchAddress},
+	} {
+		d, zip, err := a.Geocode(context.Background(), c.addr)
+		if d != c.want || zip != c.wantZip || err != c.wantErr {
+			t.Errorf("Geocode(%q): got %v, %q, %v; want %v, %q, %v", c.addr, d, zip, err, c.want, c.wantZip, c.wantErr)
+		}
+	}
+}
+
+func TestCensusGeocoder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/geocoder/geographies/onelineaddress" {
+			http.NotFound(w, r)
+			return
+		}
+		if !strings.Contains(r.FormValue("address"), "79th") {
+			w.Write([]byte(`{"result":{"addressMatches":[]}}`))
+			return
+		}
+		w.Write([]byte(`{"result":{"addressMatches":[{
+			"matchedAddress":"200 W 79TH ST, NEW YORK, NY, 10024",
+			"addressComponents":{"state":"NY","zip":"10024"},
+			"geographies":{
+				"States":[{"STUSAB":"NY","STATE":"36"}],
+				"119th Congressional Districts":[{"CDSESSN":"119","CDTYP":"","CD119":"12","BASENAME":"12","STATE":"36"}]
+			}}]}}`))
+	}))
+	defer srv.Close()
+
+	g := censusGeocoder{BaseURL: srv.URL}
+	d, zip, err := g.Geocode(context.Background(), "200 W 79th St, New York, NY")
+	if err != nil {
+		t.Fatalf("Geocode: %v", err)
+	}
+	if d != (District{"NY", 12}) || zip != "10024" {
+		t.Errorf("Geocode: got %v, %q; want NY-12, 10024", d, zip)
+	}
+	if _, _, err := g.Geocode(context.Background(), "1 Nowhere Ln"); err != ErrNoSuchAddress {
+		t.Errorf("Geocode of an unknown address: got %v, want ErrNoSuchAddress", err)
+	}
+}
+
+func TestInDistrict(t *testing.T) {
+	rs := []Rep{
+		{Name: "Sally Senior", State: "NY", District: "Senior Seat"},
+		{Name: "Harriet House", State: "NY", District: "12"},
+		{Name: "Henry Hall", State: "NY", District: "13"},
+	}
+	names := func(rs []Rep) []string {
+		var ns []string
+		for _, r := range rs {
+			ns = append(ns, r.Name)
+		}
+		return ns
+	}
+	if got, want := names(inDistrict(rs, District{})), names(rs); !reflect.DeepEqual(got, want) {
+		t.Errorf("inDistrict with no district: got %q, want %q", got, want)
+	}
+	if got, want := names(inDistrict(rs, District{"NY", 13})), []string{"Sally Senior", "Henry Hall"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("inDistrict(NY-13): got %q, want %q", got, want)
+	}
+}
+
+func TestSetAddress(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	directory = &fakeReps{reps: []Rep{
+		{Name: "Harriet House", State: "NY", District: "12", Link: "https://house.house.gov"},
+		{Name: "Henry Hall", State: "NY", District: "13", Link: "https://hall.house.gov"},
+	}}
+	a, err := loadAddressFile("testdata/addresses.csv")
+	if err != nil {
+		t.Fatalf("loadAddressFile: %v", err)
+	}
+	geocoder = a
+
+	u, err := InsertUser(ctx, userPhone, "10027-1234")
+	if err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	if text := defaultText(ctx, u); !strings.Contains(text, "ADDRESS") {
+		t.Errorf("defaultText for a ZIP with two districts doesn't suggest ADDRESS:\n%s", text)
+	}
+
+	if text := setAddress(ctx, u, "1 Nowhere Ln"); !strings.Contains(text, "couldn't find") {
+		t.Errorf("setAddress of an unknown address: got %q", text)
+	}
+
+	text := setAddress(ctx, u, "200 W 79th St, New York, NY 10024")
+	if !strings.Contains(text, "NY-12") || strings.Contains(text, "Henry Hall") || strings.Contains(text, "ADDRESS") {
+		t.Errorf("setAddress: got\n%s", text)
+	}
+	if u, err := store.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser: %v", err)
+	} else if u.District != (District{"NY", 12}) || u.ZipCode != "10024" {
+		t.Errorf("GetUser after setAddress: got %+v", u)
+	}
+}
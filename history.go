@@ -0,0 +1,201 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// History summarizes a user's calls.
+type History struct {
+	Recent    []Call // Newest first.
+	Completed int    // How many calls they've ever completed.
+	// Streak is how many of the user's calling days in a row they've
+	// completed a call on, up to their latest, or zero if they've missed
+	// one since. LongestStreak is the longest there's been. For weekly
+	// users, they count weeks.
+	Streak, LongestStreak int
+}
+
+// callHistory returns the user's n latest calls, or all of them if n <= 0,
+// and their streaks as of now.
+func callHistory(ctx context.Context, u User, n int, now time.Time) (*History, error) {
+	cs, err := store.UserCalls(ctx, u.PhoneNumber, 0)
+	if err != nil {
+		log.Errorf(ctx, "UserCalls(%s): %v", u.PhoneNumber, err)
+		return nil, err
+	}
+	h := &History{Recent: cs}
+	if n > 0 && len(cs) > n {
+		h.Recent = cs[:n]
+	}
+
+	// Find the days they completed calls on, oldest first, as midnight UTC
+	// so they can be compared.
+	loc := u.Location()
+	var days []time.Time
+	for i := len(cs) - 1; i >= 0; i-- {
+		if cs[i].Status != StateCompleted {
+			continue
+		}
+		h.Completed++
+		day := dateOf(cs[i].Created.In(loc))
+		if len(days) == 0 || !days[len(days)-1].Equal(day) {
+			days = append(days, day)
+		}
+	}
+	if len(days) == 0 {
+		return h, nil
+	}
+
+	sc := u.Schedule()
+	run := 0
+	for i, day := range days {
+		if i > 0 && sc.missedBetween(days[i-1], day) {
+			run = 0 // They missed a calling day.
+		}
+		run++
+		if run > h.LongestStreak {
+			h.LongestStreak = run
+		}
+	}
+	// Today isn't missed until it's over.
+	if !sc.missedBetween(days[len(days)-1], dateOf(now.In(loc))) {
+		h.Streak = run
+	}
+	return h, nil
+}
+
+// dateOf returns t's date, at midnight UTC.
+func dateOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// streakUnit is what the user's streaks count.
+func streakUnit(u User, n int) string {
+	unit := "day"
+	if u.Schedule().Weekly {
+		unit = "week"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return unit
+}
+
+// history replies to HISTORY, listing the user's latest calls and their
+// streaks.
+func history(ctx context.Context, r *request) (string, error) {
+	u := *r.User
+	h, err := callHistory(ctx, u, 5, time.Now())
+	if err != nil {
+		return "We couldn't look up your calls right now. Try again later.", nil
+	}
+	if len(h.Recent) == 0 {
+		return "You haven't made any calls yet. Your first is " + u.NextCallFormatted(), nil
+	}
+
+	msg := "Your latest calls:"
+	for _, c := range h.Recent {
+		rep := c.RepName
+		if rep == "" {
+			rep = c.To
+		}
+		msg += fmt.Sprintf("\n%s %s: %s", c.Created.In(u.Location()).Format("Mon 1/2"), rep, outcome(c))
+	}
+	msg += fmt.Sprintf("\nYou've completed %d calls.", h.Completed)
+	if h.LongestStreak > 0 {
+		msg += fmt.Sprintf(" Your streak is %d %s (longest: %d).", h.Streak, streakUnit(u, h.Streak), h.LongestStreak)
+	}
+	return msg, nil
+}
+
+// outcome describes how the call went.
+func outcome(c Call) string {
+	switch c.Status {
+	case StateNew:
+		return "coming up"
+	case StateSkipped:
+		return "skipped"
+	case StateLimited:
+		return "not placed"
+	case StateCanceled:
+		if c.RepLeg.State == "" && c.UserLeg.State == StateCompleted {
+			return "hung up before connecting"
+		}
+	case StateCompleted:
+		if c.RepLeg.Voicemail() {
+			return "voicemail"
+		}
+		if c.Duration > 0 {
+			return "completed, " + c.Duration.String()
+		}
+	}
+	if c.RepLeg.State == "" && c.UserLeg.State.Final() {
+		// It never got as far as the rep.
+		return "you didn't answer"
+	}
+	return strings.Replace(string(c.Status), "-", " ", -1) // e.g., "no answer"
+}
+
+var (
+	// Milestones are congratulated when a user's streak, or how many calls
+	// they've completed, reaches them.
+	streakMilestones    = []int{3, 5, 10, 20, 30, 50, 100, 200, 365}
+	completedMilestones = []int{1, 10, 25, 50, 100, 250, 500, 1000}
+)
+
+func isMilestone(n int, ms []int) bool {
+	for _, m := range ms {
+		if n == m {
+			return true
+		}
+	}
+	return false
+}
+
+// celebrate texts the user if the call they just completed reached a
+// milestone.
+func celebrate(ctx context.Context, c *Call) {
+	u, err := store.GetUser(ctx, c.From)
+	if err != nil {
+		log.Errorf(ctx, "GetUser(%s): %v", c.From, err)
+		return
+	}
+	h, err := callHistory(ctx, *u, 0, time.Now())
+	if err != nil {
+		return
+	}
+	if msg := milestoneText(*u, h, c); msg != "" {
+		if err := phone.SendSMS(ctx, u.PhoneNumber, msg); err != nil {
+			log.Errorf(ctx, "SendSMS: %v", err)
+		}
+	}
+}
+
+// milestoneText returns the message congratulating the user for reaching a
+// milestone with c, which they just completed, or "" if they didn't.
+func milestoneText(u User, h *History, c *Call) string {
+	switch {
+	case h.Completed == 1:
+		return "Congratulations on your first call! Keep it up, and you'll be heard."
+	case isMilestone(h.Completed, completedMilestones):
+		return fmt.Sprintf("Congratulations, that's %d calls to congress! Thank you for speaking up.", h.Completed)
+	}
+	// Only the first call completed on a day adds to the streak.
+	loc := u.Location()
+	day := dateOf(c.Created.In(loc))
+	for _, r := range h.Recent {
+		if r.Key != c.Key && r.Status == StateCompleted && dateOf(r.Created.In(loc)).Equal(day) {
+			return ""
+		}
+	}
+	if isMilestone(h.Streak, streakMilestones) {
+		return fmt.Sprintf("That's %d %s in a row you've called congress. Way to go!", h.Streak, streakUnit(u, h.Streak))
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// putCalls stores a call for each of the statuses, a day apart, ending at
+// last.
+func putCalls(t *testing.T, ctx context.Context, last time.Time, statuses ...CallState) []*Call {
+	var cs []*Call
+	for i, s := range statuses {
+		c := &Call{
+			Key:     randomString(),
+			From:    userPhone,
+			To:      "5550000",
+			RepName: "Sen. Jane Doe",
+			Created: last.AddDate(0, 0, i+1-len(statuses)),
+			Status:  s,
+		}
+		if err := store.PutCall(ctx, c); err != nil {
+			t.Fatalf("PutCall: %v", err)
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+func TestCallHistory(t *testing.T) {
+	ctx := context.Background()
+	ny, _ := time.LoadLocation("America/New_York")
+	u := User{PhoneNumber: userPhone, ZipCode: "10024"}
+	// Wednesday, March 1 to Friday, March 10, 2017.
+	day := func(d int) time.Time { return time.Date(2017, 3, d, 13, 0, 0, 0, ny) }
+
+	for _, c := range []struct {
+		desc                     string
+		days                     string
+		statuses                 []CallState // One a day, ending on March 10.
+		now                      time.Time
+		completed, streak, worst int
+	}{
+		{"none", "", nil, day(10), 0, 0, 0},
+		// The weekend doesn't break the streak.
+		{"weekdays", "", []CallState{"completed", "completed", "completed", "", "", "completed", "completed", "completed", "completed", "completed"}, day(10), 8, 8, 8},
+		{"missed a day", "", []CallState{"completed", "completed", "no-answer", "", "", "completed", "completed"}, day(10), 4, 2, 2},
+		{"today's not over", "", []CallState{"completed", "completed"}, day(13), 2, 2, 2},
+		{"broken", "", []CallState{"completed", "completed"}, day(14), 2, 0, 2},
+		{"daily", "DAILY", []CallState{"completed", "completed", "", "completed"}, day(10), 3, 1, 2},
+		{"MWF", "MWF", []CallState{"completed", "", "completed", "", "completed"}, day(10), 3, 3, 3},
+	} {
+		store = newMemStore()
+		var statuses []CallState
+		for _, s := range c.statuses {
+			if s != "" {
+				statuses = append(statuses, s)
+			}
+		}
+		// Put calls only on the days that have them.
+		for i, s := range c.statuses {
+			if s != "" {
+				putCalls(t, ctx, day(10).AddDate(0, 0, i+1-len(c.statuses)), s)
+			}
+		}
+		u.Days = c.days
+		h, err := callHistory(ctx, u, 3, c.now)
+		if err != nil {
+			t.Fatalf("%s: callHistory: %v", c.desc, err)
+		}
+		if h.Completed != c.completed || h.Streak != c.streak || h.LongestStreak != c.worst {
+			t.Errorf("%s: callHistory: got %d completed, streak %d, longest %d; want %d, %d, %d",
+				c.desc, h.Completed, h.Streak, h.LongestStreak, c.completed, c.streak, c.worst)
+		}
+		if want := len(statuses); want > 3 && len(h.Recent) != 3 || want <= 3 && len(h.Recent) != want {
+			t.Errorf("%s: callHistory: got %d recent calls, want up to 3 of %d", c.desc, len(h.Recent), want)
+		}
+	}
+}
+
+func TestWeeklyStreakAfterHoliday(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(c *Calendar) { calendar = c }(calendar)
+	ny, _ := time.LoadLocation("America/New_York")
+	day := func(d int) time.Time { return time.Date(2017, 3, d, 13, 0, 0, 0, ny) }
+	// The call after Wednesday, March 1 moves from the 8th to the 9th.
+	wed := time.Date(2017, 3, 8, 0, 0, 0, 0, time.UTC)
+	calendar = &Calendar{Skip: []CalendarDay{{Name: "Recess", from: wed, to: wed}}}
+	u := User{PhoneNumber: userPhone, ZipCode: "10024", Days: "WEEKLY"}
+
+	putCalls(t, ctx, day(1), StateCompleted)
+	putCalls(t, ctx, day(9), StateCompleted)
+	for _, c := range []struct {
+		now    time.Time
+		streak int
+	}{
+		{day(10), 2},
+		{day(16), 2}, // Today's not over.
+		{day(17), 0},
+	} {
+		h, err := callHistory(ctx, u, 0, c.now)
+		if err != nil {
+			t.Fatalf("callHistory: %v", err)
+		}
+		if h.Streak != c.streak || h.LongestStreak != 2 {
+			t.Errorf("callHistory at %v: got streak %d, longest %d; want %d, 2", c.now, h.Streak, h.LongestStreak, c.streak)
+		}
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	u, err := InsertUser(ctx, userPhone, "10024")
+	if err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	got, err := runCommand(ctx, userPhone, u, "HISTORY")
+	if err != nil || !strings.Contains(got, "You haven't made any calls yet") {
+		t.Errorf("HISTORY with no calls: got %q, %v", got, err)
+	}
+
+	cs := putCalls(t, ctx, time.Now(), "completed", "no-answer", "completed")
+	cs[2].Duration = 90 * time.Second
+	store.PutCall(ctx, cs[2])
+	got, err = runCommand(ctx, userPhone, u, "history")
+	if err != nil {
+		t.Fatalf("HISTORY: %v", err)
+	}
+	for _, want := range []string{"Sen. Jane Doe: completed, 1m30s", "Sen. Jane Doe: no answer", "You've completed 2 calls."} {
+		if !strings.Contains(got, want) {
+			t.Errorf("HISTORY: got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestCelebrate(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(p Telephony) { phone = p }(phone)
+	fp := &fakePhone{}
+	phone = fp
+	if _, err := InsertUser(ctx, userPhone, "10024"); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+
+	rep := Rep{Name: "Jane Doe", Offices: []Office{{Phone: "5550000"}}, Link: "https://www.senate.gov"}
+	c, err := InsertCall(ctx, userPhone, rep, rep.mainOffice())
+	if err != nil {
+		t.Fatalf("InsertCall: %v", err)
+	}
+	if err := store.SetSID(ctx, userPhone, c.Key, "CA123"); err != nil {
+		t.Fatalf("SetSID: %v", err)
+	}
+	for _, status := range []CallState{StateInProgress, StateCompleted, StateCompleted} {
+		if err := UpdateCallBySID(ctx, "CA123", LegStatus{Leg: LegRep, State: status, Duration: time.Minute}); err != nil {
+			t.Fatalf("UpdateCallBySID(%s): %v", status, err)
+		}
+	}
+	// Nothing's sent until they've hung up, too.
+	if len(fp.texts) != 0 {
+		t.Errorf("Sent texts before the call was over: %q", fp.texts)
+	}
+	if err := UpdateCallBySID(ctx, "CA123", LegStatus{Leg: LegUser, State: StateCompleted}); err != nil {
+		t.Fatalf("UpdateCallBySID: %v", err)
+	}
+	if len(fp.texts) != 1 || !strings.Contains(fp.texts[0], "first call") {
+		t.Errorf("Sent texts: got %q, want one congratulating the first call", fp.texts)
+	}
+	if c, err := store.GetCall(ctx, userPhone, c.Key); err != nil {
+		t.Errorf("GetCall: %v", err)
+	} else if c.RepName != "Sen. Jane Doe" {
+		t.Errorf("Call.RepName: got %q, want %q", c.RepName, "Sen. Jane Doe")
+	}
+}
+
+func TestMilestoneText(t *testing.T) {
+	u := User{ZipCode: "10024"}
+	now := time.Now()
+	c := &Call{Key: "today", Created: now, Status: StateCompleted}
+	for _, tc := range []struct {
+		desc string
+		h    History
+		want string
+	}{
+		{"first", History{Completed: 1, Streak: 1, Recent: []Call{*c}}, "first call"},
+		{"total", History{Completed: 25, Streak: 2, Recent: []Call{*c}}, "25 calls"},
+		{"streak", History{Completed: 7, Streak: 5, Recent: []Call{*c}}, "5 days in a row"},
+		{"nothing", History{Completed: 7, Streak: 4, Recent: []Call{*c}}, ""},
+		{"second today", History{Completed: 7, Streak: 5, Recent: []Call{*c, {Key: "earlier", Created: now, Status: StateCompleted}}}, ""},
+	} {
+		got := milestoneText(u, &tc.h, c)
+		if (tc.want == "") != (got == "") || !strings.Contains(got, tc.want) {
+			t.Errorf("%s: milestoneText: got %q, want %q", tc.desc, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+)
+
+// spokenTips are tips, for reading aloud.
+const spokenTips = "Here are some tips for calling. Have your talking points in front of you. Mention your zip code, so they know you're a constituent. Be nice; the person you're talking to has a hard job. And call every day, so they remember you."
+
+var zipDigitsRE = regexp.MustCompile(`^[0-9]{5}$`)
+
+// incomingCall answers calls to our number. Users hear a menu; anyone else
+// can join by entering their ZIP code.
+func incomingCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof(ctx, "PostForm: %s", in.Params)
+
+	u, err := store.GetUser(ctx, in.From)
+	if isNotUser(err) {
+		u = nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if u == nil || u.IsStopped() {
+		g := NewGather(cfg.Host+"/incomingcall/zip",
+			NewSay("Hello, thank you for calling Make Me Call. To get calls to your members of congress, enter your five digit zip code."))
+		g.NumDigits = 5
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{
+			g,
+			NewSay("You can also text JOIN and your zip code to this number. Goodbye!"),
+			Hangup{},
+		}})
+		return
+	}
+	phone.Respond(ctx, w, &Response{Verbs: []Verb{
+		NewGather(cfg.Host+"/incomingcall/menu",
+			NewSay(fmt.Sprintf("Hello! Your next call is %s.", u.NextCallFormatted())),
+			Pause{},
+			NewSay("To call your member of congress now, press 1. To skip your next call, press 2. To hear tips for calling, press 3."),
+		),
+		NewSay("Goodbye!"),
+		Hangup{},
+	}})
+}
+
+// callMenu handles the key a user pressed in incomingCall's menu.
+func callMenu(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := store.GetUser(ctx, in.From)
+	if err != nil || u.IsStopped() {
+		// Start over, with the menu for people who haven't joined.
+		log.Warningf(ctx, "Menu for %s, who isn't a user: %v", in.From, err)
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{Redirect{URL: cfg.Host + "/incomingcall", Method: "POST"}}})
+		return
+	}
+	log.Infof(ctx, "%s pressed %q", in.From, in.Digits)
+	req := &request{From: in.From, User: u, Source: "voice"}
+
+	var vs []Verb
+	switch in.Digits {
+	case "1":
+		req.Name = "NOW"
+		text, err := callNow(ctx, req)
+		if err != nil {
+			log.Errorf(ctx, "callNow: %v", err)
+		}
+		if text == "" {
+			text = fmt.Sprintf("OK! Hang up, and we'll call you back %s.", callBackIn(cfg.CallDelay))
+		}
+		vs = []Verb{NewSay(text), Hangup{}}
+	case "2":
+		req.Name = "SKIP"
+		text, err := skip(ctx, req)
+		if err != nil {
+			log.Errorf(ctx, "skip: %v", err)
+		}
+		if text == "" {
+			text = "You don't have a call coming up to skip."
+		} else {
+			text = "OK, we've skipped it. " + text + "."
+		}
+		vs = []Verb{NewSay(text), Pause{}, Redirect{URL: cfg.Host + "/incomingcall", Method: "POST"}}
+	case "3":
+		vs = []Verb{NewSay(spokenTips), Pause{}, Redirect{URL: cfg.Host + "/incomingcall", Method: "POST"}}
+	default:
+		vs = []Verb{NewSay("Sorry, I didn't get that."), Redirect{URL: cfg.Host + "/incomingcall", Method: "POST"}}
+	}
+	phone.Respond(ctx, w, &Response{Verbs: vs})
+}
+
+// callBackIn describes when a call after the delay will come, e.g., "in
+// about 5 minutes".
+func callBackIn(d time.Duration) string {
+	switch m := int(d / time.Minute); {
+	case m < 1:
+		return "in a moment"
+	case m == 1:
+		return "in about a minute"
+	default:
+		return fmt.Sprintf("in about %d minutes", m)
+	}
+}
+
+// callJoin handles the ZIP code a caller entered in incomingCall, joining
+// them, or welcoming them back, as if they'd texted JOIN.
+func callJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !zipDigitsRE.MatchString(in.Digits) {
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{
+			NewSay("Sorry, that isn't a zip code."),
+			Redirect{URL: cfg.Host + "/incomingcall", Method: "POST"},
+		}})
+		return
+	}
+	u, err := store.GetUser(ctx, in.From)
+	if isNotUser(err) {
+		u = nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	text, err := join(ctx, &request{From: in.From, User: u, Name: "JOIN", Arg: in.Digits, Source: "voice"})
+	if err != nil {
+		// Nothing's happened yet, so the caller can try again.
+		log.Errorf(ctx, "join: %v", err)
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{
+			NewSay("Sorry, something went wrong. Please try again later, or text JOIN and your zip code to this number."),
+			Hangup{},
+		}})
+		return
+	}
+	// They need to know how to STOP, and texts are how they'll hear from us.
+	if err := phone.SendSMS(ctx, in.From, text); err != nil {
+		log.Errorf(ctx, "SendSMS: %v", err)
+	}
+	say := "Thank you, you've joined! We've texted you the details."
+	if u != nil {
+		say = "Welcome back! We've texted you the details."
+	}
+	if u, err := store.GetUser(ctx, in.From); err == nil {
+		say += fmt.Sprintf(" Your next call is %s.", u.NextCallFormatted())
+	}
+	phone.Respond(ctx, w, &Response{Verbs: []Verb{NewSay(say + " Goodbye!"), Hangup{}}})
+}
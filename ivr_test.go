@@ -0,0 +1,80 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestIncomingCall(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(c Config, d RepProvider, p Telephony) { cfg, directory, phone = c, d, p }(cfg, directory, phone)
+	cfg.Host = "https://example.com"
+	directory = &fakeReps{reps: []Rep{senator, houseRep}}
+	fp := &fakePhone{}
+	phone = fp
+	from := url.Values{"From": {userPhone}}
+	press := func(digits string) url.Values {
+		return url.Values{"From": {userPhone}, "Digits": {digits}}
+	}
+
+	for _, c := range []struct {
+		h      func(w http.ResponseWriter, r *http.Request)
+		path   string
+		params url.Values
+		want   string
+	}{
+		// Strangers can join by entering their ZIP code.
+		{incomingCall, "/incomingcall", from, `numDigits="5" timeout="10" action="https://example.com/incomingcall/zip"`},
+		{callMenu, "/incomingcall/menu", press("1"), "<Redirect method=\"POST\">https://example.com/incomingcall</Redirect>"},
+		{callJoin, "/incomingcall/zip", press("123"), "Sorry, that isn&#39;t a zip code."},
+		{callJoin, "/incomingcall/zip", press(zip), "Thank you, you&#39;ve joined! We&#39;ve texted you the details. Your next call is"},
+
+		// Users get the menu.
+		{incomingCall, "/incomingcall", from, "Hello! Your next call is"},
+		{incomingCall, "/incomingcall", from, `action="https://example.com/incomingcall/menu"`},
+		{callMenu, "/incomingcall/menu", press("2"), "You don&#39;t have a call coming up to skip."},
+		{callMenu, "/incomingcall/menu", press("3"), "Here are some tips for calling."},
+		{callMenu, "/incomingcall/menu", press("9"), "Sorry, I didn&#39;t get that."},
+		{callMenu, "/incomingcall/menu", press("1"), "OK! Hang up, and we&#39;ll call you back in about 5 minutes."},
+	} {
+		if got := postWebhook(c.h, c.path, c.params); !strings.Contains(got, c.want) {
+			t.Errorf("%s %s: got %s, want it to contain %s", c.path, c.params.Encode(), got, c.want)
+		}
+	}
+
+	if len(fp.texts) != 1 || !strings.Contains(fp.texts[0], "Thank you, you have joined!") {
+		t.Errorf("Texts after joining: got %q", fp.texts)
+	}
+	if e, err := store.LatestConsent(ctx, userPhone); err != nil {
+		t.Errorf("LatestConsent: %v", err)
+	} else if !e.OptIn || e.Source != "voice" {
+		t.Errorf("Consent after joining: got %+v, want opted in by voice", e)
+	}
+	if js, err := s.ClaimJobs(ctx, time.Now(), time.Minute, 10); err != nil {
+		t.Errorf("ClaimJobs: %v", err)
+	} else if len(js) != 1 || js[0].Name != "call" {
+		t.Errorf("Jobs after pressing 1: got %+v, want a call", js)
+	}
+}
+
+func TestCallBackIn(t *testing.T) {
+	for _, c := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "in a moment"},
+		{time.Minute, "in about a minute"},
+		{5 * time.Minute, "in about 5 minutes"},
+	} {
+		if got := callBackIn(c.d); got != c.want {
+			t.Errorf("callBackIn(%s): got %q, want %q", c.d, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// legislatorDataset is a RepProvider that answers from local files, so
+// lookups work offline and always give the same answer:
+//
+//   - legislators-current.yaml from
+//     https://github.com/unitedstates/congress-legislators
+//   - optionally, legislators-district-offices.yaml from the same place
+//   - a CSV mapping ZIP codes to congressional districts, with a header row
+//     naming zcta (or zip), state_abbr (or state) and cd (or district)
+//     columns, like zccd.csv from
+//     https://github.com/OpenSourceActivismTech/us-zipcodes-congress
+//
+// A ZIP code that spans several districts gets all of their reps.
+type legislatorDataset struct {
+	senators  map[string][]Rep      // state -> senators
+	house     map[District]Rep      // district -> rep
+	districts map[string][]District // ZIP -> districts
+}
+
+// legislator is an entry in legislators-current.yaml; only the fields we
+// need are listed.
+type legislator struct {
+	ID struct {
+		Bioguide string `yaml:"bioguide"`
+	} `yaml:"id"`
+	Name struct {
+		First        string `yaml:"first"`
+		Last         string `yaml:"last"`
+		OfficialFull string `yaml:"official_full"`
+	} `yaml:"name"`
+	Terms []struct {
+		Type      string `yaml:"type"` // "rep" or "sen"
+		State     string `yaml:"state"`
+		District  int    `yaml:"district"`
+		Party     string `yaml:"party"`
+		URL       string `yaml:"url"`
+		Phone     string `yaml:"phone"`
+		Address   string `yaml:"address"`
+		StateRank string `yaml:"state_rank"` // "senior" or "junior"
+	} `yaml:"terms"`
+}
+
+// legislatorOffices is an entry in legislators-district-offices.yaml.
+type legislatorOffices struct {
+	ID struct {
+		Bioguide string `yaml:"bioguide"`
+	} `yaml:"id"`
+	Offices []struct {
+		Address string `yaml:"address"`
+		Suite   string `yaml:"suite"`
+		City    string `yaml:"city"`
+		State   string `yaml:"state"`
+		Zip     string `yaml:"zip"`
+		Phone   string `yaml:"phone"`
+		Hours   string `yaml:"hours"` // Free text, like "M-F 9AM-5PM".
+	} `yaml:"offices"`
+}
+
+// parseOfficeHours parses an office's hours from legislators-district-
+// offices.yaml, like "M-F 9AM-5PM" or "Monday - Friday 9:00 a.m. - 6:00 p.m.
+// ET". Days are ignored. It's false for hours it can't make sense of, like
+// "9:30-5:30" or "Mon-Thu 9-5, Fri 9-3", which are left as the default.
+func parseOfficeHours(s string) (OfficeHours, bool) {
+	i := strings.IndexAny(s, "0123456789")
+	if i < 0 {
+		return OfficeHours{}, false
+	}
+	start, end, zone, err := parseTimeRange(strings.Replace(s[i:], ".", "", -1))
+	if err != nil {
+		return OfficeHours{}, false
+	}
+	return OfficeHours{Start: start, End: end, TimeZone: zone}, true
+}
+
+// loadLegislatorDataset reads the files at the paths. officesPath may be
+// empty, leaving reps with just their Washington offices.
+func loadLegislatorDataset(legislatorsPath, zipsPath, officesPath string) (*legislatorDataset, error) {
+	lf, err := os.Open(legislatorsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+	zf, err := os.Open(zipsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zf.Close()
+	var of io.Reader
+	if officesPath != "" {
+		f, err := os.Open(officesPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		of = f
+	}
+	return readLegislatorDataset(lf, zf, of)
+}
+
+// readLegislatorDataset reads the dataset. offices may be nil.
+func readLegislatorDataset(legislators, zips, offices io.Reader) (*legislatorDataset, error) {
+	d := &legislatorDataset{
+		senators:  map[string][]Rep{},
+		house:     map[District]Rep{},
+		districts: map[string][]District{},
+	}
+
+	b, err := ioutil.ReadAll(legislators)
+	if err != nil {
+		return nil, err
+	}
+	var ls []legislator
+	if err := yaml.Unmarshal(b, &ls); err != nil {
+		return nil, fmt.Errorf("legislators: %v", err)
+	}
+	districtOffices := map[string][]Office{} // bioguide ID -> offices
+	if offices != nil {
+		b, err := ioutil.ReadAll(offices)
+		if err != nil {
+			return nil, err
+		}
+		var los []legislatorOffices
+		if err := yaml.Unmarshal(b, &los); err != nil {
+			return nil, fmt.Errorf("district offices: %v", err)
+		}
+		for _, lo := range los {
+			for _, o := range lo.Offices {
+				if o.Phone == "" {
+					continue
+				}
+				var addr []string
+				for _, a := range []string{o.Address, o.Suite, o.City, strings.TrimSpace(o.State + " " + o.Zip)} {
+					if a != "" {
+						addr = append(addr, a)
+					}
+				}
+				off := Office{
+					Name:     o.City,
+					Phone:    o.Phone,
+					Address:  strings.Join(addr, ", "),
+					TimeZone: zipTimeZone(o.Zip),
+				}
+				if h, ok := parseOfficeHours(o.Hours); ok {
+					if h.TimeZone != "" {
+						off.TimeZone = h.TimeZone
+					}
+					off.Hours = OfficeHours{Start: h.Start, End: h.End}
+				}
+				districtOffices[lo.ID.Bioguide] = append(districtOffices[lo.ID.Bioguide], off)
+			}
+		}
+	}
+	for _, l := range ls {
+		if len(l.Terms) == 0 {
+			continue
+		}
+		t := l.Terms[len(l.Terms)-1] // The current term is last.
+		name := l.Name.OfficialFull
+		if name == "" {
+			name = l.Name.First + " " + l.Name.Last
+		}
+		dc := Office{Name: dcOffice, Phone: t.Phone, Address: t.Address, TimeZone: capitolHours.TimeZone}
+		r := Rep{
+			Name:    name,
+			Offices: append([]Office{dc}, districtOffices[l.ID.Bioguide]...),
+			Party:   t.Party,
+			State:   t.State,
+			Link:    t.URL,
+		}
+		switch t.Type {
+		case "sen":
+			if r.Link == "" {
+				r.Link = "https://www.senate.gov"
+			}
+			r.District = strings.Title(t.StateRank) + " Seat"
+			d.senators[t.State] = append(d.senators[t.State], r)
+		case "rep":
+			if r.Link == "" {
+				r.Link = "https://www.house.gov"
+			}
+			r.District = strconv.Itoa(t.District)
+			d.house[District{t.State, t.District}] = r
+		}
+	}
+	for _, ss := range d.senators {
+		sort.Slice(ss, func(i, j int) bool { return ss[i].District > ss[j].District }) // Senior first.
+	}
+
+	cr := csv.NewReader(zips)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("zip districts: %v", err)
+	}
+	col := func(names ...string) int {
+		for i, h := range header {
+			for _, n := range names {
+				if strings.TrimSpace(strings.ToLower(h)) == n {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	zipCol, stateCol, cdCol := col("zcta", "zip"), col("state_abbr", "state"), col("cd", "district")
+	if zipCol < 0 || stateCol < 0 || cdCol < 0 {
+		return nil, fmt.Errorf("zip districts: header %q lacks zip, state or district columns", header)
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("zip districts: %v", err)
+		}
+		cd, err := strconv.Atoi(rec[cdCol])
+		if err != nil {
+			return nil, fmt.Errorf("zip districts: bad district %q for %s", rec[cdCol], rec[zipCol])
+		}
+		zip := rec[zipCol]
+		d.districts[zip] = append(d.districts[zip], District{rec[stateCol], cd})
+	}
+	return d, nil
+}
+
+func (d *legislatorDataset) LookupReps(ctx context.Context, zip string) ([]Rep, error) {
+	if len(zip) > 5 {
+		zip = zip[:5] // Drop any +4.
+	}
+	var rs []Rep
+	seen := map[string]bool{}
+	for _, dist := range d.districts[zip] {
+		if !seen[dist.State] {
+			seen[dist.State] = true
+			rs = append(rs, d.senators[dist.State]...)
+		}
+	}
+	for _, dist := range d.districts[zip] {
+		if r, found := d.house[dist]; found {
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
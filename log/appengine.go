@@ -0,0 +1,24 @@
+//go:build appengine
+// +build appengine
+
+package log
+
+import (
+	"golang.org/x/net/context"
+	aelog "google.golang.org/appengine/log"
+)
+
+func logf(ctx context.Context, level, format string, args ...interface{}) {
+	switch level {
+	case "DEBUG":
+		aelog.Debugf(ctx, format, args...)
+	case "INFO":
+		aelog.Infof(ctx, format, args...)
+	case "WARNING":
+		aelog.Warningf(ctx, format, args...)
+	case "ERROR":
+		aelog.Errorf(ctx, format, args...)
+	default:
+		aelog.Criticalf(ctx, format, args...)
+	}
+}
@@ -0,0 +1,33 @@
+// Package log provides leveled logging that goes to App Engine's request logs
+// when running on App Engine, and to the standard logger everywhere else.
+//
+// Its API matches google.golang.org/appengine/log.
+package log
+
+import "golang.org/x/net/context"
+
+// Debugf formats its arguments according to the format, analogous to fmt.Printf,
+// and records the text as a log message at Debug level.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, "DEBUG", format, args...)
+}
+
+// Infof is like Debugf, but at Info level.
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, "INFO", format, args...)
+}
+
+// Warningf is like Debugf, but at Warning level.
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, "WARNING", format, args...)
+}
+
+// Errorf is like Debugf, but at Error level.
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, "ERROR", format, args...)
+}
+
+// Criticalf is like Debugf, but at Critical level.
+func Criticalf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, "CRITICAL", format, args...)
+}
@@ -0,0 +1,14 @@
+//go:build !appengine
+// +build !appengine
+
+package log
+
+import (
+	stdlog "log"
+
+	"golang.org/x/net/context"
+)
+
+func logf(ctx context.Context, level, format string, args ...interface{}) {
+	stdlog.Printf(level+" "+format, args...)
+}
@@ -0,0 +1,406 @@
+package app
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// memStore is a Store that keeps everything in memory, for tests and trying
+// things out. Everything is lost when the process exits.
+type memStore struct {
+	mu    sync.Mutex
+	users map[string]User
+	calls map[string]map[string]Call // user -> key -> Call
+	sids  map[string]callRef         // SID -> Call
+	jobs  map[string]Job
+	reps  map[string]CachedReps // ZIP -> reps
+
+	consent map[string][]ConsentEvent // number -> events, oldest first
+	buckets map[string]Bucket
+	stats   map[string]OfficeStats
+	attend  map[string]map[string]Attendee // event -> number -> Attendee
+}
+
+type callRef struct{ user, key string }
+
+func newMemStore() *memStore {
+	return &memStore{
+		users: map[string]User{},
+		calls: map[string]map[string]Call{},
+		sids:  map[string]callRef{},
+		jobs:  map[string]Job{},
+		reps:  map[string]CachedReps{},
+
+		consent: map[string][]ConsentEvent{},
+		buckets: map[string]Bucket{},
+		stats:   map[string]OfficeStats{},
+		attend:  map[string]map[string]Attendee{},
+	}
+}
+
+///////////
+// USERS //
+///////////
+
+func (s *memStore) GetUser(ctx context.Context, n string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, found := s.users[n]
+	if !found {
+		return nil, ErrNoSuchUser
+	}
+	return &u, nil
+}
+
+func (s *memStore) PutUser(ctx context.Context, u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.PhoneNumber] = *u
+	return nil
+}
+
+func (s *memStore) UpdateUser(ctx context.Context, n string, f func(*User) error) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, found := s.users[n]
+	if !found {
+		return nil, ErrNoSuchUser
+	}
+	if err := f(&u); err != nil {
+		return nil, err
+	}
+	s.users[n] = u
+	return &u, nil
+}
+
+func (s *memStore) DeleteUser(ctx context.Context, n string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, n)
+	return nil
+}
+
+func (s *memStore) CallableUsers(ctx context.Context, now time.Time) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var us []User
+	for _, u := range s.users {
+		if u.NextCall.Before(now) && !u.IsStopped() {
+			us = append(us, u)
+		}
+	}
+	sort.Slice(us, func(i, j int) bool { return us[i].NextCall.After(us[j].NextCall) })
+	if len(us) > 100 {
+		us = us[:100]
+	}
+	return us, nil
+}
+
+func (s *memStore) ActiveUsers(ctx context.Context) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var us []User
+	for _, u := range s.users {
+		if !u.IsStopped() {
+			us = append(us, u)
+		}
+	}
+	return us, nil
+}
+
+///////////
+// CALLS //
+///////////
+
+func (s *memStore) PutCall(ctx context.Context, c *Call) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putCall(*c)
+	return nil
+}
+
+// putCall must be called with s.mu held.
+func (s *memStore) putCall(c Call) {
+	if s.calls[c.From] == nil {
+		s.calls[c.From] = map[string]Call{}
+	}
+	s.calls[c.From][c.Key] = c
+	if c.Sid != "" {
+		s.sids[c.Sid] = callRef{c.From, c.Key}
+	}
+}
+
+func (s *memStore) GetCall(ctx context.Context, user, key string) (*Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, found := s.calls[user][key]
+	if !found {
+		return nil, ErrNoSuchCall
+	}
+	return &c, nil
+}
+
+func (s *memStore) LatestCall(ctx context.Context, user string) (*Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest *Call
+	for _, c := range s.calls[user] {
+		if latest == nil || c.Created.After(latest.Created) {
+			c := c
+			latest = &c
+		}
+	}
+	if latest == nil {
+		return nil, ErrNoSuchCall
+	}
+	return latest, nil
+}
+
+func (s *memStore) UserCalls(ctx context.Context, user string, n int) ([]Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cs []Call
+	for _, c := range s.calls[user] {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Created.After(cs[j].Created) })
+	if n > 0 && len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs, nil
+}
+
+func (s *memStore) CallsSince(ctx context.Context, since time.Time) ([]Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cs []Call
+	for _, byKey := range s.calls {
+		for _, c := range byKey {
+			if !c.Created.Before(since) {
+				cs = append(cs, c)
+			}
+		}
+	}
+	return cs, nil
+}
+
+func (s *memStore) UpdateCall(ctx context.Context, user, key string, f func(*Call) error) (*Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, found := s.calls[user][key]
+	if !found {
+		return nil, ErrNoSuchCall
+	}
+	if err := f(&c); err != nil {
+		return nil, err
+	}
+	s.putCall(c)
+	return &c, nil
+}
+
+func (s *memStore) SetSID(ctx context.Context, user, key, sid string) error {
+	_, err := s.UpdateCall(ctx, user, key, func(c *Call) error {
+		c.Sid = sid
+		return nil
+	})
+	return err
+}
+
+func (s *memStore) CallBySID(ctx context.Context, sid string) (*Call, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, found := s.sids[sid]
+	if !found {
+		return nil, ErrNoSuchCall
+	}
+	c := s.calls[ref.user][ref.key]
+	return &c, nil
+}
+
+/////////////
+// CONSENT //
+/////////////
+
+func (s *memStore) AddConsent(ctx context.Context, e *ConsentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consent[e.PhoneNumber] = append(s.consent[e.PhoneNumber], *e)
+	return nil
+}
+
+func (s *memStore) LatestConsent(ctx context.Context, n string) (*ConsentEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	es := s.consent[n]
+	if len(es) == 0 {
+		return nil, ErrNoConsent
+	}
+	e := es[len(es)-1]
+	return &e, nil
+}
+
+/////////////////
+// RATE LIMITS //
+/////////////////
+
+func (s *memStore) UpdateBucket(ctx context.Context, key string, f func(*Bucket) error) (*Bucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, found := s.buckets[key]
+	if !found {
+		b = Bucket{Key: key}
+	}
+	if err := f(&b); err != nil {
+		return nil, err
+	}
+	s.buckets[key] = b
+	return &b, nil
+}
+
+///////////////
+// ANALYTICS //
+///////////////
+
+func (s *memStore) PutOfficeStats(ctx context.Context, st *OfficeStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[st.Phone] = *st
+	return nil
+}
+
+func (s *memStore) GetOfficeStats(ctx context.Context, phone string) (*OfficeStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, found := s.stats[phone]
+	if !found {
+		return nil, ErrNoStats
+	}
+	return &st, nil
+}
+
+func (s *memStore) AllOfficeStats(ctx context.Context) ([]OfficeStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ss []OfficeStats
+	for _, st := range s.stats {
+		ss = append(ss, st)
+	}
+	return ss, nil
+}
+
+////////////
+// EVENTS //
+////////////
+
+func (s *memStore) UpdateAttendee(ctx context.Context, event, n string, f func(*Attendee) error) (*Attendee, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, found := s.attend[event][n]
+	if !found {
+		a = Attendee{Event: event, PhoneNumber: n}
+	}
+	if err := f(&a); err != nil {
+		return nil, err
+	}
+	if s.attend[event] == nil {
+		s.attend[event] = map[string]Attendee{}
+	}
+	s.attend[event][n] = a
+	return &a, nil
+}
+
+func (s *memStore) Attendees(ctx context.Context, event string) ([]Attendee, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var as []Attendee
+	for _, a := range s.attend[event] {
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+//////////
+// JOBS //
+//////////
+
+func (s *memStore) PutJob(ctx context.Context, j *Job) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.jobs[j.Key]; found {
+		return false, nil
+	}
+	s.jobs[j.Key] = *j
+	return true, nil
+}
+
+func (s *memStore) GetJob(ctx context.Context, key string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, found := s.jobs[key]
+	if !found {
+		return nil, ErrNoSuchJob
+	}
+	return &j, nil
+}
+
+func (s *memStore) UpdateJob(ctx context.Context, j *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[j.Key] = *j
+	return nil
+}
+
+func (s *memStore) ClaimJobs(ctx context.Context, now time.Time, lease time.Duration, n int) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var js []Job
+	for _, j := range s.jobs {
+		if j.Done.IsZero() && !j.RunAt.After(now) {
+			js = append(js, j)
+		}
+	}
+	sort.Slice(js, func(i, j int) bool { return js[i].RunAt.Before(js[j].RunAt) })
+	if len(js) > n {
+		js = js[:n]
+	}
+	for _, j := range js {
+		j.RunAt = now.Add(lease)
+		s.jobs[j.Key] = j
+	}
+	return js, nil
+}
+
+func (s *memStore) DeleteJobs(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, j := range s.jobs {
+		if !j.Done.IsZero() && j.Done.Before(before) {
+			delete(s.jobs, k)
+		}
+	}
+	return nil
+}
+
+//////////
+// REPS //
+//////////
+
+func (s *memStore) GetCachedReps(ctx context.Context, zip string) (*CachedReps, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, found := s.reps[zip]
+	if !found {
+		return nil, ErrNotCached
+	}
+	return &c, nil
+}
+
+func (s *memStore) PutCachedReps(ctx context.Context, c *CachedReps) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reps[c.Zip] = *c
+	return nil
+}
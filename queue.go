@@ -0,0 +1,260 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// Job is a unit of work to run in the background, by the handler registered
+// in jobHandlers under its Name.
+type Job struct {
+	// Key identifies the job. Enqueuing a job with the same key as another,
+	// even one that's finished, does nothing.
+	Key  string
+	Name string
+	Args []byte // JSON-encoded, passed to the handler.
+
+	RunAt       time.Time // When to run next.
+	Attempts    int       // How many times it has run and failed.
+	MaxAttempts int       // Give up after this many failures.
+	LastError   string
+
+	Done     time.Time // When it succeeded, gave up, or was canceled; zero while pending.
+	Canceled bool
+}
+
+// Queue runs jobs in the background.
+//
+// Implementations are App Engine task queues (appengine.go) and localQueue,
+// selected by Config.Queue.
+type Queue interface {
+	// Enqueue schedules the job to run at j.RunAt, unless a job with the same
+	// key has already been enqueued.
+	Enqueue(ctx context.Context, j Job) error
+	// Cancel keeps the job with this key from running, if it hasn't yet.
+	Cancel(ctx context.Context, key string) error
+}
+
+// queue runs background jobs. It's set by Configure.
+var queue Queue
+
+// jobHandlers maps job names to the functions that run them. Handlers that
+// return an error are retried with backoff, so they must be idempotent.
+var jobHandlers = map[string]func(ctx context.Context, args []byte) error{}
+
+const defaultMaxAttempts = 5
+
+var ErrNoSuchJob = errors.New("no such job")
+
+// queues maps Config.Queue names to functions that open that kind of Queue.
+// Build-specific files add to it.
+var queues = map[string]func(Config) (Queue, error){
+	"local": func(Config) (Queue, error) {
+		js, ok := store.(JobStore)
+		if !ok {
+			return nil, fmt.Errorf("the local queue needs a store that can hold jobs, not %T", store)
+		}
+		return newLocalQueue(js), nil
+	},
+}
+
+func openQueue(c Config) (Queue, error) {
+	open, found := queues[c.Queue]
+	if !found {
+		names := []string{}
+		for n := range queues {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown queue %q; want one of %q", c.Queue, names)
+	}
+	return open(c)
+}
+
+// enqueue schedules the named job to run after delay, with args encoded as
+// JSON.
+func enqueue(ctx context.Context, name, key string, delay time.Duration, args interface{}) error {
+	b, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	return queue.Enqueue(ctx, Job{
+		Key:         key,
+		Name:        name,
+		Args:        b,
+		RunAt:       time.Now().Add(delay),
+		MaxAttempts: defaultMaxAttempts,
+	})
+}
+
+// runJob runs the handler for the named job.
+func runJob(ctx context.Context, name string, args []byte) error {
+	h, found := jobHandlers[name]
+	if !found {
+		return fmt.Errorf("no handler for job %q", name)
+	}
+	return h(ctx, args)
+}
+
+// backoff returns how long to wait before retrying a job that has failed
+// this many times: 30 seconds, doubling up to an hour.
+func backoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// JobStore is a Store that can also hold jobs for localQueue.
+type JobStore interface {
+	// PutJob stores the job unless one with the same key exists, in which
+	// case it returns false.
+	PutJob(ctx context.Context, j *Job) (bool, error)
+	// GetJob returns ErrNoSuchJob if there's no job with that key.
+	GetJob(ctx context.Context, key string) (*Job, error)
+	// UpdateJob replaces the job with the same key.
+	UpdateJob(ctx context.Context, j *Job) error
+	// ClaimJobs returns up to n pending jobs due by now, earliest first, and
+	// postpones each by lease, so that if whoever claimed them dies they'll
+	// be run again.
+	ClaimJobs(ctx context.Context, now time.Time, lease time.Duration, n int) ([]Job, error)
+	// DeleteJobs deletes jobs that were done before t.
+	DeleteJobs(ctx context.Context, before time.Time) error
+}
+
+// localQueue is a Queue that keeps jobs in a JobStore, so they survive
+// restarts, and runs them in this process.
+type localQueue struct {
+	js JobStore
+
+	poll      time.Duration // How often to look for due jobs.
+	lease     time.Duration // How long a job may run before it's retried.
+	retention time.Duration // How long to keep finished jobs' keys.
+	now       func() time.Time
+
+	wg sync.WaitGroup // Running jobs.
+}
+
+func newLocalQueue(js JobStore) *localQueue {
+	return &localQueue{
+		js:        js,
+		poll:      time.Second,
+		lease:     10 * time.Minute,
+		retention: 7 * 24 * time.Hour,
+		now:       time.Now,
+	}
+}
+
+func (q *localQueue) Enqueue(ctx context.Context, j Job) error {
+	if j.MaxAttempts == 0 {
+		j.MaxAttempts = defaultMaxAttempts
+	}
+	added, err := q.js.PutJob(ctx, &j)
+	if err != nil {
+		return err
+	}
+	if !added {
+		log.Infof(ctx, "Job %s was already enqueued", j.Key)
+	}
+	return nil
+}
+
+func (q *localQueue) Cancel(ctx context.Context, key string) error {
+	j, err := q.js.GetJob(ctx, key)
+	if err == ErrNoSuchJob {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !j.Done.IsZero() {
+		return nil
+	}
+	j.Done = q.now()
+	j.Canceled = true
+	log.Infof(ctx, "Canceled job %s", key)
+	return q.js.UpdateJob(ctx, j)
+}
+
+// Run runs due jobs until ctx is done.
+func (q *localQueue) Run(ctx context.Context) {
+	t := time.NewTicker(q.poll)
+	defer t.Stop()
+	for {
+		q.runDue(ctx)
+		select {
+		case <-ctx.Done():
+			q.wg.Wait()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runDue starts every due job, and cleans up old finished ones.
+func (q *localQueue) runDue(ctx context.Context) {
+	now := q.now()
+	js, err := q.js.ClaimJobs(ctx, now, q.lease, 100)
+	if err != nil {
+		log.Errorf(ctx, "ClaimJobs: %v", err)
+		return
+	}
+	for _, j := range js {
+		j := j
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.run(ctx, j)
+		}()
+	}
+	if err := q.js.DeleteJobs(ctx, now.Add(-q.retention)); err != nil {
+		log.Errorf(ctx, "DeleteJobs: %v", err)
+	}
+}
+
+// run runs the job, and records whether it succeeded or when to retry it.
+func (q *localQueue) run(ctx context.Context, j Job) {
+	ctx, cancel := context.WithTimeout(ctx, q.lease)
+	defer cancel()
+
+	err := runJob(ctx, j.Name, j.Args)
+	// Don't overwrite a cancellation that happened while running.
+	if cur, gerr := q.js.GetJob(ctx, j.Key); gerr == nil && cur.Canceled {
+		return
+	}
+	now := q.now()
+	if err == nil {
+		j.Done = now
+	} else {
+		j.Attempts++
+		j.LastError = err.Error()
+		if j.Attempts >= j.MaxAttempts {
+			log.Errorf(ctx, "Job %s failed %d times, giving up: %v", j.Key, j.Attempts, err)
+			j.Done = now
+		} else {
+			j.RunAt = now.Add(backoff(j.Attempts))
+			log.Warningf(ctx, "Job %s failed, retrying at %s: %v", j.Key, j.RunAt, err)
+		}
+	}
+	if err := q.js.UpdateJob(ctx, &j); err != nil {
+		log.Errorf(ctx, "UpdateJob(%s): %v", j.Key, err)
+	}
+}
+
+// RunQueue runs background jobs until ctx is done, if they're run by this
+// process; see cmd/makemecall. On App Engine, task queues run them.
+func RunQueue(ctx context.Context) {
+	if q, ok := queue.(*localQueue); ok {
+		q.Run(ctx)
+	}
+}
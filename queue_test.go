@@ -0,0 +1,142 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLocalQueue(t *testing.T) {
+	testLocalQueue(t, newMemStore())
+}
+
+// testLocalQueue exercises localQueue backed by a JobStore implementation.
+func testLocalQueue(t *testing.T, js JobStore) {
+	ctx := context.Background()
+	now := time.Now()
+	q := newLocalQueue(js)
+	q.now = func() time.Time { return now }
+
+	var mu sync.Mutex // Jobs run concurrently.
+	runs := map[string]int{}
+	fail := map[string]bool{}
+	jobHandlers["test"] = func(ctx context.Context, args []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		runs[string(args)]++
+		if fail[string(args)] {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	defer delete(jobHandlers, "test")
+
+	// advance moves the clock forward and runs due jobs to completion.
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		q.runDue(ctx)
+		q.wg.Wait()
+	}
+
+	for _, j := range []Job{
+		{Key: "a", Name: "test", Args: []byte("a"), RunAt: now.Add(time.Minute)},
+		{Key: "a", Name: "test", Args: []byte("a-again"), RunAt: now}, // Same key, ignored.
+		{Key: "b", Name: "test", Args: []byte("b"), RunAt: now.Add(time.Minute), MaxAttempts: 2},
+		{Key: "c", Name: "test", Args: []byte("c"), RunAt: now.Add(time.Minute)},
+	} {
+		if err := q.Enqueue(ctx, j); err != nil {
+			t.Fatalf("Enqueue(%s): %v", j.Key, err)
+		}
+	}
+	fail["b"] = true
+	if err := q.Cancel(ctx, "c"); err != nil {
+		t.Errorf("Cancel: %v", err)
+	}
+
+	// Nothing is due yet.
+	advance(30 * time.Second)
+	if len(runs) != 0 {
+		t.Errorf("Jobs ran early: %v", runs)
+	}
+
+	advance(30 * time.Second)
+	if runs["a"] != 1 || runs["a-again"] != 0 || runs["b"] != 1 || runs["c"] != 0 {
+		t.Errorf("After a minute, got runs %v, want a and b once", runs)
+	}
+
+	// b is retried after backoff, and then given up on.
+	advance(backoff(1) - time.Second)
+	if runs["b"] != 1 {
+		t.Errorf("b retried before backoff: %d runs", runs["b"])
+	}
+	advance(time.Second)
+	if runs["b"] != 2 {
+		t.Errorf("b not retried after backoff: %d runs", runs["b"])
+	}
+	advance(24 * time.Hour)
+	if runs["a"] != 1 || runs["b"] != 2 {
+		t.Errorf("After a day, got runs %v, want a once and b twice", runs)
+	}
+	if j, err := js.GetJob(ctx, "b"); err != nil {
+		t.Errorf("GetJob: %v", err)
+	} else if j.Done.IsZero() || j.Attempts != 2 || j.LastError != "failed" {
+		t.Errorf("b: got %+v, want done after 2 failed attempts", j)
+	}
+
+	// Finished jobs' keys are kept for a while, then forgotten.
+	if err := q.Enqueue(ctx, Job{Key: "a", Name: "test", Args: []byte("a"), RunAt: now}); err != nil {
+		t.Errorf("Enqueue: %v", err)
+	}
+	advance(time.Second)
+	if runs["a"] != 1 {
+		t.Errorf("Job with finished job's key ran")
+	}
+	advance(q.retention)
+	if _, err := js.GetJob(ctx, "a"); err != ErrNoSuchJob {
+		t.Errorf("GetJob after retention: got %v, want ErrNoSuchJob", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, c := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, time.Hour},
+	} {
+		if got := backoff(c.attempts); got != c.want {
+			t.Errorf("backoff(%d): got %s, want %s", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestSkipCancelsCall(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+
+	c, err := InsertCall(ctx, userPhone, Rep{}, Office{Phone: "5550000"})
+	if err != nil {
+		t.Fatalf("InsertCall: %v", err)
+	}
+	if err := enqueue(ctx, "actual-call", doCallKey(c.Key), time.Minute, doCallArgs{CallID: c.Key}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if err := SkipNextCall(ctx, userPhone); err != nil {
+		t.Fatalf("SkipNextCall: %v", err)
+	}
+	if j, err := s.GetJob(ctx, doCallKey(c.Key)); err != nil {
+		t.Errorf("GetJob: %v", err)
+	} else if !j.Canceled {
+		t.Errorf("actual-call job wasn't canceled: %+v", j)
+	}
+	if err := SkipNextCall(ctx, userPhone); err != ErrNoSkippableCalls {
+		t.Errorf("Second SkipNextCall: got %v, want ErrNoSkippableCalls", err)
+	}
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// Limit is a rate limit: at most Burst at once, refilling at Burst per Per.
+// The zero Limit allows everything.
+type Limit struct {
+	Burst int
+	Per   time.Duration
+}
+
+// parseLimit parses a Limit like "3/24h", or "" or "0" for no limit.
+func parseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("want N/DURATION, got %q", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("bad count in %q", s)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("bad duration in %q", s)
+	}
+	return Limit{n, d}, nil
+}
+
+func (l Limit) String() string {
+	if l.Burst == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Burst, l.Per)
+}
+
+// UnmarshalYAML reads a Limit from config, as parsed by parseLimit.
+func (l *Limit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	var err error
+	*l, err = parseLimit(s)
+	return err
+}
+
+// Bucket is a token bucket, rate limiting whatever its key names, e.g.,
+// "now:" and a phone number. It's kept in the store, so every instance
+// shares it.
+type Bucket struct {
+	Key     string    `datastore:",noindex"`
+	Tokens  float64   `datastore:",noindex"`
+	Updated time.Time `datastore:",noindex"` // Zero for a new bucket, which is full.
+}
+
+// take refills the bucket for the time since it was last updated, then takes
+// a token. If there isn't one, it returns how long until there is, and
+// leaves the bucket as it was.
+func (b *Bucket) take(l Limit, now time.Time) time.Duration {
+	burst := float64(l.Burst)
+	tokens := burst
+	if !b.Updated.IsZero() {
+		tokens = b.Tokens + burst*float64(now.Sub(b.Updated))/float64(l.Per)
+		if tokens > burst {
+			tokens = burst
+		}
+	}
+	if tokens < 1 {
+		return time.Duration((1 - tokens) / burst * float64(l.Per))
+	}
+	b.Tokens, b.Updated = tokens-1, now
+	return 0
+}
+
+// Rate limits are per phone number, for each of these.
+const (
+	limitTexts = "text:" // Commands texted to us.
+	limitNow   = "now:"  // NOW, which costs a call each.
+	limitCalls = "call:" // Calls we place.
+)
+
+// allow takes a token from the bucket for kind and the number, under l. If
+// the bucket's empty, it returns how long until it won't be.
+//
+// Unlike consent, rate limits fail open: if the store can't be reached, the
+// error is logged and the action allowed.
+func allow(ctx context.Context, kind, n string, l Limit) time.Duration {
+	if l.Burst == 0 {
+		return 0
+	}
+	var wait time.Duration
+	now := time.Now()
+	if _, err := store.UpdateBucket(ctx, kind+n, func(b *Bucket) error {
+		wait = b.take(l, now)
+		return nil
+	}); err != nil {
+		log.Errorf(ctx, "UpdateBucket(%s%s): %v", kind, n, err)
+		return 0
+	}
+	if wait > 0 {
+		log.Warningf(ctx, "Rate limited %s%s for %s", kind, n, wait)
+	}
+	return wait
+}
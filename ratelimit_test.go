@@ -0,0 +1,84 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseLimit(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want Limit
+	}{
+		{"3/24h", Limit{3, 24 * time.Hour}},
+		{" 30 / 1h ", Limit{30, time.Hour}},
+		{"0", Limit{}},
+		{"", Limit{}},
+	} {
+		if got, err := parseLimit(c.s); err != nil || got != c.want {
+			t.Errorf("parseLimit(%q): got %v, %v; want %v", c.s, got, err, c.want)
+		}
+	}
+	for _, s := range []string{"3", "x/1h", "3/x", "-1/1h", "3/0s"} {
+		if _, err := parseLimit(s); err == nil {
+			t.Errorf("parseLimit(%q): got no error", s)
+		}
+	}
+}
+
+func TestBucketTake(t *testing.T) {
+	l := Limit{2, 2 * time.Hour} // One an hour.
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := &Bucket{}
+	for i, c := range []struct {
+		after time.Duration
+		want  time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, time.Hour},
+		{30 * time.Minute, 30 * time.Minute},
+		{30 * time.Minute, 0},
+		{0, time.Hour},
+		{10 * time.Hour, 0}, // Full again, but no fuller.
+		{0, 0},
+		{0, time.Hour},
+	} {
+		now = now.Add(c.after)
+		if got := b.take(l, now); got != c.want {
+			t.Errorf("%d: take after %s: got %s, want %s", i, c.after, got, c.want)
+		}
+	}
+}
+
+func TestRateLimitedCommands(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(c Config) { cfg = c }(cfg)
+	cfg.NowLimit = Limit{1, 24 * time.Hour}
+	cfg.TextLimit = Limit{3, time.Hour}
+
+	u, err := InsertUser(ctx, userPhone, zip)
+	if err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	for _, c := range []struct{ text, want string }{
+		{"NOW", ""},
+		{"NOW", "You can text NOW again after"},
+		{"STATUS", "Your next call"},
+		{"STATUS", ""}, // Over TextLimit.
+		{"HELP", "Make Me Call"},
+		{"STOP", "unsubscribed"},
+	} {
+		got, err := runCommand(ctx, userPhone, u, c.text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", c.text, err)
+		} else if (c.want == "") != (got == "") || !strings.Contains(got, c.want) {
+			t.Errorf("runCommand(%q): got %q, want %q", c.text, got, c.want)
+		}
+	}
+}
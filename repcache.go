@@ -0,0 +1,82 @@
+package app
+
+import (
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// CachedReps are the reps for a ZIP code, as of when they were fetched.
+type CachedReps struct {
+	Zip     string `datastore:",noindex"` // Also the key.
+	Reps    []Rep  `datastore:",noindex"`
+	Fetched time.Time
+}
+
+var ErrNotCached = errors.New("not cached")
+
+// RepCache is a Store that can also hold cached rep lookups.
+type RepCache interface {
+	// GetCachedReps returns ErrNotCached if there's nothing cached for the
+	// ZIP code, however old.
+	GetCachedReps(ctx context.Context, zip string) (*CachedReps, error)
+	// PutCachedReps replaces whatever's cached for c.Zip.
+	PutCachedReps(ctx context.Context, c *CachedReps) error
+}
+
+// repCacheStats counts what cachedReps does, and is served at /debug/vars:
+//
+//   - hits: answered from a fresh cache entry
+//   - misses: answered by the provider
+//   - stale: the provider failed, so answered from an expired entry
+//   - errors: the provider failed, and nothing was cached
+var repCacheStats = expvar.NewMap("rep_cache")
+
+// cachedReps is a RepProvider that remembers what another one said for each
+// ZIP code for ttl. If that provider fails, it answers with what it last
+// said, however old.
+type cachedReps struct {
+	next  RepProvider
+	cache RepCache
+	ttl   time.Duration
+	now   func() time.Time
+}
+
+func newCachedReps(next RepProvider, cache RepCache, ttl time.Duration) *cachedReps {
+	return &cachedReps{
+		next:  next,
+		cache: cache,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+func (r *cachedReps) LookupReps(ctx context.Context, zip string) ([]Rep, error) {
+	c, err := r.cache.GetCachedReps(ctx, zip)
+	if err == nil && r.now().Sub(c.Fetched) < r.ttl {
+		repCacheStats.Add("hits", 1)
+		return c.Reps, nil
+	} else if err != nil && err != ErrNotCached {
+		// Carry on without the cache.
+		log.Warningf(ctx, "GetCachedReps(%s): %v", zip, err)
+	}
+
+	rs, ferr := r.next.LookupReps(ctx, zip)
+	if ferr != nil {
+		if c != nil {
+			repCacheStats.Add("stale", 1)
+			log.Warningf(ctx, "LookupReps(%s) failed, using reps from %s: %v", zip, c.Fetched, ferr)
+			return c.Reps, nil
+		}
+		repCacheStats.Add("errors", 1)
+		return nil, ferr
+	}
+	repCacheStats.Add("misses", 1)
+	if err := r.cache.PutCachedReps(ctx, &CachedReps{Zip: zip, Reps: rs, Fetched: r.now()}); err != nil {
+		log.Warningf(ctx, "PutCachedReps(%s): %v", zip, err)
+	}
+	return rs, nil
+}
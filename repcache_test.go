@@ -0,0 +1,63 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeReps is a RepProvider that answers with reps, or err, and counts how
+// often it's asked.
+type fakeReps struct {
+	reps  []Rep
+	err   error
+	calls int
+}
+
+func (f *fakeReps) LookupReps(ctx context.Context, zip string) ([]Rep, error) {
+	f.calls++
+	return f.reps, f.err
+}
+
+func TestMemRepCache(t *testing.T) {
+	testRepCache(t, newMemStore())
+}
+
+// testRepCache exercises cachedReps backed by a RepCache implementation.
+func testRepCache(t *testing.T, rc RepCache) {
+	ctx := context.Background()
+	now := time.Now()
+	f := &fakeReps{reps: []Rep{{Name: "Harriet House", Offices: []Office{{Phone: "202-225-0012"}}}}}
+	r := newCachedReps(f, rc, time.Hour)
+	r.now = func() time.Time { return now }
+
+	lookup := func(desc string, wantCalls int) {
+		t.Helper()
+		rs, err := r.LookupReps(ctx, zip)
+		if err != nil {
+			t.Errorf("%s: LookupReps: %v", desc, err)
+		} else if len(rs) != 1 || rs[0].Name != "Harriet House" {
+			t.Errorf("%s: LookupReps: got %+v", desc, rs)
+		}
+		if f.calls != wantCalls {
+			t.Errorf("%s: provider was asked %d times, want %d", desc, f.calls, wantCalls)
+		}
+	}
+
+	lookup("miss", 1)
+	lookup("hit", 1)
+	now = now.Add(2 * time.Hour)
+	lookup("expired", 2)
+
+	// Failures fall back to what's cached, however old.
+	now = now.Add(2 * time.Hour)
+	f.err = errors.New("down")
+	lookup("stale", 3)
+	lookup("still stale", 4)
+
+	if _, err := r.LookupReps(ctx, "99999"); err != f.err {
+		t.Errorf("LookupReps of an uncached ZIP while the provider fails: got %v, want %v", err, f.err)
+	}
+}
@@ -1,14 +1,19 @@
 package app
 
 import (
+	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ImJasonH/makemecall/log"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
 type LookupResponse struct {
@@ -16,12 +21,115 @@ type LookupResponse struct {
 }
 
 type Rep struct {
-	Name        string `json:"name"`
-	PhoneNumber string `json:"phone"`
-	Party       string `json:"party"`
-	State       string `json:"state"`
-	District    string `json:"district"`
-	Link        string `json:"link"`
+	Name     string `json:"name"`
+	Party    string `json:"party"`
+	State    string `json:"state"`
+	District string `json:"district"`
+	Link     string `json:"link"`
+	// Offices are the rep's offices, with the one in Washington first.
+	Offices []Office `json:"offices"`
+}
+
+// Office is one of a rep's offices.
+type Office struct {
+	Name    string `json:"name"` // e.g., "Washington, DC", or the city.
+	Phone   string `json:"phone"`
+	Address string `json:"address,omitempty"`
+	// TimeZone is the IANA name of the office's time zone, which Hours are
+	// in. If it's not set, it's Washington's.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Hours are when the office says it's open, if it says; see OpenHours.
+	// Their TimeZone is unused.
+	Hours OfficeHours `json:"hours"`
+}
+
+// OpenHours returns when the office answers the phone.
+func (o Office) OpenHours() OfficeHours {
+	h := o.Hours
+	if h.Start == 0 && h.End == 0 {
+		h.Start, h.End = capitolHours.Start, capitolHours.End
+	}
+	h.TimeZone = o.TimeZone
+	if h.TimeZone == "" {
+		h.TimeZone = capitolHours.TimeZone
+	}
+	return h
+}
+
+// legacyRep is a Rep as it was before reps had offices, with one phone number,
+// in Washington. Tasks queued then hold one gob-encoded as a Rep, so it's
+// registered with gob under Rep's name, which nothing gob-encodes anymore.
+type legacyRep struct {
+	Name        string
+	PhoneNumber string
+	Party       string
+	State       string
+	District    string
+	Link        string
+}
+
+func init() {
+	gob.RegisterName(reflect.TypeOf(Rep{}).PkgPath()+".Rep", legacyRep{})
+}
+
+// rep converts it to a Rep.
+func (l legacyRep) rep() Rep {
+	return Rep{
+		Name:     l.Name,
+		Party:    l.Party,
+		State:    l.State,
+		District: l.District,
+		Link:     l.Link,
+		Offices:  []Office{{Name: dcOffice, Phone: l.PhoneNumber, TimeZone: capitolHours.TimeZone}},
+	}
+}
+
+// dcOffice is the name of reps' offices in the Capitol.
+const dcOffice = "Washington, DC"
+
+// UnmarshalJSON also accepts a single "phone", for the Washington office, as
+// whoismyrepresentative.com gives.
+func (r *Rep) UnmarshalJSON(b []byte) error {
+	type rep Rep // Without this method.
+	var a struct {
+		rep
+		Phone  string `json:"phone"`
+		Office string `json:"office"` // Its address.
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	*r = Rep(a.rep)
+	if len(r.Offices) == 0 && a.Phone != "" {
+		r.Offices = []Office{{Name: dcOffice, Phone: a.Phone, Address: a.Office}}
+	}
+	return nil
+}
+
+// PhoneNumber returns the number of the rep's main office, or "" if there's
+// none.
+func (r Rep) PhoneNumber() string {
+	return r.mainOffice().Phone
+}
+
+// mainOffice returns the rep's office in Washington, or the zero Office if
+// there's none.
+func (r Rep) mainOffice() Office {
+	if len(r.Offices) == 0 {
+		return Office{}
+	}
+	return r.Offices[0]
+}
+
+// office returns the rep's office with the phone number, and its index in
+// Offices, or -1 if there isn't one.
+func (r Rep) office(phone string) (Office, int) {
+	for i, o := range r.Offices {
+		if o.Phone == phone {
+			return o, i
+		}
+	}
+	return Office{}, -1
 }
 
 func (r Rep) Title() string {
@@ -34,26 +142,185 @@ func (r Rep) Title() string {
 	return ""
 }
 
+// Chamber returns "senate" or "house", or "" if it's not known.
+func (r Rep) Chamber() string {
+	switch r.Title() {
+	case "Sen. ":
+		return "senate"
+	case "Rep. ":
+		return "house"
+	}
+	return ""
+}
+
+// Hours returns when the rep's main office answers the phone.
+func (r Rep) Hours() OfficeHours {
+	if len(r.Offices) == 0 {
+		return capitolHours
+	}
+	return r.Offices[0].OpenHours()
+}
+
+// Office preferences, which users choose with OFFICE.
+const (
+	officeDC    = "DC"    // The Washington office; the default.
+	officeLocal = "LOCAL" // Offices in their state or district, if the rep has any.
+	officeAny   = "ANY"
+)
+
+// officesFor returns the rep's offices the user prefers to call.
+func (r Rep) officesFor(u User) []Office {
+	if len(r.Offices) == 0 {
+		return nil
+	}
+	switch u.Office {
+	case officeLocal:
+		if len(r.Offices) > 1 {
+			return r.Offices[1:]
+		}
+	case officeAny:
+		return r.Offices
+	}
+	return r.Offices[:1]
+}
+
+// chooseOffice picks which of the rep's offices the user calls at now: one
+// they prefer, at random, and unless anyClosed, that's open. It's false if
+// there isn't one.
+func chooseOffice(u User, r Rep, now time.Time, anyClosed bool) (Office, bool) {
+	var os []Office
+	for _, o := range r.officesFor(u) {
+		if anyClosed || o.OpenHours().Open(now) {
+			os = append(os, o)
+		}
+	}
+	if len(os) == 0 {
+		return Office{}, false
+	}
+	return os[rand.Intn(len(os))], true
+}
+
 func (r Rep) String() string {
 	return fmt.Sprintf("%s%s (%s)", r.Title(), r.Name, r.Party)
 }
 
-func LookupReps(ctx context.Context, zip string) []Rep {
-	client := urlfetch.Client(ctx)
-	resp, err := client.Get("http://whoismyrepresentative.com/getall_mems.php?output=json&zip=" + zip)
+// District is a congressional district, e.g., {"NY", 12}. At-large districts
+// are 0.
+type District struct {
+	State  string `datastore:",noindex"`
+	Number int    `datastore:",noindex"`
+}
+
+func (d District) String() string {
+	if d.Number == 0 {
+		return d.State + " at-large"
+	}
+	return fmt.Sprintf("%s-%d", d.State, d.Number)
+}
+
+// IsZero reports whether the district is unknown.
+func (d District) IsZero() bool {
+	return d.State == ""
+}
+
+// houseDistrict returns the district the rep represents, if they're in the
+// House. Senators' districts are "Senior Seat" or "Junior Seat".
+func houseDistrict(r Rep) (District, bool) {
+	if strings.EqualFold(r.District, "at-large") {
+		return District{r.State, 0}, true
+	}
+	n, err := strconv.Atoi(r.District)
+	if err != nil {
+		return District{}, false
+	}
+	return District{r.State, n}, true
+}
+
+// inDistrict drops House members who don't represent d, if it's known. A ZIP
+// code can span several districts; a user's address is in exactly one.
+func inDistrict(rs []Rep, d District) []Rep {
+	if d.IsZero() {
+		return rs
+	}
+	var in []Rep
+	for _, r := range rs {
+		if hd, ok := houseDistrict(r); ok && hd != d {
+			continue
+		}
+		in = append(in, r)
+	}
+	return in
+}
+
+// RepProvider looks up the members of congress who represent a ZIP code.
+//
+// Implementations are whoIsMyRepresentative, which asks
+// whoismyrepresentative.com, and legislatorDataset, which reads local files.
+// They're selected by Config.Reps.
+type RepProvider interface {
+	LookupReps(ctx context.Context, zip string) ([]Rep, error)
+}
+
+// directory looks up reps. It's set by Configure.
+var directory RepProvider
+
+// openRepProvider opens the configured RepProvider, cached in the store if
+// c.RepCacheTTL is set. It must be called after the store is opened.
+func openRepProvider(c Config) (RepProvider, error) {
+	var p RepProvider
+	switch c.Reps {
+	case "whoismyrepresentative":
+		p = whoIsMyRepresentative{BaseURL: "http://whoismyrepresentative.com"}
+	case "dataset":
+		d, err := loadLegislatorDataset(c.LegislatorsPath, c.ZipDistrictsPath, c.LegislatorOfficesPath)
+		if err != nil {
+			return nil, err
+		}
+		p = d
+	default:
+		return nil, fmt.Errorf("unknown reps %q; want \"whoismyrepresentative\" or \"dataset\"", c.Reps)
+	}
+	if c.RepCacheTTL == 0 {
+		return p, nil
+	}
+	rc, ok := store.(RepCache)
+	if !ok {
+		return nil, fmt.Errorf("caching reps needs a store that can hold them, not %T", store)
+	}
+	return newCachedReps(p, rc, c.RepCacheTTL), nil
+}
+
+// LookupReps looks up the reps for a ZIP code, logging any error.
+func LookupReps(ctx context.Context, zip string) ([]Rep, error) {
+	if len(zip) > 5 {
+		// Reps are looked up by 5-digit ZIP; a +4 only makes it miss the cache.
+		zip = zip[:5]
+	}
+	rs, err := directory.LookupReps(ctx, zip)
 	if err != nil {
 		log.Errorf(ctx, "LookupReps(%s): %v", zip, err)
-		return nil
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Errorf(ctx, "LookupReps(%s): returned %d", zip, resp.StatusCode)
-		return nil
+	return rs, err
+}
+
+// whoIsMyRepresentative is a RepProvider backed by whoismyrepresentative.com.
+type whoIsMyRepresentative struct {
+	BaseURL string
+}
+
+func (w whoIsMyRepresentative) LookupReps(ctx context.Context, zip string) ([]Rep, error) {
+	client := httpClient(ctx)
+	resp, err := client.Get(w.BaseURL + "/getall_mems.php?output=json&zip=" + url.QueryEscape(zip))
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %d", resp.StatusCode)
+	}
 	var r LookupResponse
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		log.Errorf(ctx, "json.Decode: %v", err)
-		return nil
+		return nil, fmt.Errorf("json.Decode: %v", err)
 	}
-	return r.Results
+	return r.Results, nil
 }
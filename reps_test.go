@@ -0,0 +1,223 @@
+package app
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLegislatorDataset(t *testing.T) {
+	d, err := loadLegislatorDataset("testdata/legislators.yaml", "testdata/zip_districts.csv", "testdata/legislator_offices.yaml")
+	if err != nil {
+		t.Fatalf("loadLegislatorDataset: %v", err)
+	}
+	for _, c := range []struct {
+		zip  string
+		want []string
+	}{
+		{"10024", []string{"Sen. Sally Senior (Democrat)", "Sen. Jack Junior (Republican)", "Rep. Harriet House (Democrat)"}},
+		{"10024-1234", []string{"Sen. Sally Senior (Democrat)", "Sen. Jack Junior (Republican)", "Rep. Harriet House (Democrat)"}},
+		// Spans two districts.
+		{"10027", []string{"Sen. Sally Senior (Democrat)", "Sen. Jack Junior (Republican)", "Rep. Harriet House (Democrat)", "Rep. Henry Hall (Democrat)"}},
+		// At-large, and no senators in the fixture.
+		{"82001", []string{"Rep. Alice Atlarge (Republican)"}},
+		{"99999", nil},
+	} {
+		rs, err := d.LookupReps(context.Background(), c.zip)
+		if err != nil {
+			t.Errorf("LookupReps(%s): %v", c.zip, err)
+			continue
+		}
+		var got []string
+		for _, r := range rs {
+			got = append(got, r.String())
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("LookupReps(%s): got %q, want %q", c.zip, got, c.want)
+		}
+	}
+
+	rs, _ := d.LookupReps(context.Background(), "10024")
+	if want := (Rep{
+		Name:     "Harriet House",
+		Party:    "Democrat",
+		State:    "NY",
+		District: "12",
+		Link:     "https://house.house.gov",
+		Offices: []Office{
+			{Name: dcOffice, Phone: "202-225-0012", Address: "1 Longworth HOB; Washington DC 20515", TimeZone: "America/New_York"},
+			{Name: "New York", Phone: "212-555-0012", Address: "1 Main St, New York, NY 10024", TimeZone: "America/New_York", Hours: OfficeHours{Start: 9, End: 18}},
+			{Name: "Brooklyn", Phone: "718-555-0012", Address: "2 Court St, Suite 3, Brooklyn, NY 11201", TimeZone: "America/New_York"},
+		},
+	}); !reflect.DeepEqual(rs[2], want) {
+		t.Errorf("LookupReps(10024)[2]: got %#v, want %#v", rs[2], want)
+	}
+	if rs[0].District != "Senior Seat" {
+		t.Errorf("Senator's District: got %q, want %q", rs[0].District, "Senior Seat")
+	}
+}
+
+func TestParseOfficeHours(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		want OfficeHours
+		ok   bool
+	}{
+		{"9AM-5PM", OfficeHours{Start: 9, End: 17}, true},
+		{"M-F 9:00 a.m. - 6:00 p.m.", OfficeHours{Start: 9, End: 18}, true},
+		{"Monday - Friday 8 to 4 CT", OfficeHours{Start: 8, End: 16, TimeZone: "America/Chicago"}, true},
+		{"Mon-Thu 9:30-5:30, Fri 9:30-3", OfficeHours{}, false},
+		{"By appointment", OfficeHours{}, false},
+		{"", OfficeHours{}, false},
+	} {
+		if got, ok := parseOfficeHours(c.s); got != c.want || ok != c.ok {
+			t.Errorf("parseOfficeHours(%q): got %+v, %t; want %+v, %t", c.s, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestLegacyRep(t *testing.T) {
+	// Rep as it was when calls were queued with delay funcs.
+	type oldRep struct {
+		Name        string `json:"name"`
+		PhoneNumber string `json:"phone"`
+		Party       string `json:"party"`
+		State       string `json:"state"`
+		District    string `json:"district"`
+		Link        string `json:"link"`
+	}
+	old := oldRep{Name: "Jane Doe", PhoneNumber: "2022240001", Party: "Democrat", State: "NY", District: "Senior Seat", Link: "https://doe.senate.gov"}
+
+	// delay encodes args as interfaces, so by the name they're registered
+	// under: Rep's, which is now legacyRep's.
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode([]interface{}{legacyRep(old)}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var args []interface{}
+	if err := gob.NewDecoder(&b).Decode(&args); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	l, ok := args[0].(legacyRep)
+	if !ok {
+		t.Fatalf("Decoded %T, want legacyRep", args[0])
+	}
+	// And the old fields decode into it.
+	b.Reset()
+	if err := gob.NewEncoder(&b).Encode(old); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var fromOld legacyRep
+	if err := gob.NewDecoder(&b).Decode(&fromOld); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	for _, l := range []legacyRep{l, fromOld} {
+		r := l.rep()
+		if r.PhoneNumber() != "2022240001" || r.String() != "Sen. Jane Doe (Democrat)" {
+			t.Errorf("legacyRep(%+v).rep(): got %+v", l, r)
+		}
+	}
+}
+
+func TestWhoIsMyRepresentative(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.FormValue("zip"); got != zip {
+			http.Error(w, "bad zip "+got, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"results":[{"name":"Harriet House","party":"D","state":"NY","district":"12","phone":"202-225-0012","office":"1 House Office Building","link":"https://house.house.gov"}]}`))
+	}))
+	defer srv.Close()
+
+	w := whoIsMyRepresentative{BaseURL: srv.URL}
+	rs, err := w.LookupReps(context.Background(), zip)
+	if err != nil {
+		t.Fatalf("LookupReps: %v", err)
+	}
+	if len(rs) != 1 || rs[0].String() != "Rep. Harriet House (D)" || rs[0].PhoneNumber() != "202-225-0012" || rs[0].Offices[0].Address != "1 House Office Building" {
+		t.Errorf("LookupReps: got %+v", rs)
+	}
+
+	if _, err := w.LookupReps(context.Background(), "00000"); err == nil {
+		t.Error("LookupReps with a failing server: got nil error")
+	}
+}
+
+func TestChooseOffice(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	dc := Office{Name: dcOffice, Phone: "2022240001"}
+	la := Office{Name: "Los Angeles", Phone: "2135550001", TimeZone: "America/Los_Angeles"}
+	r := Rep{Name: "Jane Doe", Offices: []Office{dc, la}}
+	morning := time.Date(2017, 3, 1, 10, 0, 0, 0, ny) // 7AM in Los Angeles.
+	afternoon := time.Date(2017, 3, 1, 15, 0, 0, 0, ny)
+	evening := time.Date(2017, 3, 1, 18, 0, 0, 0, ny) // 3PM in Los Angeles.
+
+	for _, c := range []struct {
+		pref      string
+		rep       Rep
+		now       time.Time
+		anyClosed bool
+		want      string // Phone, or "" for none.
+	}{
+		{"", r, morning, false, dc.Phone},
+		{officeDC, r, evening, false, ""},
+		{officeDC, r, evening, true, dc.Phone},
+		{officeLocal, r, morning, false, ""},
+		{officeLocal, r, afternoon, false, la.Phone},
+		{officeLocal, Rep{Offices: []Office{dc}}, afternoon, false, dc.Phone},
+		{officeAny, r, morning, false, dc.Phone},
+		{officeAny, r, evening, false, la.Phone},
+		{officeAny, Rep{}, afternoon, true, ""},
+	} {
+		o, ok := chooseOffice(User{Office: c.pref}, c.rep, c.now, c.anyClosed)
+		if c.want == "" && ok {
+			t.Errorf("chooseOffice(%q, %v): got %+v, want none", c.pref, c.now, o)
+		} else if c.want != "" && (!ok || o.Phone != c.want) {
+			t.Errorf("chooseOffice(%q, %v): got %+v, %t; want %s", c.pref, c.now, o, ok, c.want)
+		}
+	}
+}
+
+func TestCallLocalOffice(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	store, queue = s, newLocalQueue(s)
+	defer func(d RepProvider, p Telephony) { directory, phone = d, p }(directory, phone)
+	sen := senator
+	sen.Offices = []Office{{Name: dcOffice, Phone: senator.PhoneNumber()}, {Name: "Albany", Phone: "5185550001"}}
+	directory = &fakeReps{reps: []Rep{sen}}
+	fp := &fakePhone{}
+	phone = fp
+
+	if _, err := InsertUser(ctx, userPhone, zip); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	if got, err := runCommand(ctx, userPhone, &User{PhoneNumber: userPhone}, "office local"); err != nil || !strings.Contains(got, "offices near you") {
+		t.Errorf("OFFICE LOCAL: got %q, %v", got, err)
+	}
+	u, err := store.GetUser(ctx, userPhone)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.Office != officeLocal {
+		t.Errorf("User.Office: got %q, want %q", u.Office, officeLocal)
+	}
+	if err := call(ctx, *u, true); err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if c, err := store.LatestCall(ctx, userPhone); err != nil {
+		t.Errorf("LatestCall: %v", err)
+	} else if c.To != "5185550001" {
+		t.Errorf("Call.To: got %q, want the Albany office", c.To)
+	}
+	if len(fp.texts) != 1 || !strings.Contains(fp.texts[0], "Sen. Jane Doe () at their office in Albany") {
+		t.Errorf("Sent texts: got %q, want one about calling the Albany office", fp.texts)
+	}
+}
@@ -0,0 +1,601 @@
+//go:build !appengine
+// +build !appengine
+
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/context"
+)
+
+func init() {
+	stores["sqlite"] = func(c Config) (Store, error) { return openSQLite(c.SQLitePath) }
+}
+
+// sqliteStore is a Store backed by a SQLite database, for running outside of
+// App Engine.
+//
+// Each row holds a JSON-encoded entity in its data column, alongside columns
+// for the fields it's looked up or ordered by. Adding fields to User or Call
+// therefore doesn't need a migration, but querying by them does.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// migrations bring the schema up to date. Each is applied once, in order,
+// and the number applied is recorded in the database's user_version.
+//
+// Only ever append to this list.
+var migrations = []string{
+	// 1: Users and calls.
+	`CREATE TABLE users (
+		phone     TEXT PRIMARY KEY,
+		next_call INTEGER NOT NULL, -- Unix nanoseconds
+		data      TEXT NOT NULL
+	);
+	CREATE INDEX users_next_call ON users (next_call);
+
+	CREATE TABLE calls (
+		user    TEXT NOT NULL,
+		key     TEXT NOT NULL,
+		sid     TEXT UNIQUE,        -- NULL until the call is placed
+		created INTEGER NOT NULL,   -- Unix nanoseconds
+		data    TEXT NOT NULL,
+		PRIMARY KEY (user, key)
+	);
+	CREATE INDEX calls_user_created ON calls (user, created);`,
+
+	// 2: Jobs for localQueue.
+	`CREATE TABLE jobs (
+		key    TEXT PRIMARY KEY,
+		run_at INTEGER NOT NULL,   -- Unix nanoseconds
+		done   INTEGER NOT NULL,   -- Unix nanoseconds, or 0 if pending
+		data   TEXT NOT NULL
+	);
+	CREATE INDEX jobs_done_run_at ON jobs (done, run_at);`,
+
+	// 3: Cached rep lookups.
+	`CREATE TABLE reps (
+		zip  TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+
+	// 4: Consent ledger, and soft-deleted users.
+	`ALTER TABLE users ADD COLUMN stopped INTEGER NOT NULL DEFAULT 0; -- 1 if opted out
+
+	CREATE TABLE consent (
+		phone TEXT NOT NULL,
+		time  INTEGER NOT NULL,   -- Unix nanoseconds
+		data  TEXT NOT NULL
+	);
+	CREATE INDEX consent_phone_time ON consent (phone, time);`,
+
+	// 5: Rate limiting buckets.
+	`CREATE TABLE buckets (
+		key  TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	);`,
+
+	// 6: Call analytics.
+	`CREATE INDEX calls_created ON calls (created);
+
+	CREATE TABLE office_stats (
+		phone TEXT PRIMARY KEY,
+		data  TEXT NOT NULL
+	);`,
+
+	// 7: Mass call attendees.
+	`CREATE TABLE attendees (
+		event TEXT NOT NULL,
+		phone TEXT NOT NULL,
+		data  TEXT NOT NULL,
+		PRIMARY KEY (event, phone)
+	);`,
+}
+
+func openSQLite(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time anyway, and this keeps
+	// ":memory:" databases from being per-connection.
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		// PRAGMA doesn't take parameters.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getJSON decodes the single data column selected by the query into v. It
+// returns notFound if there are no rows.
+func getJSON(q querier, v interface{}, notFound error, query string, args ...interface{}) error {
+	var data string
+	if err := q.QueryRow(query, args...).Scan(&data); err == sql.ErrNoRows {
+		return notFound
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), v)
+}
+
+// inTx runs f in a transaction, which is committed if f returns nil.
+func (s *sqliteStore) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullString maps "" to NULL, so unset values don't collide in UNIQUE columns.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+///////////
+// USERS //
+///////////
+
+func (s *sqliteStore) GetUser(ctx context.Context, n string) (*User, error) {
+	var u User
+	if err := getJSON(s.db, &u, ErrNoSuchUser, "SELECT data FROM users WHERE phone = ?", n); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *sqliteStore) PutUser(ctx context.Context, u *User) error {
+	return putUser(s.db, u)
+}
+
+func putUser(q querier, u *User) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT OR REPLACE INTO users (phone, next_call, stopped, data) VALUES (?, ?, ?, ?)",
+		u.PhoneNumber, u.NextCall.UnixNano(), u.IsStopped(), string(b))
+	return err
+}
+
+func (s *sqliteStore) UpdateUser(ctx context.Context, n string, f func(*User) error) (*User, error) {
+	var u User
+	if err := s.inTx(func(tx *sql.Tx) error {
+		if err := getJSON(tx, &u, ErrNoSuchUser, "SELECT data FROM users WHERE phone = ?", n); err != nil {
+			return err
+		}
+		if err := f(&u); err != nil {
+			return err
+		}
+		return putUser(tx, &u)
+	}); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *sqliteStore) DeleteUser(ctx context.Context, n string) error {
+	_, err := s.db.Exec("DELETE FROM users WHERE phone = ?", n)
+	return err
+}
+
+func (s *sqliteStore) CallableUsers(ctx context.Context, now time.Time) ([]User, error) {
+	return s.queryUsers("SELECT data FROM users WHERE stopped = 0 AND next_call < ? ORDER BY next_call DESC LIMIT 100", now.UnixNano())
+}
+
+func (s *sqliteStore) ActiveUsers(ctx context.Context) ([]User, error) {
+	return s.queryUsers("SELECT data FROM users WHERE stopped = 0")
+}
+
+func (s *sqliteStore) queryUsers(query string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var us []User
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var u User
+		if err := json.Unmarshal([]byte(data), &u); err != nil {
+			return nil, err
+		}
+		us = append(us, u)
+	}
+	return us, rows.Err()
+}
+
+///////////
+// CALLS //
+///////////
+
+func (s *sqliteStore) PutCall(ctx context.Context, c *Call) error {
+	return putCall(s.db, c)
+}
+
+func putCall(q querier, c *Call) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("INSERT OR REPLACE INTO calls (user, key, sid, created, data) VALUES (?, ?, ?, ?, ?)",
+		c.From, c.Key, nullString(c.Sid), c.Created.UnixNano(), string(b))
+	return err
+}
+
+func (s *sqliteStore) GetCall(ctx context.Context, user, key string) (*Call, error) {
+	var c Call
+	if err := getJSON(s.db, &c, ErrNoSuchCall, "SELECT data FROM calls WHERE user = ? AND key = ?", user, key); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqliteStore) LatestCall(ctx context.Context, user string) (*Call, error) {
+	var c Call
+	if err := getJSON(s.db, &c, ErrNoSuchCall, "SELECT data FROM calls WHERE user = ? ORDER BY created DESC LIMIT 1", user); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqliteStore) UserCalls(ctx context.Context, user string, n int) ([]Call, error) {
+	if n <= 0 {
+		n = -1 // No limit.
+	}
+	return s.queryCalls("SELECT data FROM calls WHERE user = ? ORDER BY created DESC LIMIT ?", user, n)
+}
+
+func (s *sqliteStore) CallsSince(ctx context.Context, since time.Time) ([]Call, error) {
+	return s.queryCalls("SELECT data FROM calls WHERE created >= ?", since.UnixNano())
+}
+
+// queryCalls returns the calls whose data the query selects.
+func (s *sqliteStore) queryCalls(query string, args ...interface{}) ([]Call, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cs []Call
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var c Call
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+func (s *sqliteStore) UpdateCall(ctx context.Context, user, key string, f func(*Call) error) (*Call, error) {
+	var c Call
+	if err := s.inTx(func(tx *sql.Tx) error {
+		if err := getJSON(tx, &c, ErrNoSuchCall, "SELECT data FROM calls WHERE user = ? AND key = ?", user, key); err != nil {
+			return err
+		}
+		if err := f(&c); err != nil {
+			return err
+		}
+		return putCall(tx, &c)
+	}); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqliteStore) SetSID(ctx context.Context, user, key, sid string) error {
+	_, err := s.UpdateCall(ctx, user, key, func(c *Call) error {
+		c.Sid = sid
+		return nil
+	})
+	return err
+}
+
+func (s *sqliteStore) CallBySID(ctx context.Context, sid string) (*Call, error) {
+	var c Call
+	if err := getJSON(s.db, &c, ErrNoSuchCall, "SELECT data FROM calls WHERE sid = ?", sid); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+/////////////
+// CONSENT //
+/////////////
+
+func (s *sqliteStore) AddConsent(ctx context.Context, e *ConsentEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO consent (phone, time, data) VALUES (?, ?, ?)",
+		e.PhoneNumber, e.Time.UnixNano(), string(b))
+	return err
+}
+
+func (s *sqliteStore) LatestConsent(ctx context.Context, n string) (*ConsentEvent, error) {
+	var e ConsentEvent
+	// Break ties by insertion order.
+	if err := getJSON(s.db, &e, ErrNoConsent, "SELECT data FROM consent WHERE phone = ? ORDER BY time DESC, rowid DESC LIMIT 1", n); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+/////////////////
+// RATE LIMITS //
+/////////////////
+
+func (s *sqliteStore) UpdateBucket(ctx context.Context, key string, f func(*Bucket) error) (*Bucket, error) {
+	b := Bucket{Key: key}
+	if err := s.inTx(func(tx *sql.Tx) error {
+		// If there's no row, b stays new.
+		if err := getJSON(tx, &b, nil, "SELECT data FROM buckets WHERE key = ?", key); err != nil {
+			return err
+		}
+		if err := f(&b); err != nil {
+			return err
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO buckets (key, data) VALUES (?, ?)", key, string(data))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+///////////////
+// ANALYTICS //
+///////////////
+
+func (s *sqliteStore) PutOfficeStats(ctx context.Context, st *OfficeStats) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO office_stats (phone, data) VALUES (?, ?)", st.Phone, string(b))
+	return err
+}
+
+func (s *sqliteStore) GetOfficeStats(ctx context.Context, phone string) (*OfficeStats, error) {
+	var st OfficeStats
+	if err := getJSON(s.db, &st, ErrNoStats, "SELECT data FROM office_stats WHERE phone = ?", phone); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *sqliteStore) AllOfficeStats(ctx context.Context) ([]OfficeStats, error) {
+	rows, err := s.db.Query("SELECT data FROM office_stats")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ss []OfficeStats
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var st OfficeStats
+		if err := json.Unmarshal([]byte(data), &st); err != nil {
+			return nil, err
+		}
+		ss = append(ss, st)
+	}
+	return ss, rows.Err()
+}
+
+////////////
+// EVENTS //
+////////////
+
+func (s *sqliteStore) UpdateAttendee(ctx context.Context, event, n string, f func(*Attendee) error) (*Attendee, error) {
+	a := Attendee{Event: event, PhoneNumber: n}
+	if err := s.inTx(func(tx *sql.Tx) error {
+		// If there's no row, a stays new.
+		if err := getJSON(tx, &a, nil, "SELECT data FROM attendees WHERE event = ? AND phone = ?", event, n); err != nil {
+			return err
+		}
+		if err := f(&a); err != nil {
+			return err
+		}
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO attendees (event, phone, data) VALUES (?, ?, ?)", event, n, string(data))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *sqliteStore) Attendees(ctx context.Context, event string) ([]Attendee, error) {
+	rows, err := s.db.Query("SELECT data FROM attendees WHERE event = ?", event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var as []Attendee
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var a Attendee
+		if err := json.Unmarshal([]byte(data), &a); err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	return as, rows.Err()
+}
+
+//////////
+// JOBS //
+//////////
+
+// unixNano is like t.UnixNano, but 0 for the zero Time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *sqliteStore) PutJob(ctx context.Context, j *Job) (bool, error) {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec("INSERT OR IGNORE INTO jobs (key, run_at, done, data) VALUES (?, ?, ?, ?)",
+		j.Key, unixNano(j.RunAt), unixNano(j.Done), string(b))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *sqliteStore) GetJob(ctx context.Context, key string) (*Job, error) {
+	var j Job
+	if err := getJSON(s.db, &j, ErrNoSuchJob, "SELECT data FROM jobs WHERE key = ?", key); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (s *sqliteStore) UpdateJob(ctx context.Context, j *Job) error {
+	return updateJob(s.db, j)
+}
+
+func updateJob(q querier, j *Job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE jobs SET run_at = ?, done = ?, data = ? WHERE key = ?",
+		unixNano(j.RunAt), unixNano(j.Done), string(b), j.Key)
+	return err
+}
+
+func (s *sqliteStore) ClaimJobs(ctx context.Context, now time.Time, lease time.Duration, n int) ([]Job, error) {
+	var js []Job
+	if err := s.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT data FROM jobs WHERE done = 0 AND run_at <= ? ORDER BY run_at LIMIT ?", now.UnixNano(), n)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				rows.Close()
+				return err
+			}
+			var j Job
+			if err := json.Unmarshal([]byte(data), &j); err != nil {
+				rows.Close()
+				return err
+			}
+			js = append(js, j)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, j := range js {
+			j.RunAt = now.Add(lease)
+			if err := updateJob(tx, &j); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+func (s *sqliteStore) DeleteJobs(ctx context.Context, before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM jobs WHERE done != 0 AND done < ?", before.UnixNano())
+	return err
+}
+
+//////////
+// REPS //
+//////////
+
+func (s *sqliteStore) GetCachedReps(ctx context.Context, zip string) (*CachedReps, error) {
+	var c CachedReps
+	if err := getJSON(s.db, &c, ErrNotCached, "SELECT data FROM reps WHERE zip = ?", zip); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *sqliteStore) PutCachedReps(ctx context.Context, c *CachedReps) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT OR REPLACE INTO reps (zip, data) VALUES (?, ?)", c.Zip, string(b))
+	return err
+}
@@ -0,0 +1,58 @@
+//go:build !appengine
+// +build !appengine
+
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	s, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("openSQLite: %v", err)
+	}
+	testStore(t, s)
+}
+
+func TestSQLiteLocalQueue(t *testing.T) {
+	s, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("openSQLite: %v", err)
+	}
+	testLocalQueue(t, s)
+}
+
+func TestSQLiteMigrationsAreIdempotent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "makemecall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	for i := 0; i < 2; i++ {
+		s, err := openSQLite(path)
+		if err != nil {
+			t.Fatalf("openSQLite #%d: %v", i, err)
+		}
+		var v int
+		if err := s.db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		if v != len(migrations) {
+			t.Errorf("user_version: got %d, want %d", v, len(migrations))
+		}
+		s.db.Close()
+	}
+}
+
+func TestSQLiteRepCache(t *testing.T) {
+	s, err := openSQLite(":memory:")
+	if err != nil {
+		t.Fatalf("openSQLite: %v", err)
+	}
+	testRepCache(t, s)
+}
@@ -0,0 +1,29 @@
+//go:build !appengine
+// +build !appengine
+
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// These are the counterparts of appengine.go, for running as a normal
+// net/http server; see cmd/makemecall.
+
+const (
+	defaultStore = "sqlite"
+	defaultQueue = "local"
+)
+
+func newContext(r *http.Request) context.Context { return r.Context() }
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+func httpClient(ctx context.Context) *http.Client { return client }
+
+// isCron always reports false: outside App Engine, anyone can set any
+// header, so cron runs in-process by calling RunCron instead.
+func isCron(r *http.Request) bool { return false }
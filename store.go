@@ -0,0 +1,346 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// Store persists users and their calls.
+//
+// Implementations are the App Engine datastore (datastore.go), SQLite
+// (sqlite.go) and memory (memory.go), selected by Config.Store.
+type Store interface {
+	// GetUser returns ErrNoSuchUser if there's no user with that number.
+	GetUser(ctx context.Context, n string) (*User, error)
+	// PutUser stores the user, replacing any user with the same number.
+	PutUser(ctx context.Context, u *User) error
+	// UpdateUser atomically applies f to the user and stores the result,
+	// unless f returns an error.
+	UpdateUser(ctx context.Context, n string, f func(*User) error) (*User, error)
+	DeleteUser(ctx context.Context, n string) error
+	// CallableUsers returns up to 100 users whose NextCall is before now,
+	// latest first, leaving out stopped users.
+	CallableUsers(ctx context.Context, now time.Time) ([]User, error)
+	// ActiveUsers returns every user who hasn't stopped.
+	ActiveUsers(ctx context.Context) ([]User, error)
+
+	// PutCall stores the call, replacing any call with the same key.
+	PutCall(ctx context.Context, c *Call) error
+	// GetCall returns ErrNoSuchCall if the user has no call with that key.
+	GetCall(ctx context.Context, user, key string) (*Call, error)
+	// LatestCall returns the user's most recently created call, or
+	// ErrNoSuchCall if they've never had one.
+	LatestCall(ctx context.Context, user string) (*Call, error)
+	// UserCalls returns up to n of the user's calls, newest first, or all
+	// of them if n <= 0.
+	UserCalls(ctx context.Context, user string, n int) ([]Call, error)
+	// CallsSince returns every user's calls created since the time.
+	CallsSince(ctx context.Context, since time.Time) ([]Call, error)
+	// UpdateCall atomically applies f to the call and stores the result,
+	// unless f returns an error.
+	UpdateCall(ctx context.Context, user, key string, f func(*Call) error) (*Call, error)
+	// SetSID sets the carrier's ID for the call, by which it can be found
+	// with CallBySID.
+	SetSID(ctx context.Context, user, key, sid string) error
+	// CallBySID returns ErrNoSuchCall if no call has that SID.
+	CallBySID(ctx context.Context, sid string) (*Call, error)
+
+	// AddConsent adds the event to its number's consent ledger.
+	AddConsent(ctx context.Context, e *ConsentEvent) error
+	// LatestConsent returns the number's latest consent event, or
+	// ErrNoConsent if it has none.
+	LatestConsent(ctx context.Context, n string) (*ConsentEvent, error)
+
+	// UpdateBucket atomically applies f to the rate limiting bucket with
+	// the key, or to a new one if there isn't one, and stores the result,
+	// unless f returns an error.
+	UpdateBucket(ctx context.Context, key string, f func(*Bucket) error) (*Bucket, error)
+
+	// PutOfficeStats stores the stats, replacing any for the same number.
+	PutOfficeStats(ctx context.Context, s *OfficeStats) error
+	// GetOfficeStats returns ErrNoStats if there are none for the number.
+	GetOfficeStats(ctx context.Context, phone string) (*OfficeStats, error)
+	AllOfficeStats(ctx context.Context) ([]OfficeStats, error)
+
+	// UpdateAttendee atomically applies f to the number's attendance of the
+	// event, or to a new Attendee if there isn't one, and stores the
+	// result, unless f returns an error.
+	UpdateAttendee(ctx context.Context, event, n string, f func(*Attendee) error) (*Attendee, error)
+	// Attendees returns everyone who's RSVP'd to the event.
+	Attendees(ctx context.Context, event string) ([]Attendee, error)
+}
+
+// store is where users and calls are kept. It's set by Configure.
+var store Store
+
+var (
+	ErrNoSuchUser = errors.New("no such user")
+	ErrNoSuchCall = errors.New("no such call")
+)
+
+// stores maps Config.Store names to functions that open that kind of Store.
+// Build-specific files add to it.
+var stores = map[string]func(Config) (Store, error){
+	"memory": func(Config) (Store, error) { return newMemStore(), nil },
+}
+
+func openStore(c Config) (Store, error) {
+	open, found := stores[c.Store]
+	if !found {
+		names := []string{}
+		for n := range stores {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown store %q; want one of %q", c.Store, names)
+	}
+	return open(c)
+}
+
+///////////
+// USERS //
+///////////
+
+type User struct {
+	PhoneNumber string `datastore:",noindex"` // Also the key.
+	ZipCode     string `datastore:",noindex"`
+	NextCall    time.Time
+	// District is where the user's ADDRESS is, if they've sent one. The
+	// address itself isn't kept.
+	District District
+	// Stopped is when the user opted out, or zero if they haven't. Stopped
+	// users are kept so they can START again, but aren't called.
+	Stopped time.Time `datastore:",noindex"`
+
+	// TimeZone is the IANA name of the user's time zone, if they've set it
+	// with TIME. Otherwise it's guessed from their ZIP code.
+	TimeZone string `datastore:",noindex"`
+	// WindowStart and WindowEnd are the hours, in the user's time zone, they
+	// want to be called between. If they're zero, the configured window is
+	// used.
+	WindowStart int `datastore:",noindex"`
+	WindowEnd   int `datastore:",noindex"`
+	// Days is which days the user is called on, as named by
+	// parseSchedule, e.g., "MWF" or "TUE,THU". Empty means weekdays.
+	Days string `datastore:",noindex"`
+
+	// Name is what the user texted with NAME, and City is from their
+	// ADDRESS, for campaign scripts.
+	Name string `datastore:",noindex"`
+	City string `datastore:",noindex"`
+	// Campaigns are the codes of the campaigns the user follows.
+	Campaigns []string `datastore:",noindex"`
+	// Office is which of their reps' offices they call, as set with OFFICE:
+	// "DC", "LOCAL" or "ANY". Empty means DC.
+	Office string `datastore:",noindex"`
+}
+
+// Schedule returns which days the user is called on.
+func (u User) Schedule() Schedule {
+	if sc, _, err := parseSchedule(u.Days); err == nil {
+		return sc
+	}
+	return weekdays
+}
+
+// Location returns the user's time zone.
+func (u User) Location() *time.Location {
+	for _, tz := range []string{u.TimeZone, zipTimeZone(u.ZipCode)} {
+		if tz == "" {
+			continue
+		}
+		if l, err := loadLocation(tz); err == nil {
+			return l
+		}
+	}
+	return cfg.Location()
+}
+
+// officeHours are when the offices the user prefers to call are open, for
+// scheduling. Local offices are taken to keep the usual hours in the user's
+// time zone.
+func (u User) officeHours() OfficeHours {
+	if u.Office == officeLocal {
+		h := capitolHours
+		h.TimeZone = u.Location().String()
+		return h
+	}
+	return capitolHours
+}
+
+// Window returns the hours, in the user's time zone, to call them between.
+func (u User) Window() (start, end int) {
+	if u.WindowStart == 0 && u.WindowEnd == 0 {
+		return cfg.CallWindowStart, cfg.CallWindowEnd
+	}
+	return u.WindowStart, u.WindowEnd
+}
+
+func (u User) IsStopped() bool {
+	return !u.Stopped.IsZero()
+}
+
+func (u User) NextCallFormatted() string {
+	return u.NextCall.In(u.Location()).Format(timeFmt)
+}
+
+func isNotUser(err error) bool {
+	return err == ErrNoSuchUser
+}
+
+func InsertUser(ctx context.Context, n, zip string) (*User, error) {
+	u := User{
+		PhoneNumber: n,
+		ZipCode:     zip,
+	}
+	u.NextCall = someTimeTomorrow(u)
+	if err := store.PutUser(ctx, &u); err != nil {
+		log.Errorf(ctx, "InsertUser: Put(%q): %v", n, err)
+		return nil, err
+	}
+	log.Infof(ctx, "Stored user: %s", n)
+	return &u, nil
+}
+
+func SetNextCall(ctx context.Context, n string, next time.Time) (*User, error) {
+	u, err := store.UpdateUser(ctx, n, func(u *User) error {
+		u.NextCall = next
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "SetNextCall(%s): %v", n, err)
+		return nil, err
+	}
+	log.Infof(ctx, "User %s will call at %s", n, next)
+	return u, nil
+}
+
+///////////
+// CALLS //
+///////////
+
+type Call struct {
+	Key      string `datastore:",noindex"`
+	To       string `datastore:",noindex"`
+	From     string `datastore:",noindex"`
+	RepName  string `datastore:",noindex"` // e.g., "Sen. Jane Doe"
+	Sid      string // Twilio SID of our call to the user, the same as UserLeg.SID.
+	Created  time.Time
+	Duration time.Duration `datastore:",noindex"` // Of the rep's leg.
+	// Status is the state of the call as a whole; see overall.
+	Status CallState
+	// UserLeg and RepLeg are our call to the user, and theirs to the rep,
+	// which starts once they're connected.
+	UserLeg CallLeg `datastore:",noindex"`
+	RepLeg  CallLeg `datastore:",noindex"`
+	// Attempts are earlier rep's legs, to offices that didn't answer.
+	Attempts []CallLeg `datastore:",noindex"`
+	// Events are every state change we've been told about, stale or not.
+	Events []CallEvent `datastore:",noindex"`
+}
+
+const (
+	callKeyLength = 10
+	alphabet      = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+)
+
+func randomString() string {
+	s := make([]byte, callKeyLength)
+	for i := 0; i < callKeyLength; i++ {
+		s[i] = alphabet[rand.Intn(len(alphabet))]
+	}
+	return string(s)
+}
+
+// InsertCall stores a new call from the user to the rep's office.
+func InsertCall(ctx context.Context, from string, rep Rep, o Office) (*Call, error) {
+	c := Call{
+		Key:     randomString(),
+		To:      o.Phone,
+		From:    from,
+		RepName: rep.Title() + rep.Name,
+		Created: time.Now(),
+		Status:  StateNew,
+	}
+	if err := store.PutCall(ctx, &c); err != nil {
+		log.Errorf(ctx, "InsertCall: Put(%q): %v", c.Key, err)
+		return nil, err
+	}
+	log.Infof(ctx, "Inserted Call %s", c.Key)
+	return &c, nil
+}
+
+// UpdateCallBySID applies what the carrier told us about a leg of the call
+// with the SID, unless the leg's already past it: the carrier's webhooks can
+// arrive out of order, or more than once. Once both legs are over, it texts
+// the user how the call went.
+func UpdateCallBySID(ctx context.Context, sid string, ls LegStatus) error {
+	c, err := store.CallBySID(ctx, sid)
+	if err != nil {
+		log.Errorf(ctx, "UpdateCallBySID(%q): %v", sid, err)
+		return err
+	}
+	var wasOver bool
+	c, err = store.UpdateCall(ctx, c.From, c.Key, func(c *Call) error {
+		wasOver = c.over()
+		if !c.update(ls, time.Now()) {
+			log.Warningf(ctx, "Ignoring stale %s leg status %q for call %s", ls.Leg, ls.State, c.Key)
+			return nil
+		}
+		log.Infof(ctx, "Updated %s leg status to %q; call is %q", ls.Leg, ls.State, c.Status)
+		return nil
+	})
+	if err != nil {
+		log.Errorf(ctx, "UpdateCallBySID(%q): %v", sid, err)
+		return err
+	}
+	log.Infof(ctx, "Successful update")
+	if wasOver || !c.over() {
+		return nil
+	}
+	// One text is plenty.
+	if msg := outcomeText(*c); msg != "" {
+		if err := phone.SendSMS(ctx, c.From, msg); err != nil {
+			log.Errorf(ctx, "SendSMS: %v", err)
+		}
+	} else if c.Status == StateCompleted {
+		celebrate(ctx, c)
+	}
+	return nil
+}
+
+var ErrNoSkippableCalls = errors.New("no skippable calls")
+
+// Skips the latest "new" call for the user, and cancels the job that would
+// place it.
+func SkipNextCall(ctx context.Context, n string) error {
+	c, err := store.LatestCall(ctx, n)
+	if err == ErrNoSuchCall {
+		return ErrNoSkippableCalls
+	} else if err != nil {
+		log.Errorf(ctx, "SkipNextCall(%s): %v", n, err)
+		return err
+	}
+	_, err = store.UpdateCall(ctx, n, c.Key, func(c *Call) error {
+		if c.Status != StateNew || !c.advance(LegNone, StateSkipped, time.Now()) {
+			log.Infof(ctx, `Next call (%s) is not "new": %s`, c.Key, c.Status)
+			return ErrNoSkippableCalls
+		}
+		log.Infof(ctx, "User's next call is %s", c.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := queue.Cancel(ctx, doCallKey(c.Key)); err != nil {
+		// doCall checks for skipped calls too, so this isn't fatal.
+		log.Errorf(ctx, "Cancel(%s): %v", doCallKey(c.Key), err)
+	}
+	return nil
+}
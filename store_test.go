@@ -0,0 +1,243 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	userPhone = "8675309"
+	zip       = "12345"
+)
+
+func TestMemStore(t *testing.T) {
+	testStore(t, newMemStore())
+}
+
+// testStore exercises a Store implementation.
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	now := time.Now()
+
+	// Users.
+	if _, err := s.GetUser(ctx, userPhone); err != ErrNoSuchUser {
+		t.Errorf("GetUser before PutUser: got %v, want ErrNoSuchUser", err)
+	}
+	if _, err := s.UpdateUser(ctx, userPhone, func(*User) error { return nil }); err != ErrNoSuchUser {
+		t.Errorf("UpdateUser before PutUser: got %v, want ErrNoSuchUser", err)
+	}
+	later := &User{PhoneNumber: "5551234", ZipCode: zip, NextCall: now.Add(time.Hour)}
+	earlier := &User{PhoneNumber: userPhone, ZipCode: zip, NextCall: now.Add(-2 * time.Hour)}
+	latest := &User{PhoneNumber: "5554321", ZipCode: zip, NextCall: now.Add(-time.Hour)}
+	for _, u := range []*User{later, earlier, latest} {
+		if err := s.PutUser(ctx, u); err != nil {
+			t.Fatalf("PutUser(%s): %v", u.PhoneNumber, err)
+		}
+	}
+	if u, err := s.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser: %v", err)
+	} else if u.ZipCode != zip || !u.NextCall.Equal(earlier.NextCall) {
+		t.Errorf("GetUser: got %+v, want %+v", u, earlier)
+	}
+	if us, err := s.CallableUsers(ctx, now); err != nil {
+		t.Errorf("CallableUsers: %v", err)
+	} else if len(us) != 2 || us[0].PhoneNumber != latest.PhoneNumber || us[1].PhoneNumber != earlier.PhoneNumber {
+		t.Errorf("CallableUsers: got %+v, want [%s %s]", us, latest.PhoneNumber, earlier.PhoneNumber)
+	}
+	if _, err := s.UpdateUser(ctx, userPhone, func(u *User) error {
+		u.NextCall = now.Add(24 * time.Hour)
+		return nil
+	}); err != nil {
+		t.Errorf("UpdateUser: %v", err)
+	}
+	if us, err := s.CallableUsers(ctx, now); err != nil {
+		t.Errorf("CallableUsers: %v", err)
+	} else if len(us) != 1 {
+		t.Errorf("CallableUsers after UpdateUser: got %+v, want 1 user", us)
+	}
+	if _, err := s.UpdateUser(ctx, latest.PhoneNumber, func(u *User) error {
+		u.Stopped = now
+		return nil
+	}); err != nil {
+		t.Errorf("UpdateUser: %v", err)
+	}
+	if us, err := s.CallableUsers(ctx, now); err != nil {
+		t.Errorf("CallableUsers: %v", err)
+	} else if len(us) != 0 {
+		t.Errorf("CallableUsers after stopping: got %+v, want none", us)
+	}
+	if us, err := s.ActiveUsers(ctx); err != nil {
+		t.Errorf("ActiveUsers: %v", err)
+	} else if len(us) != 2 {
+		t.Errorf("ActiveUsers: got %+v, want 2 users", us)
+	}
+	if err := s.DeleteUser(ctx, later.PhoneNumber); err != nil {
+		t.Errorf("DeleteUser: %v", err)
+	}
+	if _, err := s.GetUser(ctx, later.PhoneNumber); err != ErrNoSuchUser {
+		t.Errorf("GetUser after DeleteUser: got %v, want ErrNoSuchUser", err)
+	}
+
+	// Calls.
+	if _, err := s.LatestCall(ctx, userPhone); err != ErrNoSuchCall {
+		t.Errorf("LatestCall before PutCall: got %v, want ErrNoSuchCall", err)
+	}
+	first := &Call{Key: "first", From: userPhone, To: "5550000", Created: now.Add(-time.Minute), Status: "new"}
+	second := &Call{Key: "second", From: userPhone, To: "5550000", Created: now, Status: "new"}
+	for _, c := range []*Call{first, second} {
+		if err := s.PutCall(ctx, c); err != nil {
+			t.Fatalf("PutCall(%s): %v", c.Key, err)
+		}
+	}
+	if c, err := s.LatestCall(ctx, userPhone); err != nil {
+		t.Errorf("LatestCall: %v", err)
+	} else if c.Key != second.Key {
+		t.Errorf("LatestCall: got %s, want %s", c.Key, second.Key)
+	}
+	if cs, err := s.UserCalls(ctx, userPhone, 0); err != nil {
+		t.Errorf("UserCalls: %v", err)
+	} else if len(cs) != 2 || cs[0].Key != second.Key || cs[1].Key != first.Key {
+		t.Errorf("UserCalls: got %+v, want [second first]", cs)
+	}
+	if cs, err := s.UserCalls(ctx, userPhone, 1); err != nil {
+		t.Errorf("UserCalls: %v", err)
+	} else if len(cs) != 1 || cs[0].Key != second.Key {
+		t.Errorf("UserCalls(1): got %+v, want [second]", cs)
+	}
+	if cs, err := s.CallsSince(ctx, now.Add(-30*time.Second)); err != nil {
+		t.Errorf("CallsSince: %v", err)
+	} else if len(cs) != 1 || cs[0].Key != second.Key {
+		t.Errorf("CallsSince: got %+v, want [second]", cs)
+	}
+	if cs, err := s.UserCalls(ctx, "5559999", 0); err != nil || len(cs) != 0 {
+		t.Errorf("UserCalls for another user: got %+v, %v; want none", cs, err)
+	}
+	if _, err := s.CallBySID(ctx, "CA123"); err != ErrNoSuchCall {
+		t.Errorf("CallBySID before SetSID: got %v, want ErrNoSuchCall", err)
+	}
+	if err := s.SetSID(ctx, userPhone, first.Key, "CA123"); err != nil {
+		t.Errorf("SetSID: %v", err)
+	}
+	if c, err := s.CallBySID(ctx, "CA123"); err != nil {
+		t.Errorf("CallBySID: %v", err)
+	} else if c.Key != first.Key || c.Sid != "CA123" {
+		t.Errorf("CallBySID: got %+v, want %s", c, first.Key)
+	}
+	if _, err := s.UpdateCall(ctx, userPhone, first.Key, func(c *Call) error {
+		c.Status = "completed"
+		c.Duration = time.Minute
+		return nil
+	}); err != nil {
+		t.Errorf("UpdateCall: %v", err)
+	}
+	if c, err := s.GetCall(ctx, userPhone, first.Key); err != nil {
+		t.Errorf("GetCall: %v", err)
+	} else if c.Status != "completed" || c.Duration != time.Minute || c.Sid != "CA123" {
+		t.Errorf("GetCall after UpdateCall: got %+v", c)
+	}
+	if _, err := s.UpdateCall(ctx, userPhone, first.Key, func(c *Call) error {
+		c.Status = "busy"
+		return ErrNoSkippableCalls
+	}); err != ErrNoSkippableCalls {
+		t.Errorf("UpdateCall returning error: got %v, want ErrNoSkippableCalls", err)
+	}
+	if c, err := s.GetCall(ctx, userPhone, first.Key); err != nil {
+		t.Errorf("GetCall: %v", err)
+	} else if c.Status != "completed" {
+		t.Errorf("UpdateCall stored changes despite error: got %q", c.Status)
+	}
+	if _, err := s.GetCall(ctx, "5559999", first.Key); err != ErrNoSuchCall {
+		t.Errorf("GetCall for another user: got %v, want ErrNoSuchCall", err)
+	}
+
+	// Consent.
+	if _, err := s.LatestConsent(ctx, userPhone); err != ErrNoConsent {
+		t.Errorf("LatestConsent before AddConsent: got %v, want ErrNoConsent", err)
+	}
+	for _, e := range []*ConsentEvent{
+		{PhoneNumber: userPhone, Time: now.Add(-time.Hour), OptIn: true, Source: "sms", Keyword: "JOIN"},
+		{PhoneNumber: userPhone, Time: now, OptIn: false, Source: "sms", Keyword: "STOP"},
+		{PhoneNumber: "5559999", Time: now.Add(time.Hour), OptIn: true, Source: "sms", Keyword: "JOIN"},
+	} {
+		if err := s.AddConsent(ctx, e); err != nil {
+			t.Fatalf("AddConsent: %v", err)
+		}
+	}
+	if e, err := s.LatestConsent(ctx, userPhone); err != nil {
+		t.Errorf("LatestConsent: %v", err)
+	} else if e.OptIn || e.Keyword != "STOP" || !e.Time.Equal(now) {
+		t.Errorf("LatestConsent: got %+v, want the STOP", e)
+	}
+
+	// Rate limits.
+	for i := 1; i <= 2; i++ {
+		if b, err := s.UpdateBucket(ctx, "now:"+userPhone, func(b *Bucket) error {
+			b.Tokens++
+			b.Updated = now
+			return nil
+		}); err != nil {
+			t.Errorf("UpdateBucket: %v", err)
+		} else if b.Key != "now:"+userPhone || b.Tokens != float64(i) || !b.Updated.Equal(now) {
+			t.Errorf("UpdateBucket #%d: got %+v", i, b)
+		}
+	}
+	if _, err := s.UpdateBucket(ctx, "now:"+userPhone, func(b *Bucket) error {
+		b.Tokens = 100
+		return ErrNoSuchUser
+	}); err != ErrNoSuchUser {
+		t.Errorf("UpdateBucket returning error: got %v, want ErrNoSuchUser", err)
+	}
+	if b, err := s.UpdateBucket(ctx, "call:"+userPhone, func(*Bucket) error { return nil }); err != nil {
+		t.Errorf("UpdateBucket: %v", err)
+	} else if b.Tokens != 0 || !b.Updated.IsZero() {
+		t.Errorf("UpdateBucket for a new key: got %+v, want a new bucket", b)
+	}
+
+	// Analytics.
+	if _, err := s.GetOfficeStats(ctx, "5550000"); err != ErrNoStats {
+		t.Errorf("GetOfficeStats before PutOfficeStats: got %v, want ErrNoStats", err)
+	}
+	st := &OfficeStats{Phone: "5550000", Calls: 3, Answered: 2, Hours: make([]HourStats, 24), Updated: now}
+	st.Hours[10] = HourStats{Calls: 3, Answered: 2}
+	for _, st := range []*OfficeStats{st, {Phone: "5551111", Calls: 1, Hours: make([]HourStats, 24)}} {
+		if err := s.PutOfficeStats(ctx, st); err != nil {
+			t.Fatalf("PutOfficeStats: %v", err)
+		}
+	}
+	if got, err := s.GetOfficeStats(ctx, "5550000"); err != nil {
+		t.Errorf("GetOfficeStats: %v", err)
+	} else if got.Calls != 3 || got.Answered != 2 || got.Hours[10] != st.Hours[10] || !got.Updated.Equal(now) {
+		t.Errorf("GetOfficeStats: got %+v, want %+v", got, st)
+	}
+	if ss, err := s.AllOfficeStats(ctx); err != nil {
+		t.Errorf("AllOfficeStats: %v", err)
+	} else if len(ss) != 2 {
+		t.Errorf("AllOfficeStats: got %+v, want 2", ss)
+	}
+
+	// Events.
+	for i, status := range []string{"going", "scheduled"} {
+		if a, err := s.UpdateAttendee(ctx, "AIRDAY", userPhone, func(a *Attendee) error {
+			a.Status = status
+			a.Rep = Rep{Name: "Jane Doe", Offices: []Office{{Phone: "5550000"}}}
+			return nil
+		}); err != nil {
+			t.Errorf("UpdateAttendee: %v", err)
+		} else if a.Event != "AIRDAY" || a.PhoneNumber != userPhone || a.Status != status {
+			t.Errorf("UpdateAttendee #%d: got %+v", i, a)
+		}
+	}
+	if _, err := s.UpdateAttendee(ctx, "AIRDAY", "5551234", func(*Attendee) error { return ErrNoSuchEvent }); err != ErrNoSuchEvent {
+		t.Errorf("UpdateAttendee returning error: got %v, want ErrNoSuchEvent", err)
+	}
+	if _, err := s.UpdateAttendee(ctx, "OTHER", "5551234", func(*Attendee) error { return nil }); err != nil {
+		t.Errorf("UpdateAttendee: %v", err)
+	}
+	if as, err := s.Attendees(ctx, "AIRDAY"); err != nil {
+		t.Errorf("Attendees: %v", err)
+	} else if len(as) != 1 || as[0].Status != "scheduled" || as[0].Rep.PhoneNumber() != "5550000" {
+		t.Errorf("Attendees: got %+v, want 1 scheduled", as)
+	}
+}
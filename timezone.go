@@ -0,0 +1,246 @@
+package app
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zip3Zones maps ranges of the first three digits of ZIP codes to the time
+// zone most of each range is in. It's approximate where ranges straddle a
+// boundary; users can correct it with TIME.
+var zip3Zones = []struct {
+	lo, hi int
+	zone   string
+}{
+	{5, 5, "America/New_York"},
+	{6, 9, "America/Puerto_Rico"},
+	{10, 323, "America/New_York"},
+	{324, 325, "America/Chicago"}, // Florida panhandle
+	{326, 349, "America/New_York"},
+	{350, 372, "America/Chicago"},  // Alabama, middle Tennessee
+	{373, 379, "America/New_York"}, // East Tennessee
+	{380, 397, "America/Chicago"},
+	{398, 419, "America/New_York"},
+	{420, 421, "America/Chicago"}, // Western Kentucky
+	{422, 422, "America/New_York"},
+	{423, 424, "America/Chicago"},
+	{425, 462, "America/New_York"},
+	{463, 464, "America/Chicago"}, // Northwest Indiana
+	{465, 475, "America/New_York"},
+	{476, 477, "America/Chicago"}, // Southwest Indiana
+	{478, 499, "America/New_York"},
+	{500, 576, "America/Chicago"},
+	{577, 577, "America/Denver"}, // Western South Dakota
+	{580, 588, "America/Chicago"},
+	{590, 599, "America/Denver"},
+	{600, 692, "America/Chicago"},
+	{693, 693, "America/Denver"}, // Western Nebraska
+	{700, 797, "America/Chicago"},
+	{798, 799, "America/Denver"}, // El Paso
+	{800, 831, "America/Denver"},
+	{832, 837, "America/Boise"},
+	{838, 838, "America/Los_Angeles"}, // Northern Idaho
+	{840, 847, "America/Denver"},
+	{850, 865, "America/Phoenix"},
+	{870, 884, "America/Denver"},
+	{889, 961, "America/Los_Angeles"},
+	{967, 968, "Pacific/Honolulu"},
+	{969, 969, "Pacific/Guam"},
+	{970, 994, "America/Los_Angeles"},
+	{995, 999, "America/Anchorage"},
+}
+
+// zipTimeZone returns the IANA name of the time zone the ZIP code is in, or
+// "" if it's not known.
+func zipTimeZone(zip string) string {
+	if len(zip) < 3 {
+		return ""
+	}
+	n, err := strconv.Atoi(zip[:3])
+	if err != nil {
+		return ""
+	}
+	for _, z := range zip3Zones {
+		if z.lo <= n && n <= z.hi {
+			return z.zone
+		}
+	}
+	return ""
+}
+
+var (
+	locMu sync.Mutex
+	locs  = map[string]*time.Location{}
+)
+
+// loadLocation is time.LoadLocation, remembering what it's loaded.
+func loadLocation(name string) (*time.Location, error) {
+	locMu.Lock()
+	defer locMu.Unlock()
+	if l, found := locs[name]; found {
+		return l, nil
+	}
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locs[name] = l
+	return l, nil
+}
+
+// zoneNames are what users can call time zones in TIME.
+var zoneNames = map[string]string{
+	"ET": "America/New_York", "EST": "America/New_York", "EDT": "America/New_York", "EASTERN": "America/New_York",
+	"CT": "America/Chicago", "CST": "America/Chicago", "CDT": "America/Chicago", "CENTRAL": "America/Chicago",
+	"MT": "America/Denver", "MST": "America/Denver", "MDT": "America/Denver", "MOUNTAIN": "America/Denver",
+	"AZ": "America/Phoenix", "ARIZONA": "America/Phoenix",
+	"PT": "America/Los_Angeles", "PST": "America/Los_Angeles", "PDT": "America/Los_Angeles", "PACIFIC": "America/Los_Angeles",
+	"AKT": "America/Anchorage", "AKST": "America/Anchorage", "AKDT": "America/Anchorage", "ALASKA": "America/Anchorage",
+	"HT": "Pacific/Honolulu", "HST": "Pacific/Honolulu", "HAWAII": "Pacific/Honolulu",
+}
+
+var timeRangeRE = regexp.MustCompile(`^(\d{1,2})(?::00)? *(AM|PM)? *(?:-|TO) *(\d{1,2})(?::00)? *(AM|PM)?(?: +([A-Z]+))?$`)
+
+// parseTimeRange parses a range of hours like "9-11", "9AM-5PM" or "1 to 4
+// PT", returning hours since midnight and, if given, the IANA time zone.
+//
+// Hours without AM or PM are taken to mean daytime, so "1-4" is 1PM to 4PM,
+// and "9-5" is 9AM to 5PM.
+func parseTimeRange(s string) (start, end int, zone string, err error) {
+	m := timeRangeRE.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, 0, "", fmt.Errorf("%q isn't a range of hours", s)
+	}
+	start, _ = strconv.Atoi(m[1])
+	end, _ = strconv.Atoi(m[3])
+	if start > 12 || end > 12 {
+		// 24-hour times, like 13-17.
+		if m[2] != "" || m[4] != "" {
+			return 0, 0, "", fmt.Errorf("%q mixes 24-hour times and AM/PM", s)
+		}
+	} else {
+		start = hour12(start, m[2])
+		end = hour12(end, m[4])
+		if m[4] == "" && end <= start && end+12 <= 24 {
+			end += 12 // 9-5
+		}
+	}
+	if end == 0 {
+		end = 24 // Until midnight.
+	}
+	if start < 0 || end > 24 || start >= end {
+		return 0, 0, "", fmt.Errorf("%q isn't a range of hours in a day", s)
+	}
+	if m[5] != "" {
+		zone = zoneNames[m[5]]
+		if zone == "" {
+			return 0, 0, "", fmt.Errorf("unknown time zone %q", m[5])
+		}
+	}
+	return start, end, zone, nil
+}
+
+// hour12 converts an hour from 1 to 12, with AM, PM or neither, to hours
+// since midnight. Bare hours from 1 to 6 are PM, since nobody wants a call
+// at 3AM; a bare 12 is noon.
+func hour12(h int, ampm string) int {
+	switch {
+	case ampm == "AM" && h == 12:
+		return 0
+	case ampm == "AM":
+		return h
+	case ampm == "PM" && h == 12:
+		return 12
+	case ampm == "PM":
+		return h + 12
+	case h >= 1 && h <= 6:
+		return h + 12
+	}
+	return h
+}
+
+// formatHour formats hours since midnight like "9AM".
+func formatHour(h int) string {
+	switch {
+	case h == 0 || h == 24:
+		return "midnight"
+	case h == 12:
+		return "noon"
+	case h < 12:
+		return fmt.Sprintf("%dAM", h)
+	}
+	return fmt.Sprintf("%dPM", h-12)
+}
+
+// OfficeHours are when an office answers the phone. Offices are closed on
+// weekends, but users who choose to be called then can leave voicemail.
+type OfficeHours struct {
+	Start, End int // Hours since midnight in TimeZone.
+	TimeZone   string
+}
+
+// capitolHours are the usual hours of congressional offices in Washington.
+var capitolHours = OfficeHours{Start: 9, End: 17, TimeZone: "America/New_York"}
+
+func (h OfficeHours) location() *time.Location {
+	if l, err := loadLocation(h.TimeZone); err == nil {
+		return l
+	}
+	return cfg.Location()
+}
+
+// Open reports whether t is during the office's hours, on any day.
+func (h OfficeHours) Open(t time.Time) bool {
+	t = t.In(h.location())
+	return h.Start <= t.Hour() && t.Hour() < h.End
+}
+
+// on returns when the office opens and closes on the given date.
+func (h OfficeHours) on(y int, m time.Month, d int) (opens, closes time.Time) {
+	l := h.location()
+	return time.Date(y, m, d, h.Start, 0, 0, 0, l), time.Date(y, m, d, h.End, 0, 0, 0, l)
+}
+
+// callWindow returns when the user can be called on the given date in their
+// time zone: their window, when it overlaps the office's hours, or else the
+// office's hours.
+func callWindow(u User, h OfficeHours, y int, m time.Month, d int) (from, to time.Time) {
+	loc := u.Location()
+	ws, we := u.Window()
+	from, to = time.Date(y, m, d, ws, 0, 0, 0, loc), time.Date(y, m, d, we, 0, 0, 0, loc)
+	opens, closes := h.on(y, m, d)
+	if opens.After(from) {
+		from = opens
+	}
+	if closes.Before(to) {
+		to = closes
+	}
+	if !from.Before(to) {
+		return opens, closes
+	}
+	return from, to
+}
+
+// nextCallTime returns a random time on the user's next calling day after
+// now, in their time zone, during their calling window and the hours of the
+// offices they call.
+func nextCallTime(u User, now time.Time) time.Time {
+	now = now.In(u.Location())
+	y, m, d := u.Schedule().nextCallDay(now)
+	from, to := callWindow(u, u.officeHours(), y, m, d)
+
+	// Add a random number of seconds within the window.
+	r := time.Duration(rand.Int63n(int64(to.Sub(from).Seconds())))
+	return from.Add(r * time.Second)
+}
+
+// someTimeTomorrow returns a time for the user's next call, on their next
+// calling day.
+func someTimeTomorrow(u User) time.Time {
+	return nextCallTime(u, time.Now())
+}
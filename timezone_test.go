@@ -0,0 +1,128 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestZipTimeZone(t *testing.T) {
+	for _, c := range []struct{ zip, want string }{
+		{"10024", "America/New_York"},
+		{"10024-1234", "America/New_York"},
+		{"60601", "America/Chicago"},
+		{"32501", "America/Chicago"}, // Pensacola
+		{"79901", "America/Denver"},  // El Paso
+		{"85001", "America/Phoenix"},
+		{"94103", "America/Los_Angeles"},
+		{"96813", "Pacific/Honolulu"},
+		{"99501", "America/Anchorage"},
+		{"00000", ""},
+		{"", ""},
+	} {
+		if got := zipTimeZone(c.zip); got != c.want {
+			t.Errorf("zipTimeZone(%q): got %q, want %q", c.zip, got, c.want)
+		}
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	for _, c := range []struct {
+		s          string
+		start, end int
+		zone       string
+		wantErr    bool
+	}{
+		{s: "9-11", start: 9, end: 11},
+		{s: "9-5", start: 9, end: 17},
+		{s: "1-4", start: 13, end: 16},
+		{s: "9am-5pm", start: 9, end: 17},
+		{s: "9:00 AM - 12:00 PM", start: 9, end: 12},
+		{s: "11 to 2", start: 11, end: 14},
+		{s: "13-17", start: 13, end: 17},
+		{s: "9PM-12AM", start: 21, end: 24},
+		{s: "10-12 pt", start: 10, end: 12, zone: "America/Los_Angeles"},
+		{s: "10-12 Eastern", start: 10, end: 12, zone: "America/New_York"},
+		{s: "10-12 XT", wantErr: true},
+		{s: "5PM-9AM", wantErr: true},
+		{s: "13-5PM", wantErr: true},
+		{s: "noon", wantErr: true},
+	} {
+		start, end, zone, err := parseTimeRange(c.s)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeRange(%q): got %d, %d, want error", c.s, start, end)
+			}
+			continue
+		}
+		if err != nil || start != c.start || end != c.end || zone != c.zone {
+			t.Errorf("parseTimeRange(%q): got %d, %d, %q, %v; want %d, %d, %q", c.s, start, end, zone, err, c.start, c.end, c.zone)
+		}
+	}
+}
+
+func TestNextCallTime(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	wednesday := time.Date(2017, 3, 1, 10, 0, 0, 0, ny)
+	friday := time.Date(2017, 3, 3, 10, 0, 0, 0, ny)
+
+	for _, c := range []struct {
+		desc     string
+		u        User
+		now      time.Time
+		wantDay  time.Weekday
+		from, to int // Hours, in the user's time zone.
+	}{
+		{"default window", User{ZipCode: "10024"}, wednesday, time.Thursday, 12, 17},
+		{"Friday", User{ZipCode: "10024"}, friday, time.Monday, 12, 17},
+		{"own window", User{ZipCode: "10024", WindowStart: 9, WindowEnd: 10}, wednesday, time.Thursday, 9, 10},
+		// Offices close at 2PM Pacific.
+		{"Pacific", User{ZipCode: "94103"}, wednesday, time.Thursday, 12, 14},
+		// In winter, offices are open 4AM to noon Hawaii time, which
+		// doesn't overlap.
+		{"Hawaii", User{ZipCode: "96813"}, wednesday, time.Thursday, 4, 12},
+		{"TIME zone", User{ZipCode: "10024", TimeZone: "America/Chicago", WindowStart: 8, WindowEnd: 10}, wednesday, time.Thursday, 8, 10},
+	} {
+		loc := c.u.Location()
+		for i := 0; i < 20; i++ {
+			got := nextCallTime(c.u, c.now).In(loc)
+			if got.Weekday() != c.wantDay || got.Hour() < c.from || got.Hour() >= c.to {
+				t.Errorf("%s: nextCallTime: got %s, want %s between %d and %d", c.desc, got, c.wantDay, c.from, c.to)
+				break
+			}
+		}
+	}
+}
+
+func TestTimeCommand(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	if _, err := InsertUser(ctx, userPhone, "94103"); err != nil {
+		t.Fatalf("InsertUser: %v", err)
+	}
+	for _, c := range []struct{ text, want string }{
+		{"TIME 12-2", "We'll call you between noon and 2PM P"},
+		{"TIME 9-5", "so we'll call you between 9:00AM and 2:00PM"},
+		{"TIME 9-5 ET", "We'll call you between 9AM and 5PM E"},
+		{"TIME later", `Text "TIME <9AM-5PM>"`},
+		{"TIME 5-3", "Sorry"},
+	} {
+		u, err := store.GetUser(ctx, userPhone)
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		got, err := runCommand(ctx, userPhone, u, c.text)
+		if err != nil {
+			t.Errorf("runCommand(%q): %v", c.text, err)
+		} else if !strings.Contains(got, c.want) {
+			t.Errorf("runCommand(%q): got %q, want it to contain %q", c.text, got, c.want)
+		}
+	}
+	if u, err := store.GetUser(ctx, userPhone); err != nil {
+		t.Errorf("GetUser: %v", err)
+	} else if u.WindowStart != 9 || u.WindowEnd != 17 || u.TimeZone != "America/New_York" {
+		t.Errorf("User after TIME: got %+v", u)
+	}
+}
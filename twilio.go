@@ -1,137 +1,261 @@
 package app
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ImJasonH/makemecall/log"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
 const twilioBaseURL = "https://api.twilio.com"
 
-func respond(ctx context.Context, w http.ResponseWriter, r *Response) {
-	w.Header().Set("Content-Type", "application/xml")
-	b, err := xml.MarshalIndent(r, "", " ")
-	if err != nil {
-		log.Errorf(ctx, "xml.MarshalIndent: %v", err)
-	}
-	s := string(b)
-	log.Infof(ctx, "Responding: %s", s)
-	io.WriteString(w, s)
-}
+// Telephony is a carrier that can text and call users on our behalf, and
+// that calls us back with webhooks when users text or call us.
+type Telephony interface {
+	// SendSMS sends a text message.
+	SendSMS(ctx context.Context, to, text string) error
 
-type Response struct {
-	XMLName xml.Name `xml:"Response"`
-	Verbs   []Verb
-}
+	// SendCall calls the number to and, once they answer, connects them to
+	// the number dial. It returns the carrier's ID for the call.
+	SendCall(ctx context.Context, to, dial string) (string, error)
 
-type Verb interface {
-	isVerb()
-}
-type SMS struct {
-	XMLName xml.Name `xml:"Message"`
-	Text    string   `xml:",chardata"`
-}
+	// Authenticate checks that a webhook request was sent by the carrier.
+	Authenticate(r *http.Request) error
 
-func (SMS) isVerb() {}
+	// ParseInbound parses a webhook request sent by the carrier.
+	ParseInbound(r *http.Request) (*Inbound, error)
 
-type Dial struct {
-	XMLName xml.Name `xml:"Dial"`
-	Number  Number
+	// Respond writes a call-control response to a webhook request.
+	Respond(ctx context.Context, w http.ResponseWriter, r *Response)
 }
 
-func NewDial(n string) Dial {
-	return Dial{
-		Number: Number{
-			Number:              n,
-			StatusCallback:      host + "/callstatus",
-			StatusCallbackEvent: "initiated ringing answered completed",
-		},
-	}
+// Inbound is a webhook request from the carrier, about either an incoming
+// text or call, or a change in the status of a call.
+type Inbound struct {
+	From string
+	To   string
+	Body string // Text of an incoming SMS.
+	// Digits are the keys pressed during a <Gather>.
+	Digits string
+
+	CallSID       string
+	ParentCallSID string // Set for the child leg of a <Dial>.
+	CallStatus    string
+	Duration      time.Duration
+	// DialCallSID and DialCallStatus are the child leg's, sent to a
+	// <Dial>'s action once it's over.
+	DialCallSID    string
+	DialCallStatus string
+	// AnsweredBy is "human", or, e.g., "machine_start", if answering machine
+	// detection was on for the call.
+	AnsweredBy string
+
+	Params url.Values // All parameters, including those above.
 }
 
-func (Dial) isVerb() {}
+// phone is the carrier used to send texts and calls. It's set by Configure.
+var phone Telephony
 
-type Number struct {
-	XMLName             xml.Name `xml:"Number"`
-	Number              string   `xml:",chardata"`
-	StatusCallback      string   `xml:"statusCallback,attr,omitempty"`
-	StatusCallbackEvent string   `xml:"statusCallbackEvent,attr,omitempty"`
+// Twilio is a Telephony backed by Twilio's REST API.
+type Twilio struct {
+	SID     string // Account SID
+	Token   string // Auth token
+	From    string // Our phone number
+	BaseURL string
+	Host    string // Our public base URL, which Twilio sends webhooks to.
+
+	// SecondaryToken is also accepted when authenticating webhooks, so the
+	// auth token can be rotated without rejecting requests.
+	SecondaryToken string
 }
 
-type Say struct {
-	XMLName  xml.Name `xml:"Say"`
-	Text     string   `xml:",chardata"`
-	Voice    string   `xml:"voice,attr"`
-	Language string   `xml:"language,attr"`
+func (t *Twilio) Respond(ctx context.Context, w http.ResponseWriter, r *Response) {
+	respond(ctx, w, r)
 }
 
-func NewSay(s string) Say {
-	return Say{
-		Text:     s,
-		Voice:    "female",
-		Language: "en-gb",
+func respond(ctx context.Context, w http.ResponseWriter, r *Response) {
+	w.Header().Set("Content-Type", "application/xml")
+	b, err := xml.MarshalIndent(r, "", " ")
+	if err != nil {
+		log.Errorf(ctx, "xml.MarshalIndent: %v", err)
 	}
+	s := string(b)
+	log.Infof(ctx, "Responding: %s", s)
+	io.WriteString(w, s)
 }
 
-func (Say) isVerb() {}
-
 // TODO: Use message feedback to ensure delivery: https://www.twilio.com/docs/api/rest/message/feedback
-func SendSMS(ctx context.Context, to, text string) {
+func (t *Twilio) SendSMS(ctx context.Context, to, text string) error {
 	v := &url.Values{}
 	v.Set("To", to)
-	v.Set("From", twilioNumber)
+	v.Set("From", t.From)
 	v.Set("Body", text)
-	req, err := http.NewRequest("POST", twilioBaseURL+"/2010-04-01/Accounts/"+sid+"/Messages", strings.NewReader(v.Encode()))
+	req, err := http.NewRequest("POST", t.BaseURL+"/2010-04-01/Accounts/"+t.SID+"/Messages", strings.NewReader(v.Encode()))
 	if err != nil {
 		log.Errorf(ctx, "NewRequest: %v", err)
-		return
+		return err
 	}
-	do(ctx, req)
+	_, err = t.do(ctx, req)
+	return err
 }
 
-func SendCall(ctx context.Context, to, dial string) string {
+func (t *Twilio) SendCall(ctx context.Context, to, dial string) (string, error) {
 	v := &url.Values{}
 	v.Set("To", to)
-	v.Set("From", twilioNumber)
-	v.Set("Url", host+"/connect?dial="+dial)
-	req, err := http.NewRequest("POST", twilioBaseURL+"/2010-04-01/Accounts/"+sid+"/Calls", strings.NewReader(v.Encode()))
+	v.Set("From", t.From)
+	v.Set("Url", t.Host+"/connect?dial="+dial)
+	// Tell us how our call to the user goes, as well as theirs to the rep.
+	v.Set("StatusCallback", t.Host+"/callstatus")
+	for _, e := range []string{"initiated", "ringing", "answered", "completed"} {
+		v.Add("StatusCallbackEvent", e)
+	}
+	req, err := http.NewRequest("POST", t.BaseURL+"/2010-04-01/Accounts/"+t.SID+"/Calls", strings.NewReader(v.Encode()))
 	if err != nil {
 		log.Errorf(ctx, "NewRequest: %v", err)
-		return ""
+		return "", err
+	}
+	body, err := t.do(ctx, req)
+	if err != nil {
+		return "", err
 	}
-	body := do(ctx, req)
 
 	call := struct {
 		Sid string `xml:"Call>Sid"`
 	}{}
 	if err := xml.Unmarshal(body, &call); err != nil {
 		log.Errorf(ctx, "Unmarshal: %v", err)
-		return ""
+		return "", err
+	}
+	return call.Sid, nil
+}
+
+func (t *Twilio) ParseInbound(r *http.Request) (*Inbound, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	in := &Inbound{
+		From:          r.PostFormValue("From"),
+		To:            r.PostFormValue("To"),
+		Body:          r.PostFormValue("Body"),
+		Digits:        r.PostFormValue("Digits"),
+		CallSID:       r.PostFormValue("CallSid"),
+		ParentCallSID: r.PostFormValue("ParentCallSid"),
+		CallStatus:    r.PostFormValue("CallStatus"),
+		AnsweredBy:    r.PostFormValue("AnsweredBy"),
+
+		DialCallSID:    r.PostFormValue("DialCallSid"),
+		DialCallStatus: r.PostFormValue("DialCallStatus"),
+		Params:         r.PostForm,
+	}
+	if dur := r.PostFormValue("CallDuration"); dur != "" {
+		i, err := strconv.Atoi(dur)
+		if err != nil {
+			return nil, fmt.Errorf("bad CallDuration %q: %v", dur, err)
+		}
+		in.Duration = time.Duration(i) * time.Second
+	}
+	return in, nil
+}
+
+// ErrBadSignature is returned by Authenticate when a request's signature
+// doesn't match any of our tokens.
+var ErrBadSignature = errors.New("bad request signature")
+
+// Authenticate checks the request's X-Twilio-Signature header, which is an
+// HMAC of the URL Twilio requested and the POSTed parameters, signed with our
+// auth token.
+//
+// https://www.twilio.com/docs/api/security
+func (t *Twilio) Authenticate(r *http.Request) error {
+	want, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Twilio-Signature"))
+	if err != nil || len(want) == 0 {
+		return ErrBadSignature
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	u := t.publicURL(r)
+	for _, tok := range []string{t.Token, t.SecondaryToken} {
+		if tok == "" {
+			continue
+		}
+		if hmac.Equal(twilioSignature(tok, u, r.PostForm), want) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// publicURL reconstructs the URL Twilio requested.
+//
+// Behind App Engine's frontend or a reverse proxy, r.URL has only the path and
+// query, and r.Host may be an internal name, so the scheme and host come from
+// our configured public Host. Without one, we trust X-Forwarded-* headers.
+func (t *Twilio) publicURL(r *http.Request) string {
+	if t.Host != "" {
+		return t.Host + r.URL.RequestURI()
+	}
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// twilioSignature returns the HMAC-SHA1 Twilio computes for a request: the
+// URL, followed by each POST parameter's name and value, sorted by name.
+func twilioSignature(token, url string, params url.Values) []byte {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	msg := url
+	for _, k := range keys {
+		for _, v := range params[k] {
+			msg += k + v
+		}
 	}
-	return call.Sid
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
 }
 
 // do adds auth, sends request, logs errors and responses.
-func do(ctx context.Context, req *http.Request) []byte {
-	req.SetBasicAuth(sid, tok)
-	resp, err := urlfetch.Client(ctx).Do(req)
+func (t *Twilio) do(ctx context.Context, req *http.Request) ([]byte, error) {
+	req.SetBasicAuth(t.SID, t.Token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient(ctx).Do(req)
 	if err != nil {
-		log.Errorf(ctx, "urlfetch.Do: %v", err)
-		return nil
+		log.Errorf(ctx, "Do: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	all, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode >= http.StatusBadRequest {
 		log.Errorf(ctx, "Twilio response (%d): %s", resp.StatusCode, string(all))
-	} else {
-		log.Infof(ctx, "Twilio response (200): %s", string(all))
+		return nil, fmt.Errorf("twilio returned %d", resp.StatusCode)
 	}
-	return all
+	log.Infof(ctx, "Twilio response (%d): %s", resp.StatusCode, string(all))
+	return all, nil
 }
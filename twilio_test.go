@@ -0,0 +1,106 @@
+package app
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Example request from https://www.twilio.com/docs/api/security
+var (
+	exampleToken  = "12345"
+	exampleURL    = "https://mycompany.com/myapp.php?foo=1&bar=2"
+	exampleParams = url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+14158675309"},
+		"Digits":  {"1234"},
+		"From":    {"+14158675309"},
+		"To":      {"+18005551212"},
+	}
+	exampleSignature = "RSOYDt4T1cUTdK1PDd93/VVr8B8="
+)
+
+func TestTwilioSignature(t *testing.T) {
+	got := base64.StdEncoding.EncodeToString(twilioSignature(exampleToken, exampleURL, exampleParams))
+	if got != exampleSignature {
+		t.Errorf("twilioSignature: got %q, want %q", got, exampleSignature)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, c := range []struct {
+		desc      string
+		tw        Twilio
+		signature string
+		wantErr   bool
+	}{{
+		desc:      "good signature",
+		tw:        Twilio{Token: exampleToken, Host: "https://mycompany.com"},
+		signature: exampleSignature,
+		wantErr:   false,
+	}, {
+		desc:      "signed with secondary token",
+		tw:        Twilio{Token: "new-token", SecondaryToken: exampleToken, Host: "https://mycompany.com"},
+		signature: exampleSignature,
+		wantErr:   false,
+	}, {
+		desc:      "wrong token",
+		tw:        Twilio{Token: "54321", Host: "https://mycompany.com"},
+		signature: exampleSignature,
+		wantErr:   true,
+	}, {
+		desc:      "wrong host",
+		tw:        Twilio{Token: exampleToken, Host: "http://mycompany.com"},
+		signature: exampleSignature,
+		wantErr:   true,
+	}, {
+		desc:      "bad signature",
+		tw:        Twilio{Token: exampleToken, Host: "https://mycompany.com"},
+		signature: "XSOYDt4T1cUTdK1PDd93/VVr8B8=",
+		wantErr:   true,
+	}, {
+		desc:      "missing signature",
+		tw:        Twilio{Token: exampleToken, Host: "https://mycompany.com"},
+		signature: "",
+		wantErr:   true,
+	}} {
+		// Requests arrive from a proxy on an internal host name.
+		req := httptest.NewRequest("POST", "http://10.0.0.1:8080/myapp.php?foo=1&bar=2", strings.NewReader(exampleParams.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Twilio-Signature", c.signature)
+		if err := c.tw.Authenticate(req); (err != nil) != c.wantErr {
+			t.Errorf("%s: got err %v, want err %t", c.desc, err, c.wantErr)
+		}
+	}
+}
+
+func TestRouterRejectsUnsignedWebhooks(t *testing.T) {
+	defer func(p Telephony) { phone = p }(phone)
+	phone = &Twilio{Token: exampleToken, Host: "https://mycompany.com"}
+	h := NewRouter()
+	for _, path := range []string{
+		"/incomingcall", "/incomingcall/menu", "/incomingcall/zip", "/incomingtext",
+		"/connect", "/callstatus", "/gather", "/dialed", "/redial",
+	} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(exampleParams.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("POST %s: got %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestPublicURLFromProxyHeaders(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://10.0.0.1:8080/myapp.php?foo=1&bar=2", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "mycompany.com")
+	tw := &Twilio{}
+	if got := tw.publicURL(req); got != exampleURL {
+		t.Errorf("publicURL: got %q, want %q", got, exampleURL)
+	}
+}
@@ -0,0 +1,363 @@
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Response is TwiML, which tells Twilio what to do with a call or text.
+//
+// Verbs unmarshal as pointers, e.g., *Say, whether they were marshaled from
+// values or pointers.
+//
+// https://www.twilio.com/docs/voice/twiml
+type Response struct {
+	XMLName xml.Name `xml:"Response"`
+	Verbs   []Verb
+}
+
+type Verb interface {
+	isVerb()
+}
+
+// Noun is something a Dial connects to.
+type Noun interface {
+	isNoun()
+}
+
+// responseVerbs are the elements a Response may contain, gatherVerbs those a
+// Gather may, and dialNouns those a Dial may.
+var (
+	responseVerbs = map[string]func() interface{}{
+		"Say":      func() interface{} { return &Say{} },
+		"Play":     func() interface{} { return &Play{} },
+		"Pause":    func() interface{} { return &Pause{} },
+		"Gather":   func() interface{} { return &Gather{} },
+		"Record":   func() interface{} { return &Record{} },
+		"Dial":     func() interface{} { return &Dial{} },
+		"Message":  func() interface{} { return &SMS{} },
+		"Redirect": func() interface{} { return &Redirect{} },
+		"Hangup":   func() interface{} { return &Hangup{} },
+		"Reject":   func() interface{} { return &Reject{} },
+	}
+	gatherVerbs = map[string]func() interface{}{
+		"Say":   func() interface{} { return &Say{} },
+		"Play":  func() interface{} { return &Play{} },
+		"Pause": func() interface{} { return &Pause{} },
+	}
+	dialNouns = map[string]func() interface{}{
+		"Number":     func() interface{} { return &Number{} },
+		"Client":     func() interface{} { return &Client{} },
+		"Sip":        func() interface{} { return &Sip{} },
+		"Conference": func() interface{} { return &Conference{} },
+	}
+)
+
+func (r *Response) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	r.XMLName = start.Name
+	r.Verbs = nil
+	return unmarshalChildren(d, start, responseVerbs, func(v interface{}) { r.Verbs = append(r.Verbs, v.(Verb)) }, nil)
+}
+
+// unmarshalAttrs decodes start's attributes into v, without consuming any of
+// the element's contents from the decoder.
+func unmarshalAttrs(start xml.StartElement, v interface{}) error {
+	var b bytes.Buffer
+	e := xml.NewEncoder(&b)
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := e.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	return xml.Unmarshal(b.Bytes(), v)
+}
+
+// unmarshalChildren decodes each element inside start, up to its end, into a
+// value made by the function in types for the element's name, and passes it
+// to add. Character data is appended to text, if it's not nil.
+func unmarshalChildren(d *xml.Decoder, start xml.StartElement, types map[string]func() interface{}, add func(interface{}), text *string) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			newV, found := types[t.Name.Local]
+			if !found {
+				return fmt.Errorf("unexpected <%s> in <%s>", t.Name.Local, start.Name.Local)
+			}
+			v := newV()
+			if err := d.DecodeElement(v, &t); err != nil {
+				return err
+			}
+			add(v)
+		case xml.CharData:
+			if text != nil {
+				*text += string(t)
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+///////////
+// VERBS //
+///////////
+
+type Say struct {
+	XMLName  xml.Name `xml:"Say"`
+	Text     string   `xml:",chardata"`
+	Voice    string   `xml:"voice,attr,omitempty"`
+	Language string   `xml:"language,attr,omitempty"`
+	Loop     int      `xml:"loop,attr,omitempty"`
+}
+
+func NewSay(s string) Say {
+	return Say{
+		Text:     s,
+		Voice:    "female",
+		Language: "en-gb",
+	}
+}
+
+func (Say) isVerb() {}
+
+type Play struct {
+	XMLName xml.Name `xml:"Play"`
+	URL     string   `xml:",chardata"`
+	Loop    int      `xml:"loop,attr,omitempty"`
+	// Digits are played as tones instead of URL, e.g., "ww1234".
+	Digits string `xml:"digits,attr,omitempty"`
+}
+
+func (Play) isVerb() {}
+
+type Pause struct {
+	XMLName xml.Name `xml:"Pause"`
+	Length  int      `xml:"length,attr,omitempty"` // Seconds; Twilio's default is 1.
+}
+
+func (Pause) isVerb() {}
+
+// Gather plays its nested Say, Play and Pause verbs while waiting for the
+// caller to press keys, then requests Action with the Digits pressed. If they
+// press nothing, the verbs after it run instead.
+type Gather struct {
+	XMLName     xml.Name `xml:"Gather"`
+	Input       string   `xml:"input,attr,omitempty"` // "dtmf", "speech" or both.
+	NumDigits   int      `xml:"numDigits,attr,omitempty"`
+	Timeout     int      `xml:"timeout,attr,omitempty"` // Seconds.
+	FinishOnKey string   `xml:"finishOnKey,attr,omitempty"`
+	Action      string   `xml:"action,attr,omitempty"`
+	Method      string   `xml:"method,attr,omitempty"`
+	Verbs       []Verb
+}
+
+// NewGather returns a Gather of one key, which is POSTed to action.
+func NewGather(action string, vs ...Verb) Gather {
+	return Gather{
+		Input:     "dtmf",
+		NumDigits: 1,
+		Timeout:   10,
+		Action:    action,
+		Method:    "POST",
+		Verbs:     vs,
+	}
+}
+
+func (Gather) isVerb() {}
+
+func (g *Gather) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type attrs Gather // Without this method.
+	var a attrs
+	if err := unmarshalAttrs(start, &a); err != nil {
+		return err
+	}
+	*g = Gather(a)
+	return unmarshalChildren(d, start, gatherVerbs, func(v interface{}) { g.Verbs = append(g.Verbs, v.(Verb)) }, nil)
+}
+
+// Record records the caller, and requests Action with the RecordingUrl.
+type Record struct {
+	XMLName     xml.Name `xml:"Record"`
+	Action      string   `xml:"action,attr,omitempty"`
+	Method      string   `xml:"method,attr,omitempty"`
+	Timeout     int      `xml:"timeout,attr,omitempty"`   // Seconds of silence that end it.
+	MaxLength   int      `xml:"maxLength,attr,omitempty"` // Seconds.
+	FinishOnKey string   `xml:"finishOnKey,attr,omitempty"`
+	// PlayBeep is true if it's nil.
+	PlayBeep *bool  `xml:"playBeep,attr,omitempty"`
+	Trim     string `xml:"trim,attr,omitempty"` // "trim-silence" or "do-not-trim".
+
+	RecordingStatusCallback string `xml:"recordingStatusCallback,attr,omitempty"`
+	Transcribe              bool   `xml:"transcribe,attr,omitempty"`
+	TranscribeCallback      string `xml:"transcribeCallback,attr,omitempty"`
+}
+
+func (Record) isVerb() {}
+
+// Dial connects the caller to To, or to its Nouns.
+type Dial struct {
+	XMLName      xml.Name `xml:"Dial"`
+	Action       string   `xml:"action,attr,omitempty"`
+	Method       string   `xml:"method,attr,omitempty"`
+	Timeout      int      `xml:"timeout,attr,omitempty"`   // Seconds to ring.
+	TimeLimit    int      `xml:"timeLimit,attr,omitempty"` // Seconds.
+	CallerID     string   `xml:"callerId,attr,omitempty"`
+	HangupOnStar bool     `xml:"hangupOnStar,attr,omitempty"`
+	Record       string   `xml:"record,attr,omitempty"`
+	To           string   `xml:",chardata"` // A number, instead of Nouns.
+	Nouns        []Noun
+}
+
+func NewDial(n string) Dial {
+	return Dial{
+		Nouns: []Noun{Number{
+			Number:              n,
+			StatusCallback:      cfg.Host + "/callstatus",
+			StatusCallbackEvent: "initiated ringing answered completed",
+			MachineDetection:    "Enable",
+		}},
+	}
+}
+
+func (Dial) isVerb() {}
+
+func (dl *Dial) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type attrs Dial // Without this method.
+	var a attrs
+	if err := unmarshalAttrs(start, &a); err != nil {
+		return err
+	}
+	*dl = Dial(a)
+	if err := unmarshalChildren(d, start, dialNouns, func(v interface{}) { dl.Nouns = append(dl.Nouns, v.(Noun)) }, &dl.To); err != nil {
+		return err
+	}
+	dl.To = strings.TrimSpace(dl.To)
+	return nil
+}
+
+// SMS is a <Message>. Text is the message, unless it has Media, in which case
+// it's Body.
+type SMS struct {
+	XMLName        xml.Name `xml:"Message"`
+	To             string   `xml:"to,attr,omitempty"`
+	From           string   `xml:"from,attr,omitempty"`
+	Action         string   `xml:"action,attr,omitempty"`
+	Method         string   `xml:"method,attr,omitempty"`
+	StatusCallback string   `xml:"statusCallback,attr,omitempty"`
+	Text           string   `xml:",chardata"`
+	Body           string   `xml:"Body,omitempty"`
+	Media          []string `xml:"Media"` // URLs
+}
+
+// NewSMS returns a message of the text and any media.
+func NewSMS(text string, media ...string) SMS {
+	if len(media) == 0 {
+		return SMS{Text: text}
+	}
+	return SMS{Body: text, Media: media}
+}
+
+func (SMS) isVerb() {}
+
+// Redirect continues the call with the TwiML at URL.
+type Redirect struct {
+	XMLName xml.Name `xml:"Redirect"`
+	URL     string   `xml:",chardata"`
+	Method  string   `xml:"method,attr,omitempty"`
+}
+
+func (Redirect) isVerb() {}
+
+type Hangup struct {
+	XMLName xml.Name `xml:"Hangup"`
+}
+
+func (Hangup) isVerb() {}
+
+// Reject declines an incoming call without answering it, so it's free.
+type Reject struct {
+	XMLName xml.Name `xml:"Reject"`
+	Reason  string   `xml:"reason,attr,omitempty"` // "rejected" or "busy".
+}
+
+func (Reject) isVerb() {}
+
+///////////
+// NOUNS //
+///////////
+
+type Number struct {
+	XMLName    xml.Name `xml:"Number"`
+	Number     string   `xml:",chardata"`
+	SendDigits string   `xml:"sendDigits,attr,omitempty"`
+	// URL is TwiML run for whoever answers, before they're connected.
+	URL    string `xml:"url,attr,omitempty"`
+	Method string `xml:"method,attr,omitempty"`
+
+	StatusCallback       string `xml:"statusCallback,attr,omitempty"`
+	StatusCallbackEvent  string `xml:"statusCallbackEvent,attr,omitempty"`
+	StatusCallbackMethod string `xml:"statusCallbackMethod,attr,omitempty"`
+	// MachineDetection is "Enable" to tell status callbacks whether a person
+	// or a machine answered.
+	MachineDetection string `xml:"machineDetection,attr,omitempty"`
+}
+
+func (Number) isNoun() {}
+
+// Client is a Twilio Client app, by its identity.
+type Client struct {
+	XMLName  xml.Name `xml:"Client"`
+	Identity string   `xml:",chardata"`
+	URL      string   `xml:"url,attr,omitempty"`
+	Method   string   `xml:"method,attr,omitempty"`
+
+	StatusCallback      string `xml:"statusCallback,attr,omitempty"`
+	StatusCallbackEvent string `xml:"statusCallbackEvent,attr,omitempty"`
+}
+
+func (Client) isNoun() {}
+
+type Sip struct {
+	XMLName  xml.Name `xml:"Sip"`
+	URI      string   `xml:",chardata"` // e.g., "sip:jane@example.com"
+	Username string   `xml:"username,attr,omitempty"`
+	Password string   `xml:"password,attr,omitempty"`
+	URL      string   `xml:"url,attr,omitempty"`
+	Method   string   `xml:"method,attr,omitempty"`
+
+	StatusCallback      string `xml:"statusCallback,attr,omitempty"`
+	StatusCallbackEvent string `xml:"statusCallbackEvent,attr,omitempty"`
+}
+
+func (Sip) isNoun() {}
+
+// Conference is a conference room, by its name.
+type Conference struct {
+	XMLName xml.Name `xml:"Conference"`
+	Name    string   `xml:",chardata"`
+	Muted   bool     `xml:"muted,attr,omitempty"`
+	Beep    string   `xml:"beep,attr,omitempty"` // "true", "false", "onEnter" or "onExit".
+	// StartConferenceOnEnter is true if it's nil.
+	StartConferenceOnEnter *bool  `xml:"startConferenceOnEnter,attr,omitempty"`
+	EndConferenceOnExit    bool   `xml:"endConferenceOnExit,attr,omitempty"`
+	WaitURL                string `xml:"waitUrl,attr,omitempty"`
+	WaitMethod             string `xml:"waitMethod,attr,omitempty"`
+	MaxParticipants        int    `xml:"maxParticipants,attr,omitempty"`
+	Record                 string `xml:"record,attr,omitempty"`
+	Trim                   string `xml:"trim,attr,omitempty"`
+
+	StatusCallback      string `xml:"statusCallback,attr,omitempty"`
+	StatusCallbackEvent string `xml:"statusCallbackEvent,attr,omitempty"`
+}
+
+func (Conference) isNoun() {}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestTwiMLRoundTrip(t *testing.T) {
+	no := false
+	r := &Response{Verbs: []Verb{
+		NewSay("Hello"),
+		Say{Text: "Plain"},
+		Play{URL: "https://example.com/hold.mp3", Loop: 2},
+		Play{Digits: "ww1234"},
+		Pause{Length: 3},
+		NewGather("https://example.com/gather", NewSay("Press 1"), Pause{}, Play{URL: "https://example.com/beep.mp3"}),
+		Record{Action: "https://example.com/recorded", MaxLength: 60, PlayBeep: &no, Transcribe: true},
+		Dial{To: "5550000", CallerID: "5551111"},
+		Dial{Action: "https://example.com/dialed", Timeout: 20, Nouns: []Noun{
+			Number{Number: "5552222", SendDigits: "1234"},
+			Client{Identity: "jenny"},
+			Sip{URI: "sip:jenny@example.com", Username: "jenny"},
+		}},
+		Dial{Nouns: []Noun{Conference{Name: "mass call", Muted: true, StartConferenceOnEnter: &no, MaxParticipants: 10}}},
+		NewSMS("Hi"),
+		NewSMS("Look", "https://example.com/a.png", "https://example.com/b.png"),
+		Redirect{URL: "https://example.com/connect", Method: "POST"},
+		Reject{Reason: "busy"},
+		Hangup{},
+	}}
+	b, err := xml.Marshal(r)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got Response
+	if err := xml.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(got.Verbs) != len(r.Verbs) {
+		t.Fatalf("Unmarshal: got %d verbs, want %d", len(got.Verbs), len(r.Verbs))
+	}
+	again, err := xml.Marshal(got)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if string(again) != string(b) {
+		t.Errorf("Round trip:\ngot  %s\nwant %s", again, b)
+	}
+
+	if s := got.Verbs[0].(*Say); s.Text != "Hello" || s.Voice != "female" {
+		t.Errorf("Say: got %+v", s)
+	}
+	if g := got.Verbs[5].(*Gather); g.NumDigits != 1 || len(g.Verbs) != 3 || g.Verbs[0].(*Say).Text != "Press 1" {
+		t.Errorf("Gather: got %+v", g)
+	}
+	if rec := got.Verbs[6].(*Record); rec.PlayBeep == nil || *rec.PlayBeep || !rec.Transcribe {
+		t.Errorf("Record: got %+v", rec)
+	}
+	if d := got.Verbs[7].(*Dial); d.To != "5550000" || len(d.Nouns) != 0 {
+		t.Errorf("Dial with a number: got %+v", d)
+	}
+	if d := got.Verbs[8].(*Dial); len(d.Nouns) != 3 || d.Nouns[0].(*Number).SendDigits != "1234" || d.Nouns[2].(*Sip).Username != "jenny" {
+		t.Errorf("Dial with nouns: got %+v", d)
+	}
+	if m := got.Verbs[11].(*SMS); m.Body != "Look" || m.Text != "" || len(m.Media) != 2 {
+		t.Errorf("Message with media: got %+v", m)
+	}
+}
+
+func TestTwiMLAttributes(t *testing.T) {
+	yes := true
+	for _, c := range []struct {
+		v    Verb
+		want string
+	}{
+		{Say{Text: "hi"}, "<Say>hi</Say>"},
+		{NewSay("hi"), `<Say voice="female" language="en-gb">hi</Say>`},
+		{Pause{}, "<Pause></Pause>"},
+		{Record{PlayBeep: &yes}, `<Record playBeep="true"></Record>`},
+		{NewSMS("hi"), "<Message>hi</Message>"},
+		{NewSMS("hi", "https://example.com/a.png"), "<Message><Body>hi</Body><Media>https://example.com/a.png</Media></Message>"},
+		{Dial{Nouns: []Noun{Conference{Name: "room", EndConferenceOnExit: true}}}, `<Dial><Conference endConferenceOnExit="true">room</Conference></Dial>`},
+		{Hangup{}, "<Hangup></Hangup>"},
+	} {
+		b, err := xml.Marshal(c.v)
+		if err != nil {
+			t.Errorf("Marshal(%+v): %v", c.v, err)
+		} else if string(b) != c.want {
+			t.Errorf("Marshal(%+v): got %s, want %s", c.v, b, c.want)
+		}
+	}
+}
+
+func TestTwiMLUnmarshal(t *testing.T) {
+	var r Response
+	if err := xml.Unmarshal([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+  <Say voice="alice">Hello</Say>
+  <Dial timeout="10">
+    555-0000
+  </Dial>
+</Response>`), &r); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(r.Verbs) != 2 || r.Verbs[0].(*Say).Voice != "alice" || r.Verbs[1].(*Dial).To != "555-0000" || r.Verbs[1].(*Dial).Timeout != 10 {
+		t.Errorf("Unmarshal: got %+v", r.Verbs)
+	}
+
+	for _, bad := range []string{
+		"<Response><Number>5550000</Number></Response>",
+		"<Response><Gather><Dial>5550000</Dial></Gather></Response>",
+		"<Response><Dial><Say>hi</Say></Dial></Response>",
+	} {
+		if err := xml.Unmarshal([]byte(bad), &r); err == nil || !strings.Contains(err.Error(), "unexpected") {
+			t.Errorf("Unmarshal(%s): got %v, want an error", bad, err)
+		}
+	}
+}
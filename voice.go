@@ -0,0 +1,284 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ImJasonH/makemecall/log"
+	"golang.org/x/net/context"
+)
+
+// genericPoints are read to users who aren't calling about a campaign.
+const genericPoints = "Tell them your name and where you live, and what you'd like them to do. Be nice; the person you're talking to has a hard job."
+
+// scriptVerbs read the user their talking points for the call with the SID,
+// then ask them to press 1 to be connected to dial, or 2 to skip the call.
+// If they don't press anything, they're connected.
+func scriptVerbs(ctx context.Context, sid, dial string) []Verb {
+	action := cfg.Host + "/gather?dial=" + url.QueryEscape(dial)
+	return []Verb{
+		NewGather(action,
+			NewSay(talkingPoints(ctx, sid, dial)),
+			Pause{Length: 1},
+			NewSay("Press 1 to be connected, or 2 to skip this call."),
+		),
+		NewSay("Connecting you now."),
+		dialRep(dial),
+	}
+}
+
+// talkingPoints returns what to read the user before their call with the
+// SID: their campaign's script, if they're calling about one.
+func talkingPoints(ctx context.Context, sid, dial string) string {
+	c, err := store.CallBySID(ctx, sid)
+	if err != nil {
+		log.Warningf(ctx, "CallBySID(%q): %v", sid, err)
+		return "You're about to be connected to your representative. " + genericPoints
+	}
+	u, err := store.GetUser(ctx, c.From)
+	if err != nil {
+		log.Errorf(ctx, "GetUser(%s): %v", c.From, err)
+		return "You're about to be connected to " + c.RepName + ". " + genericPoints
+	}
+	rep := Rep{Name: c.RepName}
+	if reps, err := LookupReps(ctx, u.ZipCode); err == nil {
+		for _, r := range reps {
+			if _, i := r.office(dial); i >= 0 {
+				rep = r
+			}
+		}
+	}
+	msg := "You're about to be connected to " + spokenName(rep) + ". "
+	if camp, _ := userCampaign(*u, []Rep{rep}, time.Now()); camp != nil {
+		// Placeholders like "[your name]" are for the user to fill in.
+		script := strings.NewReplacer("[", "", "]", "").Replace(camp.ScriptFor(*u, rep))
+		return msg + "It's about " + camp.Title + ". Here's what you can say. " + script
+	}
+	return msg + genericPoints
+}
+
+// spokenName is the rep's name as it should be read aloud, e.g., "Senator
+// Jane Doe" instead of "Sen. Jane Doe".
+func spokenName(r Rep) string {
+	switch r.Chamber() {
+	case "senate":
+		return "Senator " + r.Name
+	case "house":
+		return "Representative " + r.Name
+	}
+	return r.Name
+}
+
+// gather handles the key the user pressed after hearing their talking
+// points: 1 connects them, 2 skips the call, and anything else repeats them.
+func gather(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dial := r.FormValue("dial")
+	if dial == "" {
+		log.Errorf(ctx, "Dial was not provided")
+		dial = cfg.TestNumber
+	}
+	log.Infof(ctx, "%s pressed %q", in.To, in.Digits)
+
+	var vs []Verb
+	switch in.Digits {
+	case "1":
+		vs = []Verb{NewSay("Connecting you now."), dialRep(dial)}
+	case "2":
+		if c, err := store.CallBySID(ctx, in.CallSID); err != nil {
+			log.Errorf(ctx, "CallBySID(%q): %v", in.CallSID, err)
+		} else if _, err := store.UpdateCall(ctx, c.From, c.Key, func(c *Call) error {
+			c.advance(LegNone, StateSkipped, time.Now())
+			return nil
+		}); err != nil {
+			log.Errorf(ctx, "UpdateCall(%s): %v", c.Key, err)
+		}
+		vs = []Verb{NewSay("OK, we'll skip this call. Talk to you next time!"), Hangup{}}
+	default:
+		vs = []Verb{
+			NewSay("Sorry, I didn't get that."),
+			Redirect{URL: cfg.Host + "/connect?dial=" + url.QueryEscape(dial), Method: "POST"},
+		}
+	}
+	phone.Respond(ctx, w, &Response{Verbs: vs})
+}
+
+// dialRep dials the rep's office, then has dialed offer another if nobody
+// answers.
+func dialRep(dial string) Dial {
+	d := NewDial(dial)
+	d.Action = cfg.Host + "/dialed?dial=" + url.QueryEscape(dial)
+	d.Method = "POST"
+	return d
+}
+
+// dialed runs once the user's call to the rep's office ends. If the office
+// was busy or didn't answer, it offers to connect them to another: one of the
+// rep's other offices, or another of their reps. Nothing's offered once
+// they've been connected to cfg.MaxDialAttempts offices.
+func dialed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dial := r.FormValue("dial")
+	log.Infof(ctx, "Call to %s ended: %s", dial, in.DialCallStatus)
+
+	var why string
+	state, err := parseCallState(in.DialCallStatus)
+	switch state {
+	case StateBusy:
+		why = "The line was busy."
+	case StateNoAnswer:
+		why = "Nobody answered."
+	case StateFailed:
+		why = "The call didn't go through."
+	default:
+		if err != nil {
+			log.Warningf(ctx, "dialed: %v", err)
+		}
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{Hangup{}}})
+		return
+	}
+	// The rep's leg's status callback may not have come yet, and redial
+	// needs to know which leg it was.
+	UpdateCallBySID(ctx, in.CallSID, LegStatus{Leg: LegRep, SID: in.DialCallSID, State: state})
+
+	c, err := store.CallBySID(ctx, in.CallSID)
+	if err != nil {
+		log.Errorf(ctx, "CallBySID(%q): %v", in.CallSID, err)
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{NewSay(why + " Goodbye!"), Hangup{}}})
+		return
+	}
+	rep, o, ok := nextOffice(ctx, c, dial, time.Now())
+	if !ok {
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{
+			NewSay(why + " Sorry, you can try again later. Goodbye!"),
+			Hangup{},
+		}})
+		return
+	}
+	g := NewGather(cfg.Host+"/redial?dial="+url.QueryEscape(o.Phone),
+		NewSay(fmt.Sprintf("%s To call %s's office in %s instead, press 1.", why, spokenName(rep), o.Name)))
+	g.NumDigits = 1
+	phone.Respond(ctx, w, &Response{Verbs: []Verb{g, NewSay("Goodbye!"), Hangup{}}})
+}
+
+// nextOffice returns the office to offer the user when dialing c's rep at
+// dial didn't work: another of the rep's offices, or else one of another of
+// their reps'. It only offers offices the user prefers, that are open at now,
+// and that they haven't dialed yet. It's false if there isn't one, or they've
+// dialed enough.
+func nextOffice(ctx context.Context, c *Call, dial string, now time.Time) (Rep, Office, bool) {
+	if len(c.Attempts)+1 >= cfg.MaxDialAttempts {
+		return Rep{}, Office{}, false
+	}
+	u, err := store.GetUser(ctx, c.From)
+	if err != nil {
+		log.Errorf(ctx, "GetUser(%s): %v", c.From, err)
+		return Rep{}, Office{}, false
+	}
+	reps, err := LookupReps(ctx, u.ZipCode)
+	if err != nil {
+		return Rep{}, Office{}, false
+	}
+	reps = inDistrict(reps, u.District)
+	if camp, targets := userCampaign(*u, reps, now); camp != nil {
+		reps = targets
+	}
+	dialed := map[string]bool{dial: true}
+	for _, l := range c.repLegs() {
+		dialed[l.To] = true
+	}
+	// The rep who was dialed goes first.
+	var others []Rep
+	for _, r := range reps {
+		if _, i := r.office(dial); i < 0 {
+			others = append(others, r)
+			continue
+		}
+		if o, ok := openOffice(*u, r, now, dialed); ok {
+			return r, o, true
+		}
+	}
+	for _, r := range others {
+		if o, ok := openOffice(*u, r, now, dialed); ok {
+			return r, o, true
+		}
+	}
+	return Rep{}, Office{}, false
+}
+
+// openOffice returns the first of the rep's offices the user prefers that's
+// open at now, and isn't in skip.
+func openOffice(u User, r Rep, now time.Time, skip map[string]bool) (Office, bool) {
+	for _, o := range r.officesFor(u) {
+		if !skip[o.Phone] && o.OpenHours().Open(now) {
+			return o, true
+		}
+	}
+	return Office{}, false
+}
+
+// redial handles the key the user pressed after dialed's offer: 1 connects
+// them to the office.
+func redial(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := newContext(r)
+
+	in, err := phone.ParseInbound(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dial := r.FormValue("dial")
+	log.Infof(ctx, "%s pressed %q", in.To, in.Digits)
+	if in.Digits != "1" || dial == "" {
+		phone.Respond(ctx, w, &Response{Verbs: []Verb{NewSay("OK. Talk to you next time!"), Hangup{}}})
+		return
+	}
+
+	if c, err := store.CallBySID(ctx, in.CallSID); err != nil {
+		log.Errorf(ctx, "CallBySID(%q): %v", in.CallSID, err)
+	} else {
+		name := dial
+		if u, err := store.GetUser(ctx, c.From); err == nil {
+			reps, _ := LookupReps(ctx, u.ZipCode)
+			for _, r := range reps {
+				if _, i := r.office(dial); i >= 0 {
+					name = r.Title() + r.Name
+				}
+			}
+		}
+		if _, err := store.UpdateCall(ctx, c.From, c.Key, func(c *Call) error {
+			c.redial(dial, name)
+			return nil
+		}); err != nil {
+			log.Errorf(ctx, "UpdateCall(%s): %v", c.Key, err)
+		}
+	}
+	phone.Respond(ctx, w, &Response{Verbs: []Verb{NewSay("Connecting you now."), dialRep(dial)}})
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// postWebhook POSTs params to the handler, and returns the response body.
+func postWebhook(h func(w http.ResponseWriter, r *http.Request), target string, params url.Values) string {
+	req := httptest.NewRequest("POST", target, strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w.Body.String()
+}
+
+func TestVoiceScript(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(c Config, cs []*Campaign, d RepProvider, p Telephony) {
+		cfg, campaigns, directory, phone = c, cs, d, p
+	}(cfg, campaigns, directory, phone)
+	cfg.Host = "https://example.com"
+	var err error
+	if campaigns, err = loadCampaigns("testdata/campaigns.yaml"); err != nil {
+		t.Fatalf("loadCampaigns: %v", err)
+	}
+	directory = &fakeReps{reps: []Rep{senator, houseRep}}
+	phone = &fakePhone{}
+
+	u := User{PhoneNumber: userPhone, ZipCode: zip, Name: "Jenny", Campaigns: []string{"EPW"}}
+	if err := store.PutUser(ctx, &u); err != nil {
+		t.Fatalf("PutUser: %v", err)
+	}
+	c, err := InsertCall(ctx, userPhone, senator, senator.mainOffice())
+	if err != nil {
+		t.Fatalf("InsertCall: %v", err)
+	}
+	if err := store.SetSID(ctx, userPhone, c.Key, "CA1"); err != nil {
+		t.Fatalf("SetSID: %v", err)
+	}
+
+	// Without VoiceScript, the user's connected right away.
+	params := url.Values{"CallSid": {"CA1"}, "To": {userPhone}}
+	if got := postWebhook(connect, "/connect?dial="+senator.PhoneNumber(), params); strings.Contains(got, "<Gather") {
+		t.Errorf("/connect without VoiceScript: got %s", got)
+	}
+
+	cfg.VoiceScript = true
+	got := postWebhook(connect, "/connect?dial="+senator.PhoneNumber(), params)
+	for _, want := range []string{
+		`<Gather input="dtmf" numDigits="1" timeout="10" action="https://example.com/gather?dial=2022240001" method="POST">`,
+		"connected to Senator Jane Doe. It&#39;s about Fund the EPA. Here&#39;s what you can say. Please ask Senator Jane Doe to fully fund the EPA.",
+		`<Pause length="1"></Pause>`,
+		"Press 1 to be connected, or 2 to skip this call.",
+		"</Gather>",
+		"<Number statusCallback",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/connect with VoiceScript: got %s, want it to contain %s", got, want)
+		}
+	}
+	if got := postWebhook(connect, "/connect?dial="+senator.PhoneNumber(), url.Values{"CallSid": {"CA2"}}); !strings.Contains(got, "your representative. Tell them your name") {
+		t.Errorf("/connect for an unknown call: got %s", got)
+	}
+
+	for _, c := range []struct{ digits, want string }{
+		{"1", ">2022240001</Number>"},
+		{"9", `<Redirect method="POST">https://example.com/connect?dial=2022240001</Redirect>`},
+		{"2", "<Hangup></Hangup>"},
+	} {
+		params := url.Values{"CallSid": {"CA1"}, "To": {userPhone}, "Digits": {c.digits}}
+		if got := postWebhook(gather, "/gather?dial="+senator.PhoneNumber(), params); !strings.Contains(got, c.want) {
+			t.Errorf("/gather %s: got %s, want it to contain %s", c.digits, got, c.want)
+		}
+	}
+	if c, err := store.GetCall(ctx, userPhone, c.Key); err != nil {
+		t.Errorf("GetCall: %v", err)
+	} else if c.Status != "skipped" {
+		t.Errorf("Call after pressing 2: got status %q, want skipped", c.Status)
+	}
+}
+
+func TestDialedOffersAnotherOffice(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(c Config, d RepProvider, p Telephony) {
+		cfg, directory, phone = c, d, p
+	}(cfg, directory, phone)
+	cfg.Host = "https://example.com"
+	cfg.MaxDialAttempts = 3
+	phone = &fakePhone{}
+	allDay := OfficeHours{Start: 0, End: 24}
+	sen, rep := senator, houseRep
+	sen.Offices = []Office{{Name: dcOffice, Phone: senator.PhoneNumber(), Hours: allDay}, {Name: "Albany", Phone: "5185550001", Hours: allDay}}
+	rep.Offices = []Office{{Phone: houseRep.PhoneNumber(), Hours: allDay}}
+	directory = &fakeReps{reps: []Rep{sen, rep}}
+
+	if err := store.PutUser(ctx, &User{PhoneNumber: userPhone, ZipCode: zip, Office: officeAny}); err != nil {
+		t.Fatalf("PutUser: %v", err)
+	}
+	c, err := InsertCall(ctx, userPhone, sen, sen.mainOffice())
+	if err != nil {
+		t.Fatalf("InsertCall: %v", err)
+	}
+	if err := store.SetSID(ctx, userPhone, c.Key, "CA1"); err != nil {
+		t.Fatalf("SetSID: %v", err)
+	}
+
+	for _, s := range []struct {
+		dial, status, sid, want string
+		next                    string // Offered next, if anything.
+	}{
+		{sen.PhoneNumber(), "busy", "CA2", "The line was busy. To call Senator Jane Doe&#39;s office in Albany instead, press 1.", "5185550001"},
+		{"5185550001", "no-answer", "CA3", "Nobody answered. To call Representative Harriet House&#39;s office in ", houseRep.PhoneNumber()},
+		{houseRep.PhoneNumber(), "busy", "CA4", "The line was busy. Sorry, you can try again later.", ""},
+	} {
+		params := url.Values{"CallSid": {"CA1"}, "DialCallSid": {s.sid}, "DialCallStatus": {s.status}}
+		got := postWebhook(dialed, "/dialed?dial="+s.dial, params)
+		if !strings.Contains(got, s.want) {
+			t.Errorf("/dialed %s %s: got %s, want it to contain %s", s.dial, s.status, got, s.want)
+		}
+		if s.next == "" {
+			if strings.Contains(got, "/redial") {
+				t.Errorf("/dialed %s %s: got %s, want no offer", s.dial, s.status, got)
+			}
+			continue
+		}
+		if !strings.Contains(got, `action="https://example.com/redial?dial=`+s.next+`"`) {
+			t.Errorf("/dialed %s %s: got %s, want an offer of %s", s.dial, s.status, got, s.next)
+		}
+		params = url.Values{"CallSid": {"CA1"}, "Digits": {"1"}}
+		got = postWebhook(redial, "/redial?dial="+s.next, params)
+		if want := `<Dial action="https://example.com/dialed?dial=` + s.next + `" method="POST">`; !strings.Contains(got, want) {
+			t.Errorf("/redial %s: got %s, want it to contain %s", s.next, got, want)
+		}
+	}
+
+	// A late status for the first office's leg doesn't count for the third.
+	postWebhook(callStatus, "/callstatus", url.Values{"CallSid": {"CA2"}, "ParentCallSid": {"CA1"}, "CallStatus": {"completed"}})
+	c, err = store.GetCall(ctx, userPhone, c.Key)
+	if err != nil {
+		t.Fatalf("GetCall: %v", err)
+	}
+	var dialedTo []string
+	for _, l := range c.repLegs() {
+		dialedTo = append(dialedTo, l.To+" "+string(l.State))
+	}
+	want := []string{sen.PhoneNumber() + " busy", "5185550001 no-answer", houseRep.PhoneNumber() + " busy"}
+	if !reflect.DeepEqual(dialedTo, want) {
+		t.Errorf("Rep legs: got %q, want %q", dialedTo, want)
+	}
+	if c.RepName != "Rep. Harriet House" {
+		t.Errorf("RepName: got %q, want Rep. Harriet House", c.RepName)
+	}
+
+	params := url.Values{"CallSid": {"CA1"}, "Digits": {""}}
+	if got := postWebhook(redial, "/redial?dial=5185550001", params); strings.Contains(got, "<Dial") {
+		t.Errorf("/redial without pressing 1: got %s", got)
+	}
+}
+
+func TestNextOffice(t *testing.T) {
+	ctx := context.Background()
+	store = newMemStore()
+	defer func(c Config, d RepProvider) { cfg, directory = c, d }(cfg, directory)
+	cfg.MaxDialAttempts = 3
+	ny, _ := time.LoadLocation("America/New_York")
+	afternoon := time.Date(2017, 3, 1, 15, 0, 0, 0, ny)
+	evening := time.Date(2017, 3, 1, 18, 0, 0, 0, ny) // 3PM in Los Angeles.
+	sen, rep := senator, houseRep
+	sen.Offices = []Office{{Name: dcOffice, Phone: "2022240001"}, {Name: "Albany", Phone: "5185550001"}}
+	rep.Offices = []Office{{Name: dcOffice, Phone: "2022250001"}, {Name: "Los Angeles", Phone: "2135550001", TimeZone: "America/Los_Angeles"}}
+	directory = &fakeReps{reps: []Rep{sen, rep}}
+
+	for _, c := range []struct {
+		pref, dial string
+		now        time.Time
+		want       string // Phone, or "" for none.
+	}{
+		{"", "2022240001", afternoon, "2022250001"},
+		{officeLocal, "5185550001", afternoon, "2135550001"},
+		{officeLocal, "5185550001", evening, "2135550001"},
+		{officeAny, "2022240001", afternoon, "5185550001"},
+		{officeAny, "2022240001", evening, "2135550001"},
+		{officeDC, "2022240001", evening, ""},
+	} {
+		if err := store.PutUser(ctx, &User{PhoneNumber: userPhone, ZipCode: zip, Office: c.pref}); err != nil {
+			t.Fatalf("PutUser: %v", err)
+		}
+		call := &Call{From: userPhone, To: c.dial}
+		_, o, ok := nextOffice(ctx, call, c.dial, c.now)
+		if c.want == "" && ok {
+			t.Errorf("nextOffice(%q, %s, %v): got %+v, want none", c.pref, c.dial, c.now, o)
+		} else if c.want != "" && (!ok || o.Phone != c.want) {
+			t.Errorf("nextOffice(%q, %s, %v): got %+v, %t; want %s", c.pref, c.dial, c.now, o, ok, c.want)
+		}
+	}
+}